@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// deletionConfirmLifetime is how long the confirmation of an account deletion stays valid
+const deletionConfirmLifetime = 10 * time.Minute
+
+// pendingDeletions are the account deletions waiting to be confirmed, keyed by uid. Like the sessions they only live
+// in memory, a restart means asking for a new confirmation.
+var (
+	pendingDeletions   = map[string]pendingDeletion{}
+	pendingDeletionsMu sync.Mutex
+)
+
+type pendingDeletion struct {
+	confirmation string
+	expiresAt    time.Time
+}
+
+// exportNotes is notes.json in the export
+type exportNotes struct {
+	Ids []string `json:"ids"`
+	// Truncated is true when the index has more notes than pinecone lets a query return
+	Truncated bool   `json:"truncated"`
+	Error     string `json:"error,omitempty"`
+}
+
+// exportAccountEndpoint is the endpoint at GET /api/account/export, it answers with a zip of everything opennote
+// keeps about the user. Secrets are redacted, the conversation is the one of the live session since conversations
+// aren't stored.
+func exportAccountEndpoint(c *gin.Context) {
+	uid := authenticatedUid(c)
+	user, err := findUser(c.Request.Context(), uid)
+	if errors.Is(err, errUserNotFound) {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: NonExistentUser,
+			Content:   "Unable to find user",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Data Format Error",
+		})
+		return
+	}
+
+	ctx := c.Request.Context()
+	files := map[string]any{
+		"settings.json": user.Settings(),
+	}
+
+	files["conversation.json"] = []any{}
+	if sess := GetSessionIfExists(uid); sess != nil {
+		files["conversation.json"] = sess.conversation()
+	}
+
+	if firestoreClient != nil {
+		usage, err := listUsage(ctx, uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, RequestErrorResult{
+				ErrorCode: FirestoreError,
+				Content:   "Unable to read usage",
+			})
+			return
+		}
+		files["usage.json"] = usage
+		tokens, err := listAccessTokens(ctx, uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, RequestErrorResult{
+				ErrorCode: FirestoreError,
+				Content:   "Unable to read access tokens",
+			})
+			return
+		}
+		files["tokens.json"] = tokens
+	}
+
+	// the notes live in the users own pinecone index, an export still works if it can't be reached
+	_, index := newClients(user)
+	notes := exportNotes{}
+	notes.Ids, notes.Truncated, err = listNoteIds(ctx, index)
+	if err != nil {
+		notes.Ids = []string{}
+		notes.Error = "unable to reach the pinecone index"
+	}
+	files["notes.json"] = notes
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="opennote-export.zip"`)
+	c.Status(http.StatusOK)
+	archive := zip.NewWriter(c.Writer)
+	for _, name := range []string{"settings.json", "conversation.json", "usage.json", "tokens.json", "notes.json"} {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		w, err := archive.Create(name)
+		if err == nil {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(content)
+		}
+		if err != nil {
+			log.Ctx(c.Request.Context()).Error().
+				Err(err).
+				Str("User", uid).
+				Msg("Unable to write account export")
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", uid).
+			Msg("Unable to write account export")
+	}
+}
+
+// DeleteAccountResponse is the response of /api/account/delete, the confirmation has to be sent to
+// /api/account/delete/confirm before ExpiresAt for the account to be deleted.
+type DeleteAccountResponse struct {
+	Confirmation string    `json:"confirmation"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	// Deletes lists what confirming deletes
+	Deletes []string `json:"deletes"`
+}
+
+// requestDeletionEndpoint is the endpoint at /api/account/delete, it is the first step of deleting an account and only
+// hands out a confirmation, nothing is deleted yet.
+func requestDeletionEndpoint(c *gin.Context) {
+	uid := authenticatedUid(c)
+	confirmation, err := newSecret("ond_")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to start account deletion",
+		})
+		return
+	}
+	expiresAt := time.Now().Add(deletionConfirmLifetime)
+	pendingDeletionsMu.Lock()
+	pendingDeletions[uid] = pendingDeletion{confirmation: confirmation, expiresAt: expiresAt}
+	pendingDeletionsMu.Unlock()
+
+	c.JSON(http.StatusOK, DeleteAccountResponse{
+		Confirmation: confirmation,
+		ExpiresAt:    expiresAt,
+		Deletes: []string{
+			"your settings and stored API keys",
+			"every note in your pinecone index",
+			"your access tokens and the apps you authorized",
+			"your usage history",
+			"the workspaces you own, and your membership in the others",
+			"your login, if you signed up with a username and password",
+		},
+	})
+}
+
+// ConfirmDeletionRequest is the request sent to /api/account/delete/confirm
+type ConfirmDeletionRequest struct {
+	Confirmation string `json:"confirmation"`
+}
+
+// DeletionResult is the response of /api/account/delete/confirm, NotesDeleted is false if the pinecone index couldn't
+// be reached, the rest of the account is deleted anyway.
+type DeletionResult struct {
+	NotesDeleted bool `json:"notes_deleted"`
+}
+
+// confirmDeletionEndpoint is the endpoint at /api/account/delete/confirm, it deletes the account if the confirmation
+// from /api/account/delete matches.
+func confirmDeletionEndpoint(c *gin.Context) {
+	var request ConfirmDeletionRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	uid := authenticatedUid(c)
+	pendingDeletionsMu.Lock()
+	pending, ok := pendingDeletions[uid]
+	valid := ok && time.Now().Before(pending.expiresAt) &&
+		subtle.ConstantTimeCompare([]byte(pending.confirmation), []byte(request.Confirmation)) == 1
+	if valid {
+		delete(pendingDeletions, uid)
+	}
+	pendingDeletionsMu.Unlock()
+	if !valid {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid or expired confirmation",
+		})
+		return
+	}
+
+	// a client that disconnects halfway mustn't leave a half deleted account, so only the logger of the request is kept
+	ctx := log.Ctx(c.Request.Context()).WithContext(context.Background())
+	result, err := deleteAccount(ctx, uid)
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", uid).
+			Msg("Unable to delete account")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to delete account",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// deleteAccount removes everything stored about the user. The notes are deleted first while the credentials to reach
+// them still exist, the session is evicted last so nothing recreates data in between.
+func deleteAccount(ctx context.Context, uid string) (DeletionResult, error) {
+	result := DeletionResult{}
+	// only users/{uid} is deleted, legacy documents of the user would keep their keys
+	if err := checkUsersMigrated(ctx, uid); err != nil {
+		return result, err
+	}
+	user, err := findUser(ctx, uid)
+	switch {
+	case err == nil:
+		_, index := newClients(user)
+		if err := deleteAllNotes(ctx, index); err != nil {
+			log.Ctx(ctx).Warn().
+				Err(err).
+				Str("User", uid).
+				Msg("Unable to delete notes of deleted account")
+		} else {
+			result.NotesDeleted = true
+		}
+	case !errors.Is(err, errUserNotFound):
+		return result, err
+	}
+
+	if firestoreClient != nil {
+		if err := revokeAccessTokens(ctx, uid); err != nil {
+			return result, err
+		}
+		if err := revokeOAuthGrants(ctx, uid); err != nil {
+			return result, err
+		}
+		if err := deleteUsage(ctx, uid); err != nil {
+			return result, err
+		}
+		if err := leaveWorkspaces(ctx, uid); err != nil {
+			return result, err
+		}
+	}
+	if err := userStore.Delete(ctx, uid); err != nil {
+		return result, err
+	}
+	if local := localAuth(); local != nil {
+		if err := local.DeleteAccount(uid); err != nil {
+			return result, err
+		}
+	}
+	RemoveSession(uid)
+	log.Ctx(ctx).Info().
+		Str("User", uid).
+		Bool("NotesDeleted", result.NotesDeleted).
+		Msg("Deleted account")
+	return result, nil
+}
+
+// deleteWhere deletes every document of the collection whose field equals value
+func deleteWhere(ctx context.Context, collection string, field string, value string) error {
+	docs, err := firestoreClient.Collection(collection).Where(field, "==", value).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if _, err := doc.Ref.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
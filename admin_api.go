@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bearerMatches reports whether the request sent token as its bearer token, in constant time
+func bearerMatches(c *gin.Context, token string) bool {
+	sent, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(sent), []byte(token)) == 1
+}
+
+// requireAdmin is the middleware of the admin api, it answers 404 when no admin token is configured so a server
+// without one doesn't show that the api exists
+func requireAdmin(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		if !bearerMatches(c, token) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, RequestErrorResult{
+				ErrorCode: InvalidRequestContent,
+				Content:   "Invalid admin token",
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// AdminSession is a session in memory as the admin api lists it, Workspaces are the ids of the workspaces the
+// conversation searches besides the personal index.
+type AdminSession struct {
+	Uid         string    `json:"uid"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Personal    bool      `json:"personal"`
+	Workspaces  []string  `json:"workspaces"`
+	RecentNotes int       `json:"recent_notes"`
+}
+
+// ListSessionsResponse is the response of /admin/sessions, sorted by uid
+type ListSessionsResponse struct {
+	Sessions []AdminSession `json:"sessions"`
+}
+
+// listSessionsEndpoint is the endpoint at /admin/sessions
+func listSessionsEndpoint(c *gin.Context) {
+	type liveSession struct {
+		s         *session
+		expiresAt time.Time
+	}
+	sessionsMutex.Lock()
+	live := make([]liveSession, 0, len(sessions))
+	for _, s := range sessions {
+		live = append(live, liveSession{s: s, expiresAt: s.deleteTime})
+	}
+	sessionsMutex.Unlock()
+
+	resp := ListSessionsResponse{Sessions: []AdminSession{}}
+	for _, l := range live {
+		scope := l.s.searchScope()
+		listed := AdminSession{
+			Uid:         l.s.uid(),
+			ExpiresAt:   l.expiresAt,
+			Personal:    scope.personal,
+			Workspaces:  []string{},
+			RecentNotes: len(l.s.notes()),
+		}
+		for _, workspace := range scope.workspaces {
+			listed.Workspaces = append(listed.Workspaces, workspace.id)
+		}
+		resp.Sessions = append(resp.Sessions, listed)
+	}
+	sort.Slice(resp.Sessions, func(i, j int) bool {
+		return resp.Sessions[i].Uid < resp.Sessions[j].Uid
+	})
+	c.JSON(http.StatusOK, resp)
+}
+
+// EvictSessionRequest is the request sent to /admin/sessions/evict
+type EvictSessionRequest struct {
+	Uid string `json:"uid"`
+}
+
+// EvictSessionResponse is the response of /admin/sessions/evict, Evicted is false if the user had no session
+type EvictSessionResponse struct {
+	Evicted bool `json:"evicted"`
+}
+
+// evictSessionEndpoint is the endpoint at /admin/sessions/evict, it drops the session of a user so their next request
+// starts over from the stored settings. Streams that are running keep the session they started with until they end.
+func evictSessionEndpoint(c *gin.Context) {
+	var request EvictSessionRequest
+	if err := c.BindJSON(&request); err != nil || request.Uid == "" {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	evicted := GetSessionIfExists(request.Uid) != nil
+	RemoveSession(request.Uid)
+	log.Ctx(c.Request.Context()).Info().
+		Str("User", request.Uid).
+		Bool("Evicted", evicted).
+		Msg("Evicted session through the admin api")
+	c.JSON(http.StatusOK, EvictSessionResponse{Evicted: evicted})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"github.com/abimek/opennote/routing"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+)
+
+// scopesContextKey is where the authentication middleware stores the scopes of the credential that was used, it's nil
+// for sessions of the auth provider which can do everything. The verified uid is stored under routing.UidKey.
+const scopesContextKey = "scopes"
+
+// authenticate is a middleware that verifies the bearer token of the request. Session tokens of the auth provider
+// (firebase ID tokens or local sessions) are always accepted, personal access tokens and tokens issued through OAuth
+// are only accepted if they carry the scope, an empty scope means the route is only available to sessions (for example
+// managing the access tokens themselves).
+func authenticate(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token, ok := bearerToken(c)
+		if !ok {
+			abortUnauthenticated(c, "Missing bearer token")
+			return
+		}
+
+		if strings.HasPrefix(token, accessTokenPrefix) {
+			if scope == "" {
+				abortForbidden(c, "Personal access tokens can't be used for this endpoint")
+				return
+			}
+			record, err := lookupAccessToken(c.Request.Context(), token)
+			if err != nil {
+				abortUnauthenticated(c, "Invalid access token")
+				return
+			}
+			if !record.hasScope(scope) {
+				abortForbidden(c, "Access token is missing the "+scope+" scope")
+				return
+			}
+			c.Set(routing.UidKey, record.Uid)
+			c.Set(scopesContextKey, record.Scopes)
+			c.Next()
+			return
+		}
+
+		if strings.HasPrefix(token, oauthAccessTokenPrefix) {
+			if scope == "" {
+				abortForbidden(c, "OAuth tokens can't be used for this endpoint")
+				return
+			}
+			record, err := lookupOAuthAccessToken(c.Request.Context(), token)
+			if err != nil {
+				abortUnauthenticated(c, "Invalid access token")
+				return
+			}
+			if !record.hasScope(scope) {
+				abortForbidden(c, "Access token is missing the "+scope+" scope")
+				return
+			}
+			c.Set(routing.UidKey, record.Uid)
+			c.Set(scopesContextKey, record.Scopes)
+			c.Next()
+			return
+		}
+
+		uid, err := authProvider.VerifyToken(c.Request.Context(), token)
+		if err != nil {
+			log.Ctx(c.Request.Context()).Debug().
+				Err(err).
+				Msg("Invalid session token")
+			abortUnauthenticated(c, "Invalid ID token")
+			return
+		}
+		c.Set(routing.UidKey, uid)
+		c.Next()
+	}
+}
+
+// bearerToken returns the token in the Authorization header
+func bearerToken(c *gin.Context) (string, bool) {
+	header := c.GetHeader("Authorization")
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	token = strings.TrimSpace(token)
+	return token, ok && token != ""
+}
+
+// authenticatedUid returns the uid verified by authenticate
+func authenticatedUid(c *gin.Context) string {
+	return c.GetString(routing.UidKey)
+}
+
+// authorizeUid checks that the uid sent in a request body belongs to the authenticated caller, an empty uid is
+// replaced with the callers uid. It writes the error response itself and returns false if the uid doesn't match.
+func authorizeUid(c *gin.Context, uid *string) bool {
+	authed := authenticatedUid(c)
+	if *uid == "" {
+		*uid = authed
+	}
+	if *uid != authed {
+		c.JSON(http.StatusForbidden, RequestErrorResult{
+			ErrorCode: ForbiddenError,
+			Content:   "Credentials don't belong to this user",
+		})
+		return false
+	}
+	return true
+}
+
+func abortUnauthenticated(c *gin.Context, content string) {
+	c.AbortWithStatusJSON(http.StatusUnauthorized, RequestErrorResult{
+		ErrorCode: UnauthenticatedError,
+		Content:   content,
+	})
+}
+
+func abortForbidden(c *gin.Context, content string) {
+	c.AbortWithStatusJSON(http.StatusForbidden, RequestErrorResult{
+		ErrorCode: ForbiddenError,
+		Content:   content,
+	})
+}
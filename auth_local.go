@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"go.etcd.io/bbolt"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// localSessionPrefix marks session tokens signed by the local provider
+	localSessionPrefix   = "onl_"
+	localSessionLifetime = 7 * 24 * time.Hour
+
+	minPasswordLength = 8
+	// bcrypt ignores everything after 72 bytes, longer passwords are rejected instead of silently cut
+	maxPasswordLength = 72
+)
+
+var (
+	localAccountsBucket = []byte("accounts")
+	// localUidsBucket maps uids to usernames
+	localUidsBucket = []byte("uids")
+
+	usernamePattern = regexp.MustCompile(`^[a-z0-9._-]{3,64}$`)
+
+	errAccountExists       = errors.New("account already exists")
+	errAccountNotFound     = errors.New("account not found")
+	errInvalidLogin        = errors.New("invalid username or password")
+	errInvalidSession      = errors.New("invalid session token")
+	errInvalidUsername     = errors.New("usernames are 3 to 64 lowercase letters, digits, dots, dashes or underscores")
+	errInvalidPassword     = errors.New("passwords are 8 to 72 bytes long")
+	errLocalAuthDisabled   = errors.New("local authentication is disabled")
+	errLocalSignupDisabled = errors.New("signing up is disabled, ask an admin for an account")
+)
+
+// localAccount is an account of the local provider, stored as json keyed by username
+type localAccount struct {
+	Uid          string
+	Username     string
+	PasswordHash string
+	// Generation changes with every password reset, session tokens of an older generation are rejected
+	Generation int
+	CreatedAt  time.Time
+}
+
+// localSession is the signed payload of a session token
+type localSession struct {
+	Uid        string `json:"uid"`
+	Generation int    `json:"gen"`
+	ExpiresAt  int64  `json:"exp"`
+}
+
+// localAuthProvider signs users in with a username and password, it needs nothing outside the server so opennote can
+// run on a LAN.
+type localAuthProvider struct {
+	db         *bbolt.DB
+	sessionKey []byte
+	// signup lets anyone who can reach the server create an account, otherwise accounts are only created with
+	// "go run . account add"
+	signup bool
+}
+
+func openLocalAuthProvider(conf config.LocalAuth) (*localAuthProvider, error) {
+	key, err := loadSessionKey(conf.SessionKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(conf.AccountsPath), 0o700); err != nil {
+		return nil, err
+	}
+	db, err := bbolt.Open(conf.AccountsPath, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(localAccountsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(localUidsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &localAuthProvider{db: db, sessionKey: key, signup: conf.Signup}, nil
+}
+
+// loadSessionKey reads the signing key, a new one is written if the file doesn't exist yet
+func loadSessionKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0o600); err != nil {
+		return nil, err
+	}
+	log.Info().
+		Str("Path", path).
+		Msg("Generated a new session signing key")
+	return key, nil
+}
+
+// Close releases the accounts database
+func (p *localAuthProvider) Close() error {
+	return p.db.Close()
+}
+
+// localAuth returns the local provider, or nil if another provider is in use
+func localAuth() *localAuthProvider {
+	provider, _ := authProvider.(*localAuthProvider)
+	return provider
+}
+
+func normalizeUsername(username string) (string, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	if !usernamePattern.MatchString(username) {
+		return "", errInvalidUsername
+	}
+	return username, nil
+}
+
+func validatePassword(password string) error {
+	if len(password) < minPasswordLength || len(password) > maxPasswordLength {
+		return errInvalidPassword
+	}
+	return nil
+}
+
+func (p *localAuthProvider) getAccount(tx *bbolt.Tx, username string) (localAccount, error) {
+	data := tx.Bucket(localAccountsBucket).Get([]byte(username))
+	if data == nil {
+		return localAccount{}, errAccountNotFound
+	}
+	var account localAccount
+	err := json.Unmarshal(data, &account)
+	return account, err
+}
+
+func (p *localAuthProvider) putAccount(tx *bbolt.Tx, account localAccount) error {
+	data, err := json.Marshal(account)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(localAccountsBucket).Put([]byte(account.Username), data); err != nil {
+		return err
+	}
+	return tx.Bucket(localUidsBucket).Put([]byte(account.Uid), []byte(account.Username))
+}
+
+// CreateAccount adds an account with a new uid
+func (p *localAuthProvider) CreateAccount(username string, password string) (localAccount, error) {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return localAccount{}, err
+	}
+	if err := validatePassword(password); err != nil {
+		return localAccount{}, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return localAccount{}, err
+	}
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return localAccount{}, err
+	}
+	account := localAccount{
+		Uid:          "local_" + base64.RawURLEncoding.EncodeToString(raw),
+		Username:     username,
+		PasswordHash: string(hash),
+		CreatedAt:    time.Now(),
+	}
+	err = p.db.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(localAccountsBucket).Get([]byte(username)) != nil {
+			return errAccountExists
+		}
+		return p.putAccount(tx, account)
+	})
+	if err != nil {
+		return localAccount{}, err
+	}
+	return account, nil
+}
+
+// ResetPassword sets a new password, every session token of the account stops working
+func (p *localAuthProvider) ResetPassword(username string, password string) error {
+	username, err := normalizeUsername(username)
+	if err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		account, err := p.getAccount(tx, username)
+		if err != nil {
+			return err
+		}
+		account.PasswordHash = string(hash)
+		account.Generation++
+		return p.putAccount(tx, account)
+	})
+}
+
+// DeleteAccount removes the account with the uid, deleting an account that doesn't exist isn't an error
+func (p *localAuthProvider) DeleteAccount(uid string) error {
+	return p.db.Update(func(tx *bbolt.Tx) error {
+		username := tx.Bucket(localUidsBucket).Get([]byte(uid))
+		if username == nil {
+			return nil
+		}
+		if err := tx.Bucket(localAccountsBucket).Delete(username); err != nil {
+			return err
+		}
+		return tx.Bucket(localUidsBucket).Delete([]byte(uid))
+	})
+}
+
+// dummyPasswordHash is compared against when the username doesn't exist, so a login takes as long either way and
+// doesn't reveal which usernames exist
+var (
+	dummyPasswordHash     []byte
+	dummyPasswordHashOnce sync.Once
+)
+
+// Login checks the password and returns a signed session token
+func (p *localAuthProvider) Login(username string, password string) (string, localSession, error) {
+	username = strings.ToLower(strings.TrimSpace(username))
+	var account localAccount
+	err := p.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		account, err = p.getAccount(tx, username)
+		return err
+	})
+	if errors.Is(err, errAccountNotFound) {
+		dummyPasswordHashOnce.Do(func() {
+			dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("opennote-dummy-password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(dummyPasswordHash, []byte(password))
+		return "", localSession{}, errInvalidLogin
+	}
+	if err != nil {
+		return "", localSession{}, err
+	}
+	if bcrypt.CompareHashAndPassword([]byte(account.PasswordHash), []byte(password)) != nil {
+		return "", localSession{}, errInvalidLogin
+	}
+	session := localSession{
+		Uid:        account.Uid,
+		Generation: account.Generation,
+		ExpiresAt:  time.Now().Add(localSessionLifetime).Unix(),
+	}
+	token, err := p.sign(session)
+	return token, session, err
+}
+
+func (p *localAuthProvider) signature(payload string) string {
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign encodes the session as onl_<payload>.<signature>
+func (p *localAuthProvider) sign(session localSession) (string, error) {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return localSessionPrefix + payload + "." + p.signature(payload), nil
+}
+
+func (p *localAuthProvider) VerifyToken(ctx context.Context, token string) (string, error) {
+	payload, signature, ok := strings.Cut(strings.TrimPrefix(token, localSessionPrefix), ".")
+	if !ok || !strings.HasPrefix(token, localSessionPrefix) {
+		return "", errInvalidSession
+	}
+	if !hmac.Equal([]byte(signature), []byte(p.signature(payload))) {
+		return "", errInvalidSession
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidSession
+	}
+	var session localSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return "", errInvalidSession
+	}
+	if time.Now().Unix() >= session.ExpiresAt {
+		return "", errInvalidSession
+	}
+	account, err := p.accountByUid(session.Uid)
+	if err != nil || account.Generation != session.Generation {
+		return "", errInvalidSession
+	}
+	return session.Uid, nil
+}
+
+func (p *localAuthProvider) accountByUid(uid string) (localAccount, error) {
+	var account localAccount
+	err := p.db.View(func(tx *bbolt.Tx) error {
+		username := tx.Bucket(localUidsBucket).Get([]byte(uid))
+		if username == nil {
+			return errAccountNotFound
+		}
+		var err error
+		account, err = p.getAccount(tx, string(username))
+		return err
+	})
+	return account, err
+}
+
+func (p *localAuthProvider) UserExists(ctx context.Context, uid string) (bool, error) {
+	_, err := p.accountByUid(uid)
+	if errors.Is(err, errAccountNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// LoginRequest is the request sent to /auth/login and /auth/signup
+type LoginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// LoginResponse has the session token that is sent as the bearer token, like a firebase ID token
+type LoginResponse struct {
+	Token     string    `json:"token"`
+	Uid       string    `json:"uid"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// loginEndpoint is the endpoint at /auth/login, it only exists with the local provider
+func loginEndpoint(c *gin.Context) {
+	provider := localAuth()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   errLocalAuthDisabled.Error(),
+		})
+		return
+	}
+	var request LoginRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	writeLogin(c, provider, request)
+}
+
+// writeLogin logs the user in and answers with the session token
+func writeLogin(c *gin.Context, provider *localAuthProvider, request LoginRequest) {
+	token, session, err := provider.Login(request.Username, request.Password)
+	if errors.Is(err, errInvalidLogin) {
+		abortUnauthenticated(c, "Invalid username or password")
+		return
+	}
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Msg("Unable to log in")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to log in",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, LoginResponse{
+		Token:     token,
+		Uid:       session.Uid,
+		ExpiresAt: time.Unix(session.ExpiresAt, 0).UTC(),
+	})
+}
+
+// signupEndpoint is the endpoint at /auth/signup, it only works with the local provider when signup is enabled
+func signupEndpoint(c *gin.Context) {
+	provider := localAuth()
+	if provider == nil {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   errLocalAuthDisabled.Error(),
+		})
+		return
+	}
+	if !provider.signup {
+		c.JSON(http.StatusForbidden, RequestErrorResult{
+			ErrorCode: ForbiddenError,
+			Content:   errLocalSignupDisabled.Error(),
+		})
+		return
+	}
+	var request LoginRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	_, err := provider.CreateAccount(request.Username, request.Password)
+	switch {
+	case errors.Is(err, errAccountExists):
+		c.JSON(http.StatusConflict, RequestErrorResult{
+			ErrorCode: UserExistsError,
+			Content:   "Username is taken",
+		})
+		return
+	case errors.Is(err, errInvalidUsername), errors.Is(err, errInvalidPassword):
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   err.Error(),
+		})
+		return
+	case err != nil:
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Msg("Unable to create account")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to create account",
+		})
+		return
+	}
+	writeLogin(c, provider, request)
+}
+
+// manageLocalAccount runs the account add and account reset-password commands. The password is the first line of
+// stdin, if it's empty a random one is generated and printed.
+func manageLocalAccount(command string, args []string) error {
+	provider := localAuth()
+	if provider == nil {
+		return errors.New("auth.provider must be local")
+	}
+	if len(args) != 1 {
+		return errors.New("usage: opennote " + command + " <username>")
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	}
+	generated := password == ""
+	if generated {
+		raw := make([]byte, 12)
+		if _, err := rand.Read(raw); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	switch command {
+	case "account add":
+		account, err := provider.CreateAccount(args[0], password)
+		if err != nil {
+			return err
+		}
+		log.Info().
+			Str("Username", account.Username).
+			Str("User", account.Uid).
+			Msg("Created account")
+	case "account reset-password":
+		if err := provider.ResetPassword(args[0], password); err != nil {
+			return err
+		}
+		log.Info().
+			Str("Username", args[0]).
+			Msg("Reset password, existing sessions are signed out")
+	}
+	// a generated password is the output of the command, it goes to stdout instead of the logs
+	if generated {
+		fmt.Println(password)
+	}
+	return nil
+}
+
+// readPassword reads the first line of stdin, it returns an empty password when stdin is a terminal so running the
+// command without piping a password generates one
+func readPassword() (string, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice != 0 {
+		return "", nil
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
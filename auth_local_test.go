@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func openTestLocalAuth(t *testing.T) *localAuthProvider {
+	dir := t.TempDir()
+	provider, err := openLocalAuthProvider(config.LocalAuth{
+		AccountsPath:   filepath.Join(dir, "accounts.db"),
+		SessionKeyFile: filepath.Join(dir, "session.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { provider.Close() })
+	return provider
+}
+
+func TestLocalVerifyToken(t *testing.T) {
+	provider := openTestLocalAuth(t)
+	account, err := provider.CreateAccount("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := provider.Login("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := provider.sign(localSession{
+		Uid:        account.Uid,
+		Generation: account.Generation,
+		ExpiresAt:  time.Now().Add(-time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, signature, _ := strings.Cut(strings.TrimPrefix(token, localSessionPrefix), ".")
+	// a payload signed with another key, the signature of the real payload doesn't match it
+	forged, err := openTestLocalAuth(t).sign(localSession{
+		Uid:        account.Uid,
+		Generation: account.Generation,
+		ExpiresAt:  time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		uid   string
+	}{
+		{name: "valid", token: token, uid: account.Uid},
+		{name: "expired", token: expired},
+		{name: "tampered signature", token: localSessionPrefix + payload + "." + strings.ToUpper(signature)},
+		{name: "tampered payload", token: localSessionPrefix + payload + "x." + signature},
+		{name: "other key", token: forged},
+		{name: "no prefix", token: payload + "." + signature},
+		{name: "no signature", token: localSessionPrefix + payload},
+		{name: "empty", token: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			uid, err := provider.VerifyToken(context.Background(), tt.token)
+			if tt.uid == "" {
+				if !errors.Is(err, errInvalidSession) {
+					t.Fatalf("got uid %q and %v, want errInvalidSession", uid, err)
+				}
+				return
+			}
+			if err != nil || uid != tt.uid {
+				t.Fatalf("got uid %q and %v, want %q", uid, err, tt.uid)
+			}
+		})
+	}
+}
+
+// resetting the password moves the account to the next generation, tokens of the old one stop working
+func TestLocalVerifyTokenStaleGeneration(t *testing.T) {
+	provider := openTestLocalAuth(t)
+	if _, err := provider.CreateAccount("alice", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	stale, _, err := provider.Login("alice", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := provider.ResetPassword("alice", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyToken(context.Background(), stale); !errors.Is(err, errInvalidSession) {
+		t.Fatalf("stale token: got %v, want errInvalidSession", err)
+	}
+	fresh, _, err := provider.Login("alice", "battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.VerifyToken(context.Background(), fresh); err != nil {
+		t.Fatalf("fresh token: %v", err)
+	}
+}
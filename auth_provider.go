@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"firebase.google.com/go/v4/auth"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"os"
+)
+
+// AuthProvider verifies the session tokens users sign in with, access tokens and OAuth tokens are issued by opennote
+// itself and don't go through it.
+type AuthProvider interface {
+	// VerifyToken returns the uid the session token belongs to
+	VerifyToken(ctx context.Context, token string) (string, error)
+	// UserExists reports whether the uid belongs to an account of the provider
+	UserExists(ctx context.Context, uid string) (bool, error)
+}
+
+var authProvider AuthProvider
+
+var errFirestoreDisabled = errors.New("firestore isn't configured")
+
+// firebaseAuthProvider is the default provider, users sign in through firebase in the website and the plugin
+type firebaseAuthProvider struct {
+	client *auth.Client
+}
+
+func (p firebaseAuthProvider) VerifyToken(ctx context.Context, token string) (string, error) {
+	idToken, err := p.client.VerifyIDToken(ctx, token)
+	if err != nil {
+		return "", err
+	}
+	return idToken.UID, nil
+}
+
+func (p firebaseAuthProvider) UserExists(ctx context.Context, uid string) (bool, error) {
+	_, err := p.client.GetUser(ctx, uid)
+	if auth.IsUserNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// firebaseConfigured reports whether the server should connect to firebase
+func firebaseConfigured(cfg config.Config) bool {
+	if cfg.FirebaseRequired() {
+		return true
+	}
+	_, err := os.Stat(cfg.Firebase.KeyFile)
+	return err == nil
+}
+
+// authSetup sets up the configured provider
+func authSetup(conf config.Auth) {
+	switch conf.Provider {
+	case "firebase":
+		authProvider = firebaseAuthProvider{client: fireauthClient}
+	case "local":
+		provider, err := openLocalAuthProvider(conf.Local)
+		if err != nil {
+			panic("Unable to set up local authentication: " + err.Error())
+		}
+		authProvider = provider
+	default:
+		panic("Unknown auth provider " + conf.Provider)
+	}
+}
+
+// requireFirestore is a middleware for the routes that keep their data in firestore, servers running without a
+// firebase project answer them with 501
+func requireFirestore(c *gin.Context) {
+	if firestoreClient == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "This server runs without firestore",
+		})
+		return
+	}
+	c.Next()
+}
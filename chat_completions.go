@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WorkspacesHeader picks the indexes a single completion searches, see completionScope
+const WorkspacesHeader = "OpenNote-Workspaces"
+
+// maxToolRounds is how many times a completion may call query_notes before the model has to answer with what it has
+const maxToolRounds = 3
+
+// openaiErrorBody is the error format of the OpenAI api, clients of the compatible endpoints expect it
+type openaiErrorBody struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+	Code    string `json:"code,omitempty"`
+}
+
+func openaiError(c *gin.Context, status int, errType string, code string, message string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error": openaiErrorBody{
+			Message: message,
+			Type:    errType,
+			Code:    code,
+		},
+	})
+}
+
+// errNoChoices is the error of a completion OpenAI answered without any choices
+var errNoChoices = errors.New("openai answered without choices")
+
+// upstreamError reports an error from OpenAI, errors about the request itself (like a too long context) are passed
+// through so the client can fix them, an open circuit breaker is unavailable and everything else is a bad gateway.
+func upstreamError(c *gin.Context, err error) {
+	if isUnavailableError(err) {
+		c.Header("Retry-After", unavailableRetryAfter)
+		openaiError(c, http.StatusServiceUnavailable, "server_error", "", "OpenAI or Pinecone are unavailable, try again later")
+		return
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.HTTPStatusCode >= 400 && apiErr.HTTPStatusCode < 500 {
+		code := ""
+		if apiErr.Code != nil {
+			code = fmt.Sprint(apiErr.Code)
+		}
+		openaiError(c, apiErr.HTTPStatusCode, apiErr.Type, code, apiErr.Message)
+		return
+	}
+	openaiError(c, http.StatusBadGateway, "server_error", "", "Unable to reach OpenAI")
+}
+
+// completionsSession checks the quota of the authenticated user and returns their session, it writes an OpenAI style
+// error and returns nil if the request can't go through.
+func completionsSession(c *gin.Context) *session {
+	uid := authenticatedUid(c)
+	if err := checkQuota(c.Request.Context(), uid); err != nil {
+		if isQuotaError(err) {
+			openaiError(c, http.StatusTooManyRequests, "insufficient_quota", "quota_exceeded", "Token quota exceeded, "+err.Error())
+			return nil
+		}
+		openaiError(c, http.StatusInternalServerError, "server_error", "", "Unable to check token quota")
+		return nil
+	}
+	sess := sessionForRequest(c, uid)
+	if sess == nil {
+		return nil
+	}
+	sess.updateTimer()
+	return sess
+}
+
+// completionRequest turns the request of the client into the request sent to OpenAI. The conversation comes from the
+// client instead of the session, so the endpoint is stateless like the OpenAI one, and query_notes is the only
+// function the model gets, functions the client sends aren't supported.
+func (s *session) completionRequest(request openai.ChatCompletionRequest) openai.ChatCompletionRequest {
+	if request.Model == "" {
+		request.Model = s.settings.chatModel
+	}
+	request.N = 0
+	request.Functions = function_call_defintions()
+	request.FunctionCall = nil
+	return request
+}
+
+// appendToolCall adds the function call of the model and the notes it asked for to the conversation
+func (s *session) appendToolCall(ctx context.Context, req *openai.ChatCompletionRequest, scope searchScope, call openai.FunctionCall) {
+	req.Messages = append(req.Messages,
+		openai.ChatCompletionMessage{
+			Role:         openai.ChatMessageRoleAssistant,
+			FunctionCall: &call,
+		},
+		openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleFunction,
+			Name:    QueryNotesName,
+			Content: s.queryNotesIn(ctx, scope, call.Arguments),
+		},
+	)
+}
+
+// chatCompletionsEndpoint is the endpoint at /v1/chat/completions, it is a drop in replacement of the OpenAI one that
+// answers with the users notes. It runs the same query_notes loop as session.Message on the users own OpenAI key.
+func chatCompletionsEndpoint(c *gin.Context) {
+	var request openai.ChatCompletionRequest
+	if err := c.BindJSON(&request); err != nil {
+		openaiError(c, http.StatusBadRequest, "invalid_request_error", "", "Content doesn't match expected structure")
+		return
+	}
+	if len(request.Messages) == 0 {
+		openaiError(c, http.StatusBadRequest, "invalid_request_error", "", "messages must not be empty")
+		return
+	}
+	sess := completionsSession(c)
+	if sess == nil {
+		return
+	}
+	scope, ok := completionScope(c, sess)
+	if !ok {
+		return
+	}
+	req := sess.completionRequest(request)
+	if req.Stream {
+		sess.streamCompletion(c, req, scope)
+		return
+	}
+	sess.completion(c, req, scope)
+}
+
+// completionScope returns the indexes a completion searches. The conversation lives on the client, so instead of the
+// scope picked for the session a client can pick the workspaces of every request with the WorkspacesHeader, a comma
+// separated list of workspace ids where "personal" stands for the users own index.
+func completionScope(c *gin.Context, sess *session) (searchScope, bool) {
+	header := strings.TrimSpace(c.GetHeader(WorkspacesHeader))
+	if header == "" {
+		return sess.searchScope(), true
+	}
+	personal := false
+	var ids []string
+	for _, id := range strings.Split(header, ",") {
+		id = strings.TrimSpace(id)
+		switch id {
+		case "":
+		case personalScopeName:
+			personal = true
+		default:
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > 0 && firestoreClient == nil {
+		openaiError(c, http.StatusNotImplemented, "invalid_request_error", "", "Workspaces aren't available on this server")
+		return searchScope{}, false
+	}
+	scope, err := resolveSearchScope(c.Request.Context(), sess.uid(), personal, ids)
+	if errors.Is(err, errNotMember) || errors.Is(err, errWorkspaceNotFound) {
+		openaiError(c, http.StatusForbidden, "invalid_request_error", "", "Not a member of every workspace in "+WorkspacesHeader)
+		return searchScope{}, false
+	}
+	if err != nil {
+		openaiError(c, http.StatusInternalServerError, "server_error", "", "Unable to read workspaces")
+		return searchScope{}, false
+	}
+	return scope, true
+}
+
+func (s *session) completion(c *gin.Context, req openai.ChatCompletionRequest, scope searchScope) {
+	uid := s.uid()
+	chatClient, _ := s.clients()
+	var usage openai.Usage
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			req.FunctionCall = "none"
+		}
+		ctx, span := startChatSpan(c.Request.Context(), req, false)
+		resp, err := chatClient.CreateChatCompletion(ctx, req)
+		endChatSpan(span, chatUsage(resp.Usage), err)
+		if err != nil {
+			upstreamError(c, err)
+			return
+		}
+		recordUsage(c.Request.Context(), uid, chatUsage(resp.Usage))
+		usage.PromptTokens += resp.Usage.PromptTokens
+		usage.CompletionTokens += resp.Usage.CompletionTokens
+		usage.TotalTokens += resp.Usage.TotalTokens
+
+		if len(resp.Choices) == 0 {
+			upstreamError(c, errNoChoices)
+			return
+		}
+		call := resp.Choices[0].Message.FunctionCall
+		if call == nil || call.Name != QueryNotesName {
+			resp.Usage = usage
+			c.JSON(http.StatusOK, resp)
+			return
+		}
+		s.appendToolCall(c.Request.Context(), &req, scope, *call)
+	}
+}
+
+// streamCompletion answers with server sent events in the format of the OpenAI api. The chunks of the query_notes
+// calls stay on the server, the client only sees the content of the final answer.
+func (s *session) streamCompletion(c *gin.Context, req openai.ChatCompletionRequest, scope searchScope) {
+	uid := s.uid()
+	// streamed completions don't report their usage, so it's estimated like in session.Message2
+	var usage tokenUsage
+	defer func() {
+		usage.Estimated = usage.PromptTokens + usage.CompletionTokens
+		recordUsage(c.Request.Context(), uid, usage)
+	}()
+
+	chatClient, _ := s.clients()
+	configChanged := s.configChanges()
+	started := false
+	sentRole := false
+	for round := 0; ; round++ {
+		if round == maxToolRounds {
+			req.FunctionCall = "none"
+		}
+		ctx, span := startChatSpan(c.Request.Context(), req, true)
+		stream, err := chatClient.CreateChatCompletionStream(ctx, req)
+		if err != nil {
+			endSpan(span, err)
+			if !started {
+				upstreamError(c, err)
+				return
+			}
+			writeStreamError(c, "Unable to reach OpenAI")
+			return
+		}
+		if !started {
+			c.Header("Content-Type", "text/event-stream")
+			c.Header("Cache-Control", "no-cache")
+			c.Header("Connection", "keep-alive")
+			c.Status(http.StatusOK)
+			started = true
+		}
+		roundStart := usage
+		usage.PromptTokens += estimatePromptTokens(req)
+
+		call, err := s.forwardStream(c, stream, &usage, &sentRole, &configChanged)
+		stream.Close()
+		roundUsage := tokenUsage{
+			PromptTokens:     usage.PromptTokens - roundStart.PromptTokens,
+			CompletionTokens: usage.CompletionTokens - roundStart.CompletionTokens,
+		}
+		roundUsage.Estimated = roundUsage.total()
+		endChatSpan(span, roundUsage, err)
+		if err != nil {
+			writeStreamError(c, "Stream from OpenAI failed")
+			return
+		}
+		if call == nil {
+			fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+			c.Writer.Flush()
+			return
+		}
+		s.appendToolCall(c.Request.Context(), &req, scope, *call)
+	}
+}
+
+// forwardStream writes the chunks of stream to the client until it ends, it returns the function call of the model if
+// the stream ended with one.
+func (s *session) forwardStream(c *gin.Context, stream *openai.ChatCompletionStream, usage *tokenUsage, sentRole *bool, configChanged *<-chan struct{}) (*openai.FunctionCall, error) {
+	var call *openai.FunctionCall
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case <-*configChanged:
+			// a comment, OpenAI clients skip it but it shows up for anyone reading the raw stream
+			fmt.Fprint(c.Writer, ": opennote configuration changed, the next request uses the new settings\n\n")
+			*configChanged = nil
+		default:
+		}
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		choice := &resp.Choices[0]
+		if delta := choice.Delta.FunctionCall; delta != nil {
+			usage.CompletionTokens += estimateTokens(delta.Arguments)
+			if call == nil {
+				call = &openai.FunctionCall{}
+			}
+			if call.Name == "" {
+				call.Name = delta.Name
+			}
+			call.Arguments += delta.Arguments
+			continue
+		}
+		if choice.FinishReason == openai.FinishReasonFunctionCall {
+			continue
+		}
+		if choice.Delta.Role != "" {
+			// every round starts with a role chunk, the client should only see one answer
+			if *sentRole && choice.Delta.Content == "" && choice.FinishReason == "" {
+				continue
+			}
+			*sentRole = true
+		}
+		tokens := estimateTokens(choice.Delta.Content)
+		usage.CompletionTokens += tokens
+		streamedTokens.Add(float64(tokens))
+		data, _ := json.Marshal(resp)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+		c.Writer.Flush()
+	}
+	if call != nil && call.Name != QueryNotesName {
+		return nil, nil
+	}
+	return call, nil
+}
+
+// writeStreamError ends a stream that already started, the status can't change anymore so the error is sent as an
+// event like OpenAI does
+func writeStreamError(c *gin.Context, message string) {
+	data, _ := json.Marshal(gin.H{
+		"error": openaiErrorBody{
+			Message: message,
+			Type:    "server_error",
+		},
+	})
+	fmt.Fprintf(c.Writer, "data: %s\n\n", data)
+	c.Writer.Flush()
+}
+
+// modelObject is a model in the OpenAI model list format
+type modelObject struct {
+	Id      string `json:"id"`
+	Object  string `json:"object"`
+	Created int64  `json:"created"`
+	OwnedBy string `json:"owned_by"`
+}
+
+// modelsEndpoint is the endpoint at /v1/models, it lists the chat models the users OpenAI key has access to since those
+// are the models chatCompletionsEndpoint can use.
+func modelsEndpoint(c *gin.Context) {
+	sess := sessionForRequest(c, authenticatedUid(c))
+	if sess == nil {
+		return
+	}
+	sess.updateTimer()
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	chatClient, _ := sess.clients()
+	models, err := chatClient.ListModels(ctx)
+	if err != nil {
+		upstreamError(c, err)
+		return
+	}
+	data := []modelObject{}
+	for _, model := range models.Models {
+		if !strings.HasPrefix(model.ID, "gpt-") {
+			continue
+		}
+		data = append(data, modelObject{
+			Id:      model.ID,
+			Object:  "model",
+			Created: model.CreatedAt,
+			OwnedBy: model.OwnedBy,
+		})
+	}
+	sort.Slice(data, func(i, j int) bool {
+		return data[i].Id < data[j].Id
+	})
+	c.JSON(http.StatusOK, gin.H{
+		"object": "list",
+		"data":   data,
+	})
+}
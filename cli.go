@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/abimek/opennote/config"
+	"github.com/abimek/opennote/keyring"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// setupLevel is how much of the server a command needs before it runs
+type setupLevel int
+
+const (
+	// setupNothing commands only need the config
+	setupNothing setupLevel = iota
+	// setupStores commands use firebase, the auth provider, the master keys and the stores
+	setupStores
+	// setupSessions commands also create sessions
+	setupSessions
+)
+
+// command is a subcommand of opennote like "user get", the name is one or two words
+type command struct {
+	name  string
+	args  string
+	help  string
+	setup setupLevel
+	run   func(cfg config.Config, args []string) error
+}
+
+// commands are the subcommands of opennote, the first one runs when no command is given. Commands that talk to a
+// running server go through its admin api, the others open the stores themselves.
+var commands = []command{
+	{"serve", "", "start the server", setupSessions, serveCommand},
+	{"openapi", "[-check]", "print the openapi spec of the plugin, -check fails if the committed spec is out of date", setupNothing, openapiCommand},
+	{"mcp", "", "serve the notes of the owner of mcp.token over stdio", setupSessions, mcpCommand},
+	{"user get", "<uid>", "print the settings of a user, keys are masked", setupStores, userGetCommand},
+	{"user create", "<uid>", "create empty settings for an account that signed up", setupStores, userCreateCommand},
+	{"user delete", "-yes <uid>", "delete the user, their notes, tokens, usage and workspaces", setupStores, userDeleteCommand},
+	{"user reindex", "[-model name] <uid>", "embed every note of the user again, with models.embedding by default", setupStores, userReindexCommand},
+	{"user migrate", "", "move user documents to users/{uid}, once before deploying a server that needs it", setupStores, userMigrateCommand},
+	{"account add", "<username>", "create a local account, the password is read from stdin or generated", setupStores, accountAddCommand},
+	{"account reset-password", "<username>", "set the password of a local account and sign it out everywhere", setupStores, accountResetPasswordCommand},
+	{"sessions list", "", "list the sessions of the server at server.url", setupNothing, sessionsListCommand},
+	{"sessions evict", "<uid>", "drop the session of a user on the server at server.url", setupNothing, sessionsEvictCommand},
+	{"keys generate", "", "add a new master key to keys.master_key_file, creating the file on first run", setupNothing, keysGenerateCommand},
+	{"keys rotate", "", "re-wrap every user and workspace with the newest master key", setupStores, keysRotateCommand},
+	{"usage report", "[-period 2006-01]", "print the tokens every user used in a month or day, this month by default", setupStores, usageReportCommand},
+}
+
+// commandAliases are the names commands had before they were grouped, so existing scripts keep working
+var commandAliases = map[string]string{
+	"rotate-keys":    "keys rotate",
+	"migrate-users":  "user migrate",
+	"add-user":       "account add",
+	"reset-password": "account reset-password",
+}
+
+// findCommand returns the command args start with and the arguments after its name
+func findCommand(args []string) (command, []string, error) {
+	if len(args) == 0 {
+		return commands[0], nil, nil
+	}
+	if name, ok := commandAliases[args[0]]; ok {
+		args = append(strings.Fields(name), args[1:]...)
+	}
+	for _, cmd := range commands {
+		words := len(strings.Fields(cmd.name))
+		if len(args) >= words && strings.Join(args[:words], " ") == cmd.name {
+			return cmd, args[words:], nil
+		}
+	}
+	return command{}, nil, fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+// printUsage lists the commands, the flags before the command are printed by -h
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: opennote [flags] <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.help)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run opennote -h for the flags, every flag can also be set in the config file or the environment")
+}
+
+// commandArgs parses the flags of a command and checks it got the positional arguments it wants
+func commandArgs(flags *flag.FlagSet, args []string, want ...string) ([]string, error) {
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != len(want) {
+		if len(want) == 0 {
+			return nil, fmt.Errorf("%s takes no arguments", flags.Name())
+		}
+		return nil, fmt.Errorf("usage: opennote %s %s", flags.Name(), strings.Join(want, " "))
+	}
+	return flags.Args(), nil
+}
+
+// openapiCommand prints the generated openapi spec, it doesn't need any credentials. With -check it instead fails if
+// the committed spec drifted from the code, so CI can catch a forgotten regeneration.
+func openapiCommand(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("openapi", flag.ContinueOnError)
+	check := flags.Bool("check", false, "fail if the committed spec is out of date")
+	if _, err := commandArgs(flags, args); err != nil {
+		return err
+	}
+	newRouter(cfg)
+	if *check {
+		if err := checkOpenAPISpec(); err != nil {
+			return fmt.Errorf("committed openapi spec is out of date, run: go run . openapi > %s: %w", openapiSpecFile, err)
+		}
+		return nil
+	}
+	spec, err := renderOpenAPISpec(specServerURL)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(spec)
+	return err
+}
+
+// mcpCommand serves the notes of the user owning the configured token over stdio for local assistants and editors
+func mcpCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("mcp", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	return serveMCPStdio(cfg.MCP.Token)
+}
+
+func userGetCommand(cfg config.Config, args []string) error {
+	args, err := commandArgs(flag.NewFlagSet("user get", flag.ContinueOnError), args, "<uid>")
+	if err != nil {
+		return err
+	}
+	user, err := findUser(context.Background(), args[0])
+	if errors.Is(err, errUserNotFound) {
+		return fmt.Errorf("no user %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(user.Settings())
+}
+
+// userCreateCommand creates the same empty settings the website creates after signup, for accounts whose settings were
+// lost or never created
+func userCreateCommand(cfg config.Config, args []string) error {
+	args, err := commandArgs(flag.NewFlagSet("user create", flag.ContinueOnError), args, "<uid>")
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	uid := args[0]
+	exists, err := authProvider.UserExists(ctx, uid)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("no account %s, users can only be created for accounts of the auth provider", uid)
+	}
+	record, err := sealUser(User{Uid: uid, TopK: 1})
+	if err != nil {
+		return err
+	}
+	created, err := userStore.Create(ctx, record)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("user %s already exists", uid)
+	}
+	fmt.Printf("created user %s\n", uid)
+	return nil
+}
+
+// userDeleteCommand deletes the account like confirming /api/account/delete does, and evicts the session of the user
+// from the running server if the admin api can be reached
+func userDeleteCommand(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	yes := flags.Bool("yes", false, "confirm the deletion, it can't be undone")
+	args, err := commandArgs(flags, args, "<uid>")
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("deleting a user can't be undone, pass -yes to confirm")
+	}
+	uid := args[0]
+	result, err := deleteAccount(context.Background(), uid)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("deleted user %s, notes deleted: %t\n", uid, result.NotesDeleted)
+
+	if cfg.Admin.Token == "" {
+		log.Warn().
+			Str("User", uid).
+			Msg("admin.token isn't set, a session the user has on the server lasts until it's idle")
+		return nil
+	}
+	if _, err := evictSession(cfg, uid); err != nil {
+		log.Warn().
+			Err(err).
+			Str("User", uid).
+			Msg("Unable to evict the session of the deleted user, it lasts until it's idle")
+	}
+	return nil
+}
+
+// userReindexCommand embeds the notes of the user again, after models.embedding changed. The tokens are counted as
+// usage of the user since their OpenAI key pays for them.
+func userReindexCommand(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("user reindex", flag.ContinueOnError)
+	modelName := flags.String("model", cfg.Models.Embedding, "embedding model the notes are indexed with")
+	args, err := commandArgs(flags, args, "<uid>")
+	if err != nil {
+		return err
+	}
+	var model openai.EmbeddingModel
+	model.UnmarshalText([]byte(*modelName))
+	if model == openai.Unknown {
+		return fmt.Errorf("unknown embedding model %s", *modelName)
+	}
+	uid := args[0]
+	ctx := context.Background()
+	user, err := findUser(ctx, uid)
+	if errors.Is(err, errUserNotFound) {
+		return fmt.Errorf("no user %s", uid)
+	}
+	if err != nil {
+		return err
+	}
+
+	chatClient, index := newClients(user)
+	reindexed, usage, err := reindexNotes(ctx, chatClient, index, model, uid)
+	recordUsage(ctx, uid, usage)
+	fmt.Printf("reindexed %d notes of %s with %s, %d tokens\n", reindexed, uid, model, usage.EmbeddingTokens)
+	return err
+}
+
+func userMigrateCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("user migrate", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	return migrateUsers()
+}
+
+func accountAddCommand(cfg config.Config, args []string) error {
+	return manageLocalAccount("account add", args)
+}
+
+func accountResetPasswordCommand(cfg config.Config, args []string) error {
+	return manageLocalAccount("account reset-password", args)
+}
+
+func sessionsListCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("sessions list", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	var resp ListSessionsResponse
+	if err := adminRequest(cfg, http.MethodGet, "/admin/sessions", nil, &resp); err != nil {
+		return err
+	}
+	if len(resp.Sessions) == 0 {
+		fmt.Println("no sessions")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "USER\tEXPIRES IN\tSEARCHES\tRECENT NOTES")
+	for _, s := range resp.Sessions {
+		searches := s.Workspaces
+		if s.Personal {
+			searches = append([]string{personalScopeName}, searches...)
+		}
+		expiresIn := time.Until(s.ExpiresAt).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n", s.Uid, expiresIn, strings.Join(searches, ","), s.RecentNotes)
+	}
+	return tw.Flush()
+}
+
+func sessionsEvictCommand(cfg config.Config, args []string) error {
+	args, err := commandArgs(flag.NewFlagSet("sessions evict", flag.ContinueOnError), args, "<uid>")
+	if err != nil {
+		return err
+	}
+	evicted, err := evictSession(cfg, args[0])
+	if err != nil {
+		return err
+	}
+	if !evicted {
+		fmt.Printf("%s has no session\n", args[0])
+		return nil
+	}
+	fmt.Printf("evicted the session of %s\n", args[0])
+	return nil
+}
+
+// evictSession drops the session of the user on the running server, it returns false if there was none
+func evictSession(cfg config.Config, uid string) (bool, error) {
+	var resp EvictSessionResponse
+	err := adminRequest(cfg, http.MethodPost, "/admin/sessions/evict", EvictSessionRequest{Uid: uid}, &resp)
+	return resp.Evicted, err
+}
+
+// adminClient is the client of the admin api, the api only answers from memory so it doesn't need long
+var adminClient = &http.Client{Timeout: 30 * time.Second}
+
+// adminRequest calls the admin api of the server at server.url with admin.token and decodes the response into out
+func adminRequest(cfg config.Config, method string, path string, body interface{}, out interface{}) error {
+	if cfg.Admin.Token == "" {
+		return errors.New("admin.token isn't set, the server and the command both need it")
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	url := strings.TrimSuffix(cfg.Server.URL, "/") + path
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+cfg.Admin.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s has no admin api, set admin.token on the server", cfg.Server.URL)
+	case resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("%s rejected admin.token", cfg.Server.URL)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// keysGenerateCommand adds a new master key to the key file, the keys already in it are kept so stored users can still
+// be opened
+func keysGenerateCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("keys generate", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	if len(cfg.Keys.MasterKeys) > 0 {
+		return errors.New("keys.master_keys is set and takes priority over the key file, add the new key there instead")
+	}
+	version, err := keyring.Generate(cfg.Keys.MasterKeyFile)
+	if err != nil {
+		return fmt.Errorf("unable to generate a master key: %w", err)
+	}
+	fmt.Printf("Added master key version %d to %s\n", version, cfg.Keys.MasterKeyFile)
+	if version > 1 {
+		fmt.Println("Restart the server and run \"opennote keys rotate\" to re-wrap the stored users with it")
+	}
+	return nil
+}
+
+// keysRotateCommand re-wraps every stored user and workspace with the newest master key
+func keysRotateCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("keys rotate", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	if err := rotateUserKeys(); err != nil {
+		return fmt.Errorf("unable to rotate user keys: %w", err)
+	}
+	if firestoreClient != nil {
+		if err := rotateWorkspaceKeys(); err != nil {
+			return fmt.Errorf("unable to rotate workspace keys: %w", err)
+		}
+	}
+	return nil
+}
+
+// usageReportCommand prints the usage of every user in a period, the heaviest users first
+func usageReportCommand(cfg config.Config, args []string) error {
+	flags := flag.NewFlagSet("usage report", flag.ContinueOnError)
+	period := flags.String("period", time.Now().UTC().Format(monthLayout), "month (2006-01) or day (2006-01-02) to report")
+	if _, err := commandArgs(flags, args); err != nil {
+		return err
+	}
+	if _, err := time.Parse(monthLayout, *period); err != nil {
+		if _, err := time.Parse(dayLayout, *period); err != nil {
+			return fmt.Errorf("period %s isn't a month like 2006-01 or a day like 2006-01-02", *period)
+		}
+	}
+	if firestoreClient == nil {
+		return errors.New("usage is kept in firestore, which isn't configured")
+	}
+	records, err := usageReport(context.Background(), *period)
+	if err != nil {
+		return err
+	}
+
+	var sum usageRecord
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "USER\tPROMPT\tCOMPLETION\tEMBEDDING\tTOTAL\tESTIMATED\t")
+	for _, r := range records {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%d\t\n", r.Uid, r.PromptTokens, r.CompletionTokens, r.EmbeddingTokens, r.total(), r.Estimated)
+		sum.PromptTokens += r.PromptTokens
+		sum.CompletionTokens += r.CompletionTokens
+		sum.EmbeddingTokens += r.EmbeddingTokens
+		sum.Estimated += r.Estimated
+	}
+	fmt.Fprintf(tw, "%d users\t%d\t%d\t%d\t%d\t%d\t\n", len(records), sum.PromptTokens, sum.CompletionTokens, sum.EmbeddingTokens, sum.total(), sum.Estimated)
+	return tw.Flush()
+}
@@ -0,0 +1,541 @@
+// Package config loads the settings of the server. Every setting has a default, which can be overridden by the YAML
+// config file, then by environment variables and last by command line flags.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FileEnv is the path of the config file, the -config flag takes priority over it. Without either, DefaultFile is
+// read if it exists.
+const (
+	FileEnv     = "OPENNOTE_CONFIG"
+	DefaultFile = "opennote.yaml"
+)
+
+// Config is every setting of the server
+type Config struct {
+	Server    Server    `yaml:"server"`
+	Firebase  Firebase  `yaml:"firebase"`
+	Auth      Auth      `yaml:"auth"`
+	Keys      Keys      `yaml:"keys"`
+	Users     Users     `yaml:"users"`
+	Sessions  Sessions  `yaml:"sessions"`
+	Models    Models    `yaml:"models"`
+	Usage     Usage     `yaml:"usage"`
+	Plugin    Plugin    `yaml:"plugin"`
+	MCP       MCP       `yaml:"mcp"`
+	Log       Log       `yaml:"log"`
+	Metrics   Metrics   `yaml:"metrics"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Admin     Admin     `yaml:"admin"`
+	Upstreams Upstreams `yaml:"upstreams"`
+}
+
+type Server struct {
+	// Addr is the address the server listens on
+	Addr string `yaml:"addr"`
+	// URL is the public url of the server, it is used in the plugin manifest and the openapi spec
+	URL string `yaml:"url"`
+	// CORSOrigins are the origins allowed to call the app routes, empty means routing.DefaultAppOrigins
+	CORSOrigins []string `yaml:"cors_origins"`
+	// TrustedProxies are the ips and cidr ranges of the proxies whose X-Forwarded-For is believed for the client ip the
+	// rate limits use, empty trusts no proxy and uses the address of the connection
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// ShutdownTimeout is how long running requests and streams get to finish after SIGTERM before they're cut off
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+}
+
+type Firebase struct {
+	// KeyFile is the service account the server connects to firebase with
+	KeyFile       string      `yaml:"key_file"`
+	StorageBucket string      `yaml:"storage_bucket"`
+	Web           FirebaseWeb `yaml:"web"`
+}
+
+// FirebaseWeb is the web config of the firebase sign in on the OAuth authorize page
+type FirebaseWeb struct {
+	ApiKey     string `yaml:"api_key"`
+	AuthDomain string `yaml:"auth_domain"`
+	ProjectId  string `yaml:"project_id"`
+}
+
+type Auth struct {
+	// Provider is who signs users in, firebase or local
+	Provider string    `yaml:"provider"`
+	Local    LocalAuth `yaml:"local"`
+}
+
+type LocalAuth struct {
+	// AccountsPath is the database file the local provider keeps accounts in
+	AccountsPath string `yaml:"accounts_path"`
+	// SessionKeyFile is the file with the key session tokens are signed with, it is generated on first start
+	SessionKeyFile string `yaml:"session_key_file"`
+	// Signup lets anyone who can reach the server create an account, otherwise accounts are only created by an admin
+	Signup bool `yaml:"signup"`
+}
+
+type Keys struct {
+	// MasterKeyFile holds the master keys that encrypt user secrets, one "version:base64key" per line
+	MasterKeyFile string `yaml:"master_key_file"`
+	// MasterKeys are the master keys inline, they take priority over MasterKeyFile
+	MasterKeys []string `yaml:"master_keys"`
+}
+
+type Users struct {
+	// Store is where users are stored, firestore, bolt or memory
+	Store string `yaml:"store"`
+	// Path is the database file of the bolt store
+	Path string `yaml:"path"`
+}
+
+type Sessions struct {
+	// TimeLimit is how long a session lives after its last request
+	TimeLimit time.Duration `yaml:"time_limit"`
+	// MaxConversationChars is how long a conversation can get before its oldest messages are dropped
+	MaxConversationChars int `yaml:"max_conversation_chars"`
+}
+
+type Models struct {
+	// Chat is the model conversations use, and the default of the completions endpoint
+	Chat string `yaml:"chat"`
+	// Embedding is the model queries are embedded with, it has to be the model the notes were indexed with
+	Embedding string `yaml:"embedding"`
+}
+
+type Usage struct {
+	// DailyTokenLimit and MonthlyTokenLimit are the token caps per user, 0 means no cap. Usage is counted in firestore,
+	// so the server refuses to start with a cap but without firebase.
+	DailyTokenLimit   int64 `yaml:"daily_token_limit"`
+	MonthlyTokenLimit int64 `yaml:"monthly_token_limit"`
+}
+
+type Plugin struct {
+	// OpenAIVerificationToken is the token ChatGPT gives when the plugins OAuth client is registered with it
+	OpenAIVerificationToken string `yaml:"openai_verification_token"`
+}
+
+type MCP struct {
+	// Token is the personal access token the stdio MCP server authenticates with, it needs the query scope
+	Token string `yaml:"token"`
+}
+
+type Log struct {
+	// Level is the lowest level that is logged, trace, debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is json, or console for readable logs during development
+	Format string `yaml:"format"`
+}
+
+type Metrics struct {
+	// Token is the bearer token Prometheus has to send to scrape /metrics, empty leaves /metrics open
+	Token string `yaml:"token"`
+}
+
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP traces url of a collector, like http://localhost:4318/v1/traces, empty turns tracing off
+	Endpoint string `yaml:"endpoint"`
+	// Headers are sent with every export, for collectors that need an api key
+	Headers map[string]string `yaml:"headers"`
+	// SampleRatio is the share of the traces that are kept, it also applies to traces continued from the traceparent
+	// of a caller, whatever sampling decision the caller sent
+	SampleRatio float64 `yaml:"sample_ratio"`
+	// ServiceName is the service.name of the spans
+	ServiceName string `yaml:"service_name"`
+}
+
+type Admin struct {
+	// Token is the bearer token of the admin api the opennote command uses to manage a running server, empty turns the
+	// admin api off
+	Token string `yaml:"token"`
+}
+
+// Upstreams is how calls to OpenAI and Pinecone are retried and when they stop being made
+type Upstreams struct {
+	// Attempts is how often a call is made before it fails, 1 turns retries off
+	Attempts int `yaml:"attempts"`
+	// MaxDelay is the longest wait between attempts, a Retry-After asking for longer isn't waited for
+	MaxDelay time.Duration `yaml:"max_delay"`
+	// BreakerFailures is how many failures of an upstream in a row open its circuit breaker, 0 turns breakers off.
+	// Only server errors and calls that got no answer count, a rate limit or a bad api key is the problem of one user.
+	BreakerFailures int `yaml:"breaker_failures"`
+	// BreakerCooldown is how long an open breaker fails calls right away before it lets one through to try again
+	BreakerCooldown time.Duration `yaml:"breaker_cooldown"`
+}
+
+// Default returns the config used when nothing overrides it
+func Default() Config {
+	return Config{
+		Server: Server{
+			Addr:            ":8080",
+			URL:             "http://localhost:8080",
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Firebase: Firebase{
+			KeyFile: "resources/firebase/key.json",
+		},
+		Auth: Auth{
+			Provider: "firebase",
+			Local: LocalAuth{
+				AccountsPath:   "resources/data/accounts.db",
+				SessionKeyFile: "resources/keys/session.key",
+			},
+		},
+		Keys: Keys{
+			MasterKeyFile: "resources/keys/master.keys",
+		},
+		Users: Users{
+			Store: "firestore",
+			Path:  "resources/data/users.db",
+		},
+		Sessions: Sessions{
+			TimeLimit:            5 * time.Minute,
+			MaxConversationChars: 4097,
+		},
+		Models: Models{
+			Chat:      "gpt-3.5-turbo-0613",
+			Embedding: "text-embedding-ada-002",
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+			ServiceName: "opennote",
+		},
+		Upstreams: Upstreams{
+			Attempts:        3,
+			MaxDelay:        10 * time.Second,
+			BreakerFailures: 5,
+			BreakerCooldown: 30 * time.Second,
+		},
+	}
+}
+
+// envVar is an environment variable that overrides a setting
+type envVar struct {
+	name  string
+	apply func(c *Config, value string) error
+}
+
+func setString(field func(c *Config) *string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}
+}
+
+func setList(field func(c *Config) *[]string) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		*field(c) = splitList(value)
+		return nil
+	}
+}
+
+func setInt(field func(c *Config) *int) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setInt64(field func(c *Config) *int64) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(c *Config, value string) error {
+	return func(c *Config, value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("expected a duration like 5m")
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// envVars are the environment variables that override the config file, in the order they are applied
+var envVars = []envVar{
+	// PORT is what gin listened on before the config existed, OPENNOTE_ADDR wins if both are set
+	{"PORT", func(c *Config, value string) error {
+		c.Server.Addr = ":" + value
+		return nil
+	}},
+	{"OPENNOTE_ADDR", setString(func(c *Config) *string { return &c.Server.Addr })},
+	{"OPENNOTE_SERVER_URL", setString(func(c *Config) *string { return &c.Server.URL })},
+	{"OPENNOTE_CORS_ORIGINS", setList(func(c *Config) *[]string { return &c.Server.CORSOrigins })},
+	{"OPENNOTE_TRUSTED_PROXIES", setList(func(c *Config) *[]string { return &c.Server.TrustedProxies })},
+	{"OPENNOTE_SHUTDOWN_TIMEOUT", setDuration(func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout })},
+	{"OPENNOTE_FIREBASE_KEY_FILE", setString(func(c *Config) *string { return &c.Firebase.KeyFile })},
+	{"OPENNOTE_FIREBASE_STORAGE_BUCKET", setString(func(c *Config) *string { return &c.Firebase.StorageBucket })},
+	{"OPENNOTE_FIREBASE_API_KEY", setString(func(c *Config) *string { return &c.Firebase.Web.ApiKey })},
+	{"OPENNOTE_FIREBASE_AUTH_DOMAIN", setString(func(c *Config) *string { return &c.Firebase.Web.AuthDomain })},
+	{"OPENNOTE_FIREBASE_PROJECT_ID", setString(func(c *Config) *string { return &c.Firebase.Web.ProjectId })},
+	{"OPENNOTE_AUTH_PROVIDER", setString(func(c *Config) *string { return &c.Auth.Provider })},
+	{"OPENNOTE_LOCAL_ACCOUNTS_PATH", setString(func(c *Config) *string { return &c.Auth.Local.AccountsPath })},
+	{"OPENNOTE_LOCAL_SESSION_KEY_FILE", setString(func(c *Config) *string { return &c.Auth.Local.SessionKeyFile })},
+	{"OPENNOTE_LOCAL_SIGNUP", func(c *Config, value string) error {
+		signup, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		c.Auth.Local.Signup = signup
+		return nil
+	}},
+	{"OPENNOTE_MASTER_KEY_FILE", setString(func(c *Config) *string { return &c.Keys.MasterKeyFile })},
+	{"OPENNOTE_MASTER_KEYS", setList(func(c *Config) *[]string { return &c.Keys.MasterKeys })},
+	{"OPENNOTE_USER_STORE", setString(func(c *Config) *string { return &c.Users.Store })},
+	{"OPENNOTE_USER_STORE_PATH", setString(func(c *Config) *string { return &c.Users.Path })},
+	{"OPENNOTE_SESSION_TIME_LIMIT", setDuration(func(c *Config) *time.Duration { return &c.Sessions.TimeLimit })},
+	{"OPENNOTE_MAX_CONVERSATION_CHARS", setInt(func(c *Config) *int { return &c.Sessions.MaxConversationChars })},
+	{"OPENNOTE_CHAT_MODEL", setString(func(c *Config) *string { return &c.Models.Chat })},
+	{"OPENNOTE_EMBEDDING_MODEL", setString(func(c *Config) *string { return &c.Models.Embedding })},
+	{"OPENNOTE_DAILY_TOKEN_LIMIT", setInt64(func(c *Config) *int64 { return &c.Usage.DailyTokenLimit })},
+	{"OPENNOTE_MONTHLY_TOKEN_LIMIT", setInt64(func(c *Config) *int64 { return &c.Usage.MonthlyTokenLimit })},
+	{"OPENNOTE_OPENAI_VERIFICATION_TOKEN", setString(func(c *Config) *string { return &c.Plugin.OpenAIVerificationToken })},
+	{"OPENNOTE_TOKEN", setString(func(c *Config) *string { return &c.MCP.Token })},
+	{"OPENNOTE_LOG_LEVEL", setString(func(c *Config) *string { return &c.Log.Level })},
+	{"OPENNOTE_LOG_FORMAT", setString(func(c *Config) *string { return &c.Log.Format })},
+	{"OPENNOTE_METRICS_TOKEN", setString(func(c *Config) *string { return &c.Metrics.Token })},
+	{"OPENNOTE_TRACING_ENDPOINT", setString(func(c *Config) *string { return &c.Tracing.Endpoint })},
+	{"OPENNOTE_TRACING_HEADERS", func(c *Config, value string) error {
+		headers := map[string]string{}
+		for _, entry := range splitList(value) {
+			key, value, ok := strings.Cut(entry, "=")
+			if !ok || strings.TrimSpace(key) == "" {
+				return errors.New("expected key=value pairs separated by commas")
+			}
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		c.Tracing.Headers = headers
+		return nil
+	}},
+	{"OPENNOTE_TRACING_SAMPLE_RATIO", func(c *Config, value string) error {
+		ratio, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("expected a number between 0 and 1")
+		}
+		c.Tracing.SampleRatio = ratio
+		return nil
+	}},
+	// OTEL_SERVICE_NAME is the name every OpenTelemetry sdk reads
+	{"OTEL_SERVICE_NAME", setString(func(c *Config) *string { return &c.Tracing.ServiceName })},
+	{"OPENNOTE_ADMIN_TOKEN", setString(func(c *Config) *string { return &c.Admin.Token })},
+	{"OPENNOTE_UPSTREAM_ATTEMPTS", setInt(func(c *Config) *int { return &c.Upstreams.Attempts })},
+	{"OPENNOTE_UPSTREAM_MAX_DELAY", setDuration(func(c *Config) *time.Duration { return &c.Upstreams.MaxDelay })},
+	{"OPENNOTE_BREAKER_FAILURES", setInt(func(c *Config) *int { return &c.Upstreams.BreakerFailures })},
+	{"OPENNOTE_BREAKER_COOLDOWN", setDuration(func(c *Config) *time.Duration { return &c.Upstreams.BreakerCooldown })},
+}
+
+// splitList splits a comma separated list and drops empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// Load builds the config out of the defaults, the config file, the environment and the flags in args. Flags come
+// before the subcommand, the arguments after the flags are returned.
+func Load(args []string) (Config, []string, error) {
+	c := Default()
+
+	flags := flag.NewFlagSet("opennote", flag.ContinueOnError)
+	file := flags.String("config", "", "path of the YAML config file")
+	addr := flags.String("addr", "", "address the server listens on")
+	serverURL := flags.String("server-url", "", "public url of the server")
+	authProvider := flags.String("auth-provider", "", "who signs users in, firebase or local")
+	userStore := flags.String("user-store", "", "where users are stored, firestore, bolt or memory")
+	userStorePath := flags.String("user-store-path", "", "database file of the bolt user store")
+	sessionTimeLimit := flags.Duration("session-time-limit", 0, "how long a session lives after its last request")
+	chatModel := flags.String("chat-model", "", "model conversations use")
+	logLevel := flags.String("log-level", "", "lowest level that is logged, trace, debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, nil, err
+	}
+
+	if err := c.readFile(*file); err != nil {
+		return Config{}, nil, err
+	}
+	for _, env := range envVars {
+		value, ok := os.LookupEnv(env.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := env.apply(&c, value); err != nil {
+			return Config{}, nil, fmt.Errorf("invalid %s: %w", env.name, err)
+		}
+	}
+
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "addr":
+			c.Server.Addr = *addr
+		case "server-url":
+			c.Server.URL = *serverURL
+		case "auth-provider":
+			c.Auth.Provider = *authProvider
+		case "user-store":
+			c.Users.Store = *userStore
+		case "user-store-path":
+			c.Users.Path = *userStorePath
+		case "session-time-limit":
+			c.Sessions.TimeLimit = *sessionTimeLimit
+		case "chat-model":
+			c.Models.Chat = *chatModel
+		case "log-level":
+			c.Log.Level = *logLevel
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return Config{}, nil, err
+	}
+	return c, flags.Args(), nil
+}
+
+// readFile reads the config file over c. A path that was picked explicitly has to exist, DefaultFile is optional.
+func (c *Config) readFile(path string) error {
+	if path == "" {
+		path = os.Getenv(FileEnv)
+	}
+	explicit := path != ""
+	if !explicit {
+		path = DefaultFile
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := yaml.Unmarshal(data, c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate returns every problem with the config at once
+func (c Config) Validate() error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if c.Server.Addr == "" {
+		problem("server.addr is required")
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problem("server.shutdown_timeout must be positive")
+	}
+	if u, err := url.Parse(c.Server.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		problem("server.url must be an http or https url")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problem("server.trusted_proxies must be ips or cidr ranges, not %q", proxy)
+		}
+	}
+	switch c.Auth.Provider {
+	case "firebase":
+	case "local":
+		if c.Auth.Local.AccountsPath == "" || c.Auth.Local.SessionKeyFile == "" {
+			problem("auth.local.accounts_path and auth.local.session_key_file are required with the local provider")
+		}
+	default:
+		problem("auth.provider must be firebase or local, not %q", c.Auth.Provider)
+	}
+	if len(c.Keys.MasterKeys) == 0 && c.Keys.MasterKeyFile == "" {
+		problem("keys.master_key_file or keys.master_keys is required")
+	}
+	switch c.Users.Store {
+	case "firestore", "memory":
+	case "bolt":
+		if c.Users.Path == "" {
+			problem("users.path is required with the bolt store")
+		}
+	default:
+		problem("users.store must be firestore, bolt or memory, not %q", c.Users.Store)
+	}
+	if c.Sessions.TimeLimit <= 0 {
+		problem("sessions.time_limit must be positive")
+	}
+	if c.Sessions.MaxConversationChars <= 0 {
+		problem("sessions.max_conversation_chars must be positive")
+	}
+	if c.Models.Chat == "" {
+		problem("models.chat is required")
+	}
+	if c.Models.Embedding == "" {
+		problem("models.embedding is required")
+	}
+	if c.Usage.DailyTokenLimit < 0 || c.Usage.MonthlyTokenLimit < 0 {
+		problem("usage token limits can't be negative")
+	}
+	switch c.Log.Level {
+	case "trace", "debug", "info", "warn", "error":
+	default:
+		problem("log.level must be trace, debug, info, warn or error, not %q", c.Log.Level)
+	}
+	if c.Log.Format != "json" && c.Log.Format != "console" {
+		problem("log.format must be json or console, not %q", c.Log.Format)
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("tracing.endpoint must be an http or https url")
+		}
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problem("tracing.sample_ratio must be between 0 and 1")
+	}
+	if c.Tracing.ServiceName == "" {
+		problem("tracing.service_name is required")
+	}
+	if c.Upstreams.Attempts < 1 {
+		problem("upstreams.attempts must be at least 1")
+	}
+	if c.Upstreams.MaxDelay < 0 || c.Upstreams.BreakerCooldown < 0 {
+		problem("upstreams.max_delay and upstreams.breaker_cooldown can't be negative")
+	}
+	if c.Upstreams.BreakerFailures < 0 {
+		problem("upstreams.breaker_failures can't be negative")
+	}
+	return errors.Join(problems...)
+}
+
+// LocalAuth reports whether users sign in with the local provider
+func (c Config) LocalAuth() bool {
+	return c.Auth.Provider == "local"
+}
+
+// FirebaseRequired reports whether the auth provider or user store can't work without firebase. The server still
+// connects to firebase without them when the service account exists, since access tokens, usage and OAuth keep their
+// data in firestore.
+func (c Config) FirebaseRequired() bool {
+	return !c.LocalAuth() || c.Users.Store == "firestore"
+}
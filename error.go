@@ -10,6 +10,11 @@ const (
 	PineconeError
 	InvalidCredsError
 	UserExistsError
+	UnauthenticatedError
+	ForbiddenError
+	QuotaExceededError
+	NonExistentWorkspace
+	UpstreamUnavailableError
 )
 
 func (c WebsiteRequestError) String() string {
@@ -28,6 +33,21 @@ func (c WebsiteRequestError) String() string {
 		return "InvalidCredsError"
 	case UserExistsError:
 		return "UserExistsError"
+	case UnauthenticatedError:
+		return "UnauthenticatedError"
+	case ForbiddenError:
+		return "ForbiddenError"
+	case QuotaExceededError:
+		return "QuotaExceededError"
+	case NonExistentWorkspace:
+		return "NonExistentWorkspace"
+	case UpstreamUnavailableError:
+		return "UpstreamUnavailableError"
 	}
 	return ""
 }
+
+// MarshalText sends error codes as their name, the numbers depend on the order of the constants
+func (c WebsiteRequestError) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
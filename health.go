@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// draining is set once the server got a signal to stop, new chats are refused while the running ones finish
+var draining atomic.Bool
+
+// readinessTimeout is how long /readyz waits for the user store
+const readinessTimeout = 2 * time.Second
+
+// HealthResponse is the response of /healthz and /readyz, Checks is only set by /readyz and has "ok" or the problem for
+// every check.
+type HealthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthzEndpoint is the endpoint at /healthz, it answers as long as the process is serving requests
+func healthzEndpoint(c *gin.Context) {
+	c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyzEndpoint is the endpoint at /readyz, load balancers only send traffic while it answers 200. It fails while the
+// server is draining so new requests go to the other instances.
+func readyzEndpoint(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	resp := HealthResponse{Status: "ok", Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			resp.Status = "unavailable"
+			resp.Checks[name] = err.Error()
+			return
+		}
+		resp.Checks[name] = "ok"
+	}
+	if draining.Load() {
+		check("draining", errors.New("shutting down"))
+	}
+	check("config", checkSetup())
+	if userStore != nil {
+		check("user_store", userStore.Ping(ctx))
+	}
+
+	status := http.StatusOK
+	if resp.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, resp)
+}
+
+// checkSetup reports whether everything the config asks for was set up
+func checkSetup() error {
+	switch {
+	case userStore == nil:
+		return errors.New("user store isn't set up")
+	case authProvider == nil:
+		return errors.New("auth provider isn't set up")
+	case userKeyring == nil:
+		return errors.New("master keys aren't loaded")
+	case sessions == nil:
+		return errors.New("sessions aren't set up")
+	}
+	return nil
+}
+
+// rejectWhileDraining is the middleware of the chat routes, a draining server lets running chats finish but takes no
+// new ones
+func rejectWhileDraining(c *gin.Context) {
+	if !draining.Load() {
+		c.Next()
+		return
+	}
+	c.Header("Retry-After", "5")
+	c.AbortWithStatusJSON(http.StatusServiceUnavailable, RequestErrorResult{
+		ErrorCode: ServerError,
+		Content:   "Server is shutting down",
+	})
+}
+
+// shutdown drains the server. New chats are refused, running requests and streams get until the timeout to finish and
+// are cut off after it, then the session timer is waited for and the stores are closed.
+func shutdown(srv *http.Server, timeout time.Duration, timerStopped <-chan struct{}) {
+	draining.Store(true)
+	log.Info().
+		Dur("Timeout", timeout).
+		Msg("Shutting down, waiting for running requests")
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Requests were still running at the shutdown deadline, closing them")
+		srv.Close()
+	}
+	<-timerStopped
+	closeStores()
+	log.Info().Msg("Shut down")
+}
+
+// closeStores drops the sessions and closes the databases. Sessions only live in memory and their usage is recorded as
+// it happens, so there is nothing to write back.
+func closeStores() {
+	sessionsMutex.Lock()
+	dropped := len(sessions)
+	sessions = map[string]*session{}
+	sessionsMutex.Unlock()
+	log.Info().
+		Int("Sessions", dropped).
+		Msg("Dropped sessions")
+
+	if err := userStore.Close(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Unable to close user store")
+	}
+	if local := localAuth(); local != nil {
+		if err := local.Close(); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Unable to close local accounts")
+		}
+	}
+	if firestoreClient != nil {
+		if err := firestoreClient.Close(); err != nil {
+			log.Error().
+				Err(err).
+				Msg("Unable to close firestore")
+		}
+	}
+}
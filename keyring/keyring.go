@@ -0,0 +1,217 @@
+package keyring
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size in bytes of both master keys and data keys, they're all AES-256 keys.
+const KeySize = 32
+
+var (
+	ErrUnknownVersion = errors.New("keyring: unknown master key version")
+	errNoKeys         = errors.New("keyring: no master keys configured")
+)
+
+// Keyring holds the versioned master keys used to wrap the per-record data keys. Records are always wrapped with the
+// highest version, older versions are only kept around so records that haven't been rotated yet can still be opened.
+type Keyring struct {
+	keys    map[int][]byte
+	current int
+}
+
+// Load will load the master keys from the key file at path. Every line of the key file is "version:base64key", blank
+// lines and lines starting with # are ignored.
+func Load(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return Parse(lines)
+}
+
+// Generate adds a new random master key to the key file at path, one version above the highest in it, and creates the
+// file if it doesn't exist yet. It returns the version of the new key, existing keys are kept so records wrapped with
+// them can still be opened until they're rotated.
+func Generate(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	version := 1
+	existing, err := Parse(strings.Split(string(data), "\n"))
+	switch {
+	case err == nil:
+		version = existing.CurrentVersion() + 1
+	case !errors.Is(err, errNoKeys):
+		return 0, err
+	}
+	key, err := NewDataKey()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return 0, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	entry := strconv.Itoa(version) + ":" + base64.StdEncoding.EncodeToString(key) + "\n"
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		entry = "\n" + entry
+	}
+	if _, err := file.WriteString(entry); err != nil {
+		file.Close()
+		return 0, err
+	}
+	return version, file.Close()
+}
+
+// Parse builds a keyring out of "version:base64key" entries.
+func Parse(entries []string) (*Keyring, error) {
+	k := &Keyring{keys: map[int][]byte{}}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		rawVersion, rawKey, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("keyring: malformed entry, expected version:key")
+		}
+		version, err := strconv.Atoi(strings.TrimSpace(rawVersion))
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("keyring: invalid key version %q", rawVersion)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(rawKey))
+		if err != nil || len(key) != KeySize {
+			return nil, fmt.Errorf("keyring: key version %d must be %d base64 encoded bytes", version, KeySize)
+		}
+		if _, exists := k.keys[version]; exists {
+			return nil, fmt.Errorf("keyring: duplicate key version %d", version)
+		}
+		k.keys[version] = key
+		if version > k.current {
+			k.current = version
+		}
+	}
+	if k.current == 0 {
+		return nil, errNoKeys
+	}
+	return k, nil
+}
+
+// CurrentVersion is the master key version new data keys are wrapped with.
+func (k *Keyring) CurrentVersion() int {
+	return k.current
+}
+
+// NewDataKey generates a fresh random data key for a single record.
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Wrap encrypts a data key with the current master key, it returns the wrapped key and the version it was wrapped with.
+func (k *Keyring) Wrap(dataKey []byte) (string, int, error) {
+	wrapped, err := seal(k.keys[k.current], dataKey, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	return wrapped, k.current, nil
+}
+
+// Unwrap decrypts a data key that was wrapped with the master key of the given version.
+func (k *Keyring) Unwrap(wrapped string, version int) ([]byte, error) {
+	master, ok := k.keys[version]
+	if !ok {
+		return nil, ErrUnknownVersion
+	}
+	return open(master, wrapped, nil)
+}
+
+// Rewrap re-encrypts a wrapped data key with the current master key without touching the data it protects.
+func (k *Keyring) Rewrap(wrapped string, version int) (string, int, error) {
+	dataKey, err := k.Unwrap(wrapped, version)
+	if err != nil {
+		return "", 0, err
+	}
+	return k.Wrap(dataKey)
+}
+
+// Encrypt seals plaintext with a data key, the additional data (like the owner of the record) must be passed again to
+// Decrypt so ciphertexts can't be moved between records.
+func Encrypt(dataKey []byte, plaintext string, additionalData string) (string, error) {
+	return seal(dataKey, []byte(plaintext), []byte(additionalData))
+}
+
+// Decrypt opens a ciphertext produced by Encrypt.
+func Decrypt(dataKey []byte, ciphertext string, additionalData string) (string, error) {
+	plaintext, err := open(dataKey, ciphertext, []byte(additionalData))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// seal encrypts with AES-GCM and returns base64(nonce || ciphertext)
+func seal(key []byte, plaintext []byte, additionalData []byte) (string, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := aead.Seal(nonce, nonce, plaintext, additionalData)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+func open(key []byte, encoded string, additionalData []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("keyring: ciphertext too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,230 @@
+package keyring
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, KeySize))
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		current int
+		wantErr bool
+	}{
+		{name: "single", entries: []string{"1:" + testKey(1)}, current: 1},
+		{name: "highest version is current", entries: []string{"3:" + testKey(3), "1:" + testKey(1)}, current: 3},
+		{name: "comments and blank lines", entries: []string{"# master keys", "", " 2 : " + testKey(2) + " "}, current: 2},
+		{name: "empty", entries: []string{"# nothing"}, wantErr: true},
+		{name: "no separator", entries: []string{testKey(1)}, wantErr: true},
+		{name: "zero version", entries: []string{"0:" + testKey(1)}, wantErr: true},
+		{name: "negative version", entries: []string{"-1:" + testKey(1)}, wantErr: true},
+		{name: "not base64", entries: []string{"1:not a key"}, wantErr: true},
+		{name: "short key", entries: []string{"1:" + base64.StdEncoding.EncodeToString([]byte("short"))}, wantErr: true},
+		{name: "duplicate version", entries: []string{"1:" + testKey(1), "1:" + testKey(2)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k, err := Parse(tt.entries)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("got no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.CurrentVersion() != tt.current {
+				t.Fatalf("current version %d, want %d", k.CurrentVersion(), tt.current)
+			}
+		})
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, err := Encrypt(dataKey, "sk-secret", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := base64.StdEncoding.DecodeString(ciphertext)
+	raw[len(raw)-1] ^= 1
+	tampered := base64.StdEncoding.EncodeToString(raw)
+
+	tests := []struct {
+		name           string
+		key            []byte
+		ciphertext     string
+		additionalData string
+		wantErr        bool
+	}{
+		{name: "round trip", key: dataKey, ciphertext: ciphertext, additionalData: "alice"},
+		{name: "other record", key: dataKey, ciphertext: ciphertext, additionalData: "bob", wantErr: true},
+		{name: "other key", key: otherKey, ciphertext: ciphertext, additionalData: "alice", wantErr: true},
+		{name: "tampered", key: dataKey, ciphertext: tampered, additionalData: "alice", wantErr: true},
+		{name: "too short", key: dataKey, ciphertext: base64.StdEncoding.EncodeToString([]byte("short")), additionalData: "alice", wantErr: true},
+		{name: "not base64", key: dataKey, ciphertext: "not base64!", additionalData: "alice", wantErr: true},
+		{name: "invalid key size", key: []byte("short"), ciphertext: ciphertext, additionalData: "alice", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plaintext, err := Decrypt(tt.key, tt.ciphertext, tt.additionalData)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %q and no error", plaintext)
+				}
+				return
+			}
+			if err != nil || plaintext != "sk-secret" {
+				t.Fatalf("got %q and %v", plaintext, err)
+			}
+		})
+	}
+}
+
+// encrypting the same plaintext twice must not give the same ciphertext, every seal gets its own nonce
+func TestEncryptNonce(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := Encrypt(dataKey, "sk-secret", "alice")
+	second, _ := Encrypt(dataKey, "sk-secret", "alice")
+	if first == second {
+		t.Fatal("two encryptions gave the same ciphertext")
+	}
+	if strings.Contains(first, "sk-secret") {
+		t.Fatal("ciphertext contains the plaintext")
+	}
+}
+
+func TestRewrap(t *testing.T) {
+	old, err := Parse([]string{"1:" + testKey(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := Parse([]string{"1:" + testKey(1), "2:" + testKey(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, version, err := old.Wrap(dataKey)
+	if err != nil || version != 1 {
+		t.Fatalf("wrap: version %d, err %v", version, err)
+	}
+
+	rewrapped, version, err := rotated.Rewrap(wrapped, 1)
+	if err != nil || version != 2 {
+		t.Fatalf("rewrap: version %d, err %v", version, err)
+	}
+	unwrapped, err := rotated.Unwrap(rewrapped, 2)
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("unwrap of the rewrapped key: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		keyring *Keyring
+		wrapped string
+		version int
+		err     error
+	}{
+		{name: "version not in keyring", keyring: old, wrapped: rewrapped, version: 2, err: ErrUnknownVersion},
+		{name: "wrong version", keyring: rotated, wrapped: wrapped, version: 2},
+		{name: "unknown version", keyring: rotated, wrapped: wrapped, version: 7, err: ErrUnknownVersion},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := tt.keyring.Rewrap(tt.wrapped, tt.version)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing *string
+		version  int
+		entries  int
+	}{
+		{name: "new file", version: 1, entries: 1},
+		{name: "only comments", existing: ptr("# master keys\n"), version: 1, entries: 1},
+		{name: "next version", existing: ptr("1:" + testKey(1) + "\n3:" + testKey(3) + "\n"), version: 4, entries: 3},
+		{name: "no trailing newline", existing: ptr("1:" + testKey(1)), version: 2, entries: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys", "master.keys")
+			if tt.existing != nil {
+				if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(*tt.existing), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			version, err := Generate(path)
+			if err != nil || version != tt.version {
+				t.Fatalf("got version %d and %v, want %d", version, err, tt.version)
+			}
+			k, err := Load(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if k.CurrentVersion() != tt.version || len(k.keys) != tt.entries {
+				t.Fatalf("loaded version %d with %d keys, want %d with %d", k.CurrentVersion(), len(k.keys), tt.version, tt.entries)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.existing == nil && info.Mode().Perm() != 0o600 {
+				t.Fatalf("key file is readable by others, mode %v", info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestGenerateInvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "master.keys")
+	if err := os.WriteFile(path, []byte("not a key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Generate(path); err == nil {
+		t.Fatal("generated a key into a malformed key file")
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != "not a key\n" {
+		t.Fatalf("malformed key file was changed to %q", data)
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"github.com/rs/zerolog/log"
+)
+
+// rotateUserKeys re-wraps the data key of every stored user with the current master key. Secrets themselves aren't
+// re-encrypted since only the wrapping changes, legacy plaintext records get sealed for the first time.
+func rotateUserKeys() error {
+	ctx := context.Background()
+	current := userKeyring.CurrentVersion()
+	rotated, sealed, skipped := 0, 0, 0
+
+	if err := checkUsersMigrated(ctx, ""); err != nil {
+		return err
+	}
+	records, err := userStore.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, listed := range records {
+		if listed.DataKey != "" && listed.KeyVersion == current {
+			skipped++
+			continue
+		}
+		// the record is rotated as it is stored now, so a settings change made since List isn't lost
+		legacy := false
+		_, err := userStore.Update(ctx, listed.Uid, func(record userRecord) (userRecord, error) {
+			legacy = record.DataKey == ""
+			return rotateUserRecord(record, current)
+		})
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("User", listed.Uid).
+				Msg("Unable to rotate user keys")
+			return err
+		}
+		if legacy {
+			sealed++
+		} else {
+			rotated++
+		}
+	}
+	log.Info().
+		Int("KeyVersion", current).
+		Int("Rotated", rotated).
+		Int("Sealed", sealed).
+		Int("Skipped", skipped).
+		Msg("Finished rotating user keys")
+	return nil
+}
+
+// rotateUserRecord re-wraps the data key of the record with the current master key, or seals it if it's a legacy
+// plaintext record
+func rotateUserRecord(record userRecord, current int) (userRecord, error) {
+	switch {
+	case record.DataKey == "":
+		return sealUser(User{
+			Uid:                 record.Uid,
+			OpenAIApiKey:        record.OpenAIApiKey,
+			PineconeApiKey:      record.PineconeApiKey,
+			PineconeIndex:       record.PineconeIndex,
+			PineconeEnvironment: record.PineconeEnvironment,
+			PineconeProjectName: record.PineconeProjectName,
+			TopK:                record.TopK,
+		})
+	case record.KeyVersion == current:
+		return record, nil
+	}
+	var err error
+	record.DataKey, record.KeyVersion, err = userKeyring.Rewrap(record.DataKey, record.KeyVersion)
+	return record, err
+}
+
+// rotateWorkspaceKeys re-wraps the data key of every workspace with the current master key, workspaces are sealed with
+// the same keyring as users
+func rotateWorkspaceKeys() error {
+	ctx := context.Background()
+	current := userKeyring.CurrentVersion()
+	rotated, skipped := 0, 0
+
+	docs, err := firestoreClient.Collection("workspaces").Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		var record workspaceRecord
+		if err := doc.DataTo(&record); err != nil {
+			return err
+		}
+		if record.KeyVersion == current {
+			skipped++
+			continue
+		}
+		record.DataKey, record.KeyVersion, err = userKeyring.Rewrap(record.DataKey, record.KeyVersion)
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("Workspace", record.Id).
+				Msg("Unable to rotate workspace keys")
+			return err
+		}
+		if _, err = doc.Ref.Set(ctx, record); err != nil {
+			return err
+		}
+		rotated++
+	}
+	log.Info().
+		Int("KeyVersion", current).
+		Int("Rotated", rotated).
+		Int("Skipped", skipped).
+		Msg("Finished rotating workspace keys")
+	return nil
+}
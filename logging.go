@@ -0,0 +1,77 @@
+package main
+
+import (
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"regexp"
+)
+
+// logWriter is where every log goes, it's also handed to gin so panics it recovers from are redacted too
+var logWriter io.Writer = redactingWriter{out: os.Stderr}
+
+// loggingSetup sets the level and format of the logs. Everything goes through a redactingWriter, so secrets and notes
+// that end up in a log by accident, like inside an error from an upstream api, don't reach the output.
+func loggingSetup(conf config.Log) {
+	var out io.Writer = os.Stderr
+	if conf.Format == "console" {
+		out = zerolog.ConsoleWriter{Out: os.Stderr}
+	}
+	logWriter = redactingWriter{out: out}
+	log.Logger = zerolog.New(logWriter).With().Timestamp().Logger()
+	// logging with the context of something that isn't a request still logs, just without a request id
+	zerolog.DefaultContextLogger = &log.Logger
+
+	level, err := zerolog.ParseLevel(conf.Level)
+	if err != nil {
+		level = zerolog.InfoLevel
+	}
+	zerolog.SetGlobalLevel(level)
+	// gin prints every route and a warning per request in debug mode, that's only wanted when debugging
+	if level > zerolog.DebugLevel {
+		gin.SetMode(gin.ReleaseMode)
+	}
+	gin.DefaultWriter = logWriter
+	gin.DefaultErrorWriter = logWriter
+}
+
+// redacted replaces whatever the redaction patterns match
+const redacted = "[REDACTED]"
+
+var (
+	// secretPatterns match secrets wherever they are, OpenAI keys, opennote tokens and bearer credentials
+	secretPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`sk-[A-Za-z0-9_-]{16,}`),
+		regexp.MustCompile(`\bon[aprscldw]_[A-Za-z0-9_-]{16,}`),
+		regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`),
+	}
+	// sensitiveFields matches JSON fields holding credentials or the content of notes and conversations, only the value
+	// is replaced so the log still shows the field was there
+	sensitiveFields = regexp.MustCompile(`(?i)("[a-z_]*(?:api_?key|secret|password|token|authorization|content|chat|queries|query)"\s*:\s*)("(?:[^"\\]|\\.)*"|\[(?:[^\]"]|"(?:[^"\\]|\\.)*")*\])`)
+)
+
+// redactingWriter scrubs secrets and note content out of every log before writing it to out. zerolog writes every
+// event with a single Write, so the patterns always see whole JSON objects.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	scrubbed := redact(p)
+	if _, err := w.out.Write(scrubbed); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// redact returns p with secrets and sensitive fields replaced
+func redact(p []byte) []byte {
+	p = sensitiveFields.ReplaceAll(p, []byte(`${1}"`+redacted+`"`))
+	for _, pattern := range secretPatterns {
+		p = pattern.ReplaceAll(p, []byte(redacted))
+	}
+	return p
+}
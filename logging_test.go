@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{
+			name: "nothing sensitive",
+			in:   `{"level":"info","User":"alice","message":"Saved user"}`,
+			want: `{"level":"info","User":"alice","message":"Saved user"}`,
+		},
+		{
+			name: "openai key in an error",
+			in:   `{"error":"invalid key sk-abcdefghijklmnopqrstuvwx provided"}`,
+			want: `{"error":"invalid key [REDACTED] provided"}`,
+		},
+		{
+			name: "short sk- prefix isn't a key",
+			in:   `{"message":"task-list sk-short"}`,
+			want: `{"message":"task-list sk-short"}`,
+		},
+		{
+			name: "opennote tokens",
+			in:   `{"message":"ona_abcdefghijklmnopqrstuv onr_abcdefghijklmnopqrstuv"}`,
+			want: `{"message":"[REDACTED] [REDACTED]"}`,
+		},
+		{
+			name: "bearer credentials",
+			in:   `{"message":"header Bearer eyJhbGciOi.eyJzdWIi.c2lnbmF0dXJl"}`,
+			want: `{"message":"header [REDACTED]"}`,
+		},
+		{
+			name: "sensitive string fields",
+			in:   `{"openai_api_key":"whatever","password":"hunter2","User":"alice"}`,
+			want: `{"openai_api_key":"[REDACTED]","password":"[REDACTED]","User":"alice"}`,
+		},
+		{
+			name: "escaped quotes in a field",
+			in:   `{"content":"she said \"hi\"","User":"alice"}`,
+			want: `{"content":"[REDACTED]","User":"alice"}`,
+		},
+		{
+			name: "array field",
+			in:   `{"queries":["first","has ] inside"],"User":"alice"}`,
+			want: `{"queries":"[REDACTED]","User":"alice"}`,
+		},
+		{
+			name: "field names are case insensitive",
+			in:   `{"Authorization":"Basic abc"}`,
+			want: `{"Authorization":"[REDACTED]"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redact([]byte(tt.in)); string(got) != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// a Write must report the length of what it was given, not of what was written, or zerolog reports a short write
+func TestRedactingWriter(t *testing.T) {
+	var out bytes.Buffer
+	in := []byte(`{"password":"a much longer password than the replacement"}`)
+	n, err := redactingWriter{out: &out}.Write(in)
+	if err != nil || n != len(in) {
+		t.Fatalf("wrote %d and %v, want %d", n, err, len(in))
+	}
+	if want := `{"password":"[REDACTED]"}`; out.String() != want {
+		t.Fatalf("got %s, want %s", out.String(), want)
+	}
+}
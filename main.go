@@ -3,13 +3,22 @@ package main
 import (
 	"cloud.google.com/go/firestore"
 	"context"
+	"errors"
 	firebase "firebase.google.com/go/v4"
 	"firebase.google.com/go/v4/auth"
+	"flag"
+	"fmt"
+	"github.com/abimek/opennote/config"
+	"github.com/abimek/opennote/keyring"
 	"github.com/abimek/opennote/routing"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/api/option"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 var firestoreClient *firestore.Client
@@ -17,39 +26,179 @@ var fireauthClient *auth.Client
 
 func main() {
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
-	// intialize firebase
-	firebaseSetup()
-	sessions = map[string]*session{}
-
-	r := gin.Default()
-	// cors is not necessary on production, I'll be attempting to run this on a docker container soon
-	r.Use(routing.GENERAL)
-	// serving static file to OpenAI
+
+	cfg, args, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		printUsage(os.Stderr)
+		return
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	loggingSetup(cfg.Log)
+	shutdownTracing := tracingSetup(cfg.Tracing)
+	defer shutdownTracing(context.Background())
+	if len(args) > 0 && args[0] == "help" {
+		printUsage(os.Stdout)
+		return
+	}
+	cmd, args, err := findCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+
+	if cmd.setup >= setupStores {
+		// intialize firebase, servers using local auth and a local user store can run without it
+		if firebaseConfigured(cfg) {
+			firebaseSetup(cfg.Firebase)
+		}
+		resilienceSetup(cfg.Upstreams)
+		authSetup(cfg.Auth)
+		keyringSetup(cfg.Keys)
+		userStoreSetup(cfg.Users)
+		usageSetup(cfg.Usage)
+		oauthSetup(cfg.Firebase.Web)
+	}
+	if cmd.setup >= setupSessions {
+		sessionsSetup(cfg.Sessions, cfg.Models)
+	}
+	if err := cmd.run(cfg, args); err != nil {
+		log.Fatal().Err(err).Msg("Unable to run " + cmd.name)
+	}
+}
+
+// serveCommand serves the api until it gets SIGTERM or an interrupt, then drains
+func serveCommand(cfg config.Config, args []string) error {
+	if _, err := commandArgs(flag.NewFlagSet("serve", flag.ContinueOnError), args); err != nil {
+		return err
+	}
+	r := newRouter(cfg)
+	// the spec is generated from the registered routes, so the plugin is set up after them
+	pluginSetup(cfg)
+	//steams
+	//r.StaticFile("/download/PinePassInstaller", "./resources/content/PinePassInstaller.exe")
+
+	// SIGTERM is how deploys stop the server, interrupt is ctrl-c during development
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	timerStopped := make(chan struct{})
+	go func() {
+		sessionTimer(ctx)
+		close(timerStopped)
+	}()
+
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("Unable to serve")
+		}
+	}()
+	log.Info().
+		Str("Addr", cfg.Server.Addr).
+		Msg("Serving")
+	<-ctx.Done()
+	// a second signal kills the server right away
+	stop()
+	shutdown(srv, cfg.Server.ShutdownTimeout, timerStopped)
+	return nil
+}
+
+// newRouter registers every route, it has no side effects besides the registration so the openapi spec can be
+// generated without starting the server.
+func newRouter(cfg config.Config) *gin.Engine {
+	routing.Reset()
+	r := gin.New()
+	// without trusted proxies anyone could pick their own client ip, and with it their own rate limit, with X-Forwarded-For
+	if err := r.SetTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("Invalid trusted proxies")
+	}
+	// recovery runs after the access log so a panic is logged as the 500 it's answered with
+	r.Use(routing.RequestID, traceRequests, routing.AccessLog, observeRequests, gin.RecoveryWithWriter(logWriter))
 	log.Debug().Msg("Initilizing Requests")
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
 			"message": "Hello world!",
 		})
 	})
-	routing.Route(r, "POST", "/api/createEmptyUser", initEmptyUserEndpoint)
-	routing.Route(r, "POST", "/api/getUser", getUserEndpoint)
-	routing.Route(r, "POST", "/api/updateUser", updateUserEndpoint)
-	routing.Route(r, "POST", "/api/validateCredentials", validateCredentials)
-	routing.Route(r, "POST", "/messager", queryMessageEndpoint2)
-	//steams
-	//r.StaticFile("/download/PinePassInstaller", "./resources/content/PinePassInstaller.exe")
-	go sessionTimer()
-	r.Run()
+	routing.Route(r, "GET", "/healthz", healthzEndpoint)
+	routing.Route(r, "GET", "/readyz", readyzEndpoint)
+
+	routing.Route(r, "GET", "/metrics", metricsEndpoint(cfg.Metrics.Token))
+
+	// the admin api the opennote command manages a running server with
+	admin := r.Group("/admin", requireAdmin(cfg.Admin.Token))
+	routing.Route(admin, "GET", "/sessions", listSessionsEndpoint)
+	routing.Route(admin, "POST", "/sessions/evict", evictSessionEndpoint)
+
+	// routes used by the website and the obsidian plugin
+	origins := cfg.Server.CORSOrigins
+	if len(origins) == 0 {
+		origins = routing.DefaultAppOrigins
+	}
+	app := r.Group("/", routing.AppCORSPolicy(origins).Middleware())
+	routing.Route(app, "POST", "/api/createEmptyUser", routing.LimitIP, authenticate(""), routing.LimitUser, initEmptyUserEndpoint)
+	routing.Route(app, "POST", "/api/getUser", routing.LimitIP, authenticate(ScopeReadSettings), routing.LimitUser, getUserEndpoint)
+	routing.Route(app, "POST", "/api/updateUser", routing.LimitIP, authenticate(""), routing.LimitUser, updateUserEndpoint)
+	routing.Route(app, "PATCH", "/api/user", routing.LimitIP, authenticate(""), routing.LimitUser, patchUserEndpoint)
+	routing.Route(app, "POST", "/api/validateCredentials", routing.LimitIP, authenticate(""), routing.LimitUser, validateCredentials)
+	routing.Route(app, "POST", "/api/createToken", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, createTokenEndpoint)
+	routing.Route(app, "POST", "/api/listTokens", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, listTokensEndpoint)
+	routing.Route(app, "POST", "/api/revokeToken", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, revokeTokenEndpoint)
+	routing.Route(app, "POST", "/api/getUsage", requireFirestore, routing.LimitIP, authenticate(ScopeReadSettings), routing.LimitUser, getUsageEndpoint)
+	routing.Route(app, "POST", "/messager", rejectWhileDraining, routing.LimitIP, authenticate(ScopeChat), routing.LimitUser, queryMessageEndpoint2)
+	routing.Route(app, "POST", "/oauth/register", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, registerClientEndpoint)
+	routing.Route(app, "GET", "/api/account/export", routing.LimitIP, authenticate(""), routing.LimitUser, exportAccountEndpoint)
+	routing.Route(app, "POST", "/api/account/delete", routing.LimitIP, authenticate(""), routing.LimitUser, requestDeletionEndpoint)
+	routing.Route(app, "POST", "/api/account/delete/confirm", routing.LimitIP, authenticate(""), routing.LimitUser, confirmDeletionEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/create", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, createWorkspaceEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/list", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, listWorkspacesEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/get", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, getWorkspaceEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/update", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, updateWorkspaceEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/credentials", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, workspaceCredentialsEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/delete", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, deleteWorkspaceEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/invite", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, inviteEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/join", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, joinWorkspaceEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/setRole", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, setRoleEndpoint)
+	routing.Route(app, "POST", "/api/workspaces/removeMember", requireFirestore, routing.LimitIP, authenticate(""), routing.LimitUser, removeMemberEndpoint)
+	routing.Route(app, "GET", "/api/conversation/workspaces", routing.LimitIP, authenticate(ScopeChat), routing.LimitUser, getConversationWorkspacesEndpoint)
+	routing.Route(app, "POST", "/api/conversation/workspaces", routing.LimitIP, authenticate(ScopeChat), routing.LimitUser, setConversationWorkspacesEndpoint)
+	routing.Route(app, "POST", "/auth/login", routing.LimitIP, loginEndpoint)
+	routing.Route(app, "POST", "/auth/signup", routing.LimitIP, signupEndpoint)
+
+	// routes used by the ChatGPT plugin, only described routes end up in the openapi spec ChatGPT reads
+	plugin := r.Group("/", routing.PluginCORSPolicy().Middleware())
+	routing.Route(plugin, "GET", "/.well-known/ai-plugin.json", pluginManifestEndpoint)
+	routing.Route(plugin, "GET", "/.well-known/openapi.yaml", openapiSpecEndpoint)
+	routing.Route(plugin, "GET", "/.well-known/logo.png", pluginLogoEndpoint)
+	routing.Route(plugin, "POST", "/query", rejectWhileDraining, routing.LimitIP, authenticate(ScopeQuery), routing.LimitUser, queryEndpoint)
+	routing.Describe("POST", "/query", routing.Spec{
+		OperationId: "query_post",
+		Summary:     "Finds relevant information about an asked topic from the users notes",
+		Request:     QueryRequest{},
+		Response:    QueryResponse{},
+	})
+	routing.Route(plugin, "POST", "/mcp", rejectWhileDraining, routing.LimitIP, authenticate(ScopeQuery), routing.LimitUser, mcpEndpoint)
+	routing.Route(plugin, "GET", "/oauth/authorize", requireFirestore, routing.LimitIP, authorizePageEndpoint)
+	routing.Route(plugin, "POST", "/oauth/authorize", requireFirestore, routing.LimitIP, authorizeEndpoint)
+	routing.Route(plugin, "POST", "/oauth/token", requireFirestore, routing.LimitIP, tokenEndpoint)
+
+	// OpenAI compatible routes, so OpenAI client libraries and chat UIs can use opennote with an opennote token
+	v1 := r.Group("/v1", routing.AppCORSPolicy(origins).Middleware())
+	routing.Route(v1, "POST", "/chat/completions", rejectWhileDraining, routing.LimitIP, authenticate(ScopeChat), routing.LimitUser, chatCompletionsEndpoint)
+	routing.Route(v1, "GET", "/models", routing.LimitIP, authenticate(ScopeChat), routing.LimitUser, modelsEndpoint)
+	return r
 }
 
 // firebaseSetup inits firebaseAuth and firestore
-func firebaseSetup() {
+func firebaseSetup(conf config.Firebase) {
 	// intialize firestore
-	config := &firebase.Config{
-		StorageBucket: "todo",
+	firebaseConfig := &firebase.Config{
+		StorageBucket: conf.StorageBucket,
 	}
-	opt := option.WithCredentialsFile("resources/firebase/key.json")
-	app, err := firebase.NewApp(context.Background(), config, opt)
+	opt := option.WithCredentialsFile(conf.KeyFile)
+	app, err := firebase.NewApp(context.Background(), firebaseConfig, opt)
 	if err != nil {
 		panic("Unablet to connect to firebase")
 	}
@@ -65,3 +214,21 @@ func firebaseSetup() {
 		panic("Unable to conenct to fireauth")
 	}
 }
+
+// keyringSetup loads the master keys used to encrypt user secrets at rest, inline keys take priority over the key file
+func keyringSetup(conf config.Keys) {
+	var err error
+	if len(conf.MasterKeys) > 0 {
+		userKeyring, err = keyring.Parse(conf.MasterKeys)
+	} else {
+		userKeyring, err = keyring.Load(conf.MasterKeyFile)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		log.Fatal().
+			Str("MasterKeyFile", conf.MasterKeyFile).
+			Msg("There is no master key file, create it with \"opennote keys generate\" before the first start")
+	}
+	if err != nil {
+		panic("Unable to load master keys: " + err.Error())
+	}
+}
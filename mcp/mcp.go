@@ -0,0 +1,298 @@
+package mcp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// LatestProtocolVersion is the newest MCP revision the server speaks, older revisions a client asks for are accepted
+// since the subset opennote uses didn't change between them.
+const LatestProtocolVersion = "2025-06-18"
+
+var supportedProtocolVersions = map[string]bool{
+	"2024-11-05": true,
+	"2025-03-26": true,
+	"2025-06-18": true,
+}
+
+// JSON-RPC error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeResourceNotFound is the MCP specific code for reading a resource that doesn't exist
+	CodeResourceNotFound = -32002
+)
+
+// Tool is a tool the client can call, InputSchema is the JSON schema of its arguments.
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+// Content is a single piece of tool output, opennote only returns text.
+type Content struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+// ToolResult is the result of a tool call. Failures of the tool itself are reported with IsError so the model can see
+// them, protocol errors are returned as JSON-RPC errors instead.
+type ToolResult struct {
+	Content []Content `json:"content"`
+	IsError bool      `json:"isError,omitempty"`
+}
+
+// TextResult returns a successful result with a single text content.
+func TextResult(text string) *ToolResult {
+	return &ToolResult{Content: []Content{{Type: "text", Text: text}}}
+}
+
+// ErrorResult returns a failed result the model gets to see.
+func ErrorResult(text string) *ToolResult {
+	return &ToolResult{Content: []Content{{Type: "text", Text: text}}, IsError: true}
+}
+
+type Resource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+type ResourceTemplate struct {
+	URITemplate string `json:"uriTemplate"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+type ResourceContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType,omitempty"`
+	Text     string `json:"text"`
+}
+
+// Backend provides the tools and resources of a single authenticated user.
+type Backend interface {
+	Tools() []Tool
+	CallTool(ctx context.Context, name string, arguments json.RawMessage) (*ToolResult, error)
+	Resources(ctx context.Context) ([]Resource, error)
+	ResourceTemplates() []ResourceTemplate
+	// ReadResource returns nil contents if the resource doesn't exist
+	ReadResource(ctx context.Context, uri string) ([]ResourceContents, error)
+}
+
+// Server answers MCP requests, it holds no per client state so the same server is shared by every transport and user.
+type Server struct {
+	Name         string
+	Version      string
+	Instructions string
+}
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  any             `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Handle answers a single JSON-RPC message or a batch of them, it returns nil when there is nothing to send back
+// (notifications and responses from the client).
+func (s *Server) Handle(ctx context.Context, backend Backend, message []byte) []byte {
+	message = bytes.TrimSpace(message)
+	if len(message) > 0 && message[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(message, &batch); err != nil {
+			return marshal(errorResponse(nil, CodeParseError, "invalid JSON"))
+		}
+		var responses []*response
+		for _, m := range batch {
+			if resp := s.handleOne(ctx, backend, m); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		return marshal(responses)
+	}
+	if resp := s.handleOne(ctx, backend, message); resp != nil {
+		return marshal(resp)
+	}
+	return nil
+}
+
+func (s *Server) handleOne(ctx context.Context, backend Backend, message []byte) *response {
+	var req request
+	if err := json.Unmarshal(message, &req); err != nil {
+		return errorResponse(nil, CodeParseError, "invalid JSON")
+	}
+	// responses to server requests and notifications don't get an answer
+	if req.Method == "" || len(req.Id) == 0 {
+		return nil
+	}
+	if req.JSONRPC != "2.0" {
+		return errorResponse(req.Id, CodeInvalidRequest, "jsonrpc must be 2.0")
+	}
+
+	result, rpcErr := s.dispatch(ctx, backend, req)
+	if rpcErr != nil {
+		return &response{JSONRPC: "2.0", Id: req.Id, Error: rpcErr}
+	}
+	return &response{JSONRPC: "2.0", Id: req.Id, Result: result}
+}
+
+func (s *Server) dispatch(ctx context.Context, backend Backend, req request) (any, *rpcError) {
+	switch req.Method {
+	case "initialize":
+		var params struct {
+			ProtocolVersion string `json:"protocolVersion"`
+		}
+		_ = json.Unmarshal(req.Params, &params)
+		version := params.ProtocolVersion
+		if !supportedProtocolVersions[version] {
+			version = LatestProtocolVersion
+		}
+		return map[string]any{
+			"protocolVersion": version,
+			"capabilities": map[string]any{
+				"tools":     map[string]any{},
+				"resources": map[string]any{},
+			},
+			"serverInfo": map[string]any{
+				"name":    s.Name,
+				"version": s.Version,
+			},
+			"instructions": s.Instructions,
+		}, nil
+	case "ping":
+		return map[string]any{}, nil
+	case "tools/list":
+		return map[string]any{"tools": backend.Tools()}, nil
+	case "tools/call":
+		var params struct {
+			Name      string          `json:"name"`
+			Arguments json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.Name == "" {
+			return nil, &rpcError{Code: CodeInvalidParams, Message: "missing tool name"}
+		}
+		if !hasTool(backend.Tools(), params.Name) {
+			return nil, &rpcError{Code: CodeInvalidParams, Message: "unknown tool " + params.Name}
+		}
+		result, err := backend.CallTool(ctx, params.Name, params.Arguments)
+		if err != nil {
+			return ErrorResult(err.Error()), nil
+		}
+		return result, nil
+	case "resources/list":
+		resources, err := backend.Resources(ctx)
+		if err != nil {
+			return nil, &rpcError{Code: CodeInternalError, Message: err.Error()}
+		}
+		if resources == nil {
+			resources = []Resource{}
+		}
+		return map[string]any{"resources": resources}, nil
+	case "resources/templates/list":
+		return map[string]any{"resourceTemplates": backend.ResourceTemplates()}, nil
+	case "resources/read":
+		var params struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.URI == "" {
+			return nil, &rpcError{Code: CodeInvalidParams, Message: "missing uri"}
+		}
+		contents, err := backend.ReadResource(ctx, params.URI)
+		if err != nil {
+			return nil, &rpcError{Code: CodeInternalError, Message: err.Error()}
+		}
+		if contents == nil {
+			return nil, &rpcError{Code: CodeResourceNotFound, Message: "resource not found"}
+		}
+		return map[string]any{"contents": contents}, nil
+	}
+	return nil, &rpcError{Code: CodeMethodNotFound, Message: "method not found: " + req.Method}
+}
+
+func hasTool(tools []Tool, name string) bool {
+	for _, tool := range tools {
+		if tool.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func errorResponse(id json.RawMessage, code int, message string) *response {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &response{JSONRPC: "2.0", Id: id, Error: &rpcError{Code: code, Message: message}}
+}
+
+func marshal(v any) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// ServeStdio runs the stdio transport, messages are newline delimited JSON. It returns when in is closed.
+func (s *Server) ServeStdio(ctx context.Context, backend Backend, in io.Reader, out io.Writer) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		if resp := s.Handle(ctx, backend, line); resp != nil {
+			if _, err := out.Write(append(resp, '\n')); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// ServeHTTP answers a POST of the streamable HTTP transport. Every request gets a single JSON response, the server
+// never starts streams of its own so GET isn't supported and there are no sessions to DELETE.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request, backend Backend) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 16*1024*1024))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	resp := s.Handle(r.Context(), backend, body)
+	if resp == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(resp)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/abimek/opennote/mcp"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"os"
+	"strings"
+)
+
+const (
+	getNoteName        = "get_note"
+	getNoteDescription = "Returns the full content of a single note from the users notes by its id, ids are returned as resources by query_notes."
+
+	noteURIPrefix      = "opennote://notes/"
+	workspaceURIPrefix = "opennote://workspaces/"
+)
+
+var mcpServer = &mcp.Server{
+	Name:         "opennote",
+	Version:      "v1",
+	Instructions: "Search the users personal notes with query_notes before answering questions about things they wrote down.",
+}
+
+// notesBackend exposes the notes of a session over MCP
+type notesBackend struct {
+	sess *session
+}
+
+func (b notesBackend) Tools() []mcp.Tool {
+	return []mcp.Tool{
+		{
+			Name:        QueryNotesName,
+			Description: QueryNotesDescription,
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"queries": map[string]any{
+						"type":        "array",
+						"description": "List of queries for the users notes, like 'Zustand Usage' or 'B-Tree Implementation'",
+						"items":       map[string]any{"type": "string"},
+					},
+				},
+				"required": []string{"queries"},
+			},
+		},
+		{
+			Name:        getNoteName,
+			Description: getNoteDescription,
+			InputSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"id": map[string]any{
+						"type":        "string",
+						"description": "The id of the note",
+					},
+					"workspace": map[string]any{
+						"type":        "string",
+						"description": "The workspace the note is from, left out for the users own notes",
+					},
+				},
+				"required": []string{"id"},
+			},
+		},
+	}
+}
+
+func (b notesBackend) CallTool(ctx context.Context, name string, arguments json.RawMessage) (*mcp.ToolResult, error) {
+	if err := checkQuota(ctx, b.sess.uid()); err != nil {
+		return nil, err
+	}
+	b.sess.updateTimer()
+	switch name {
+	case QueryNotesName:
+		var request QueryRequest
+		if err := json.Unmarshal(arguments, &request); err != nil || len(request.Queries) == 0 {
+			return mcp.ErrorResult("queries must be a non empty list of strings"), nil
+		}
+		toolCalls.Inc(name)
+		resp, err := b.sess.searchNotes(ctx, request.Queries)
+		if err != nil {
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("User", b.sess.uid()).
+				Msg("Unable to search notes")
+			return mcp.ErrorResult(notesUnavailableResult), nil
+		}
+		data, _ := json.Marshal(resp)
+		return mcp.TextResult(string(data)), nil
+	case getNoteName:
+		var request struct {
+			Id        string `json:"id"`
+			Workspace string `json:"workspace"`
+		}
+		if err := json.Unmarshal(arguments, &request); err != nil || request.Id == "" {
+			return mcp.ErrorResult("id is required"), nil
+		}
+		index, ok := b.index(request.Workspace)
+		if !ok {
+			return mcp.ErrorResult("workspace " + request.Workspace + " isn't searched in this conversation"), nil
+		}
+		toolCalls.Inc(name)
+		note, ok, err := fetchNote(ctx, index, request.Id)
+		if err != nil {
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("User", b.sess.uid()).
+				Msg("Unable to fetch note")
+			return mcp.ErrorResult(notesUnavailableResult), nil
+		}
+		if !ok {
+			return mcp.ErrorResult("no note with id " + request.Id), nil
+		}
+		return mcp.TextResult(note.Content), nil
+	}
+	return nil, errors.New("unknown tool " + name)
+}
+
+// Resources lists the notes returned by the recent searches of the session, pinecone can't list an index so the rest
+// of the notes are only reachable through the resource template.
+func (b notesBackend) Resources(ctx context.Context) ([]mcp.Resource, error) {
+	var resources []mcp.Resource
+	for _, note := range b.sess.notes() {
+		name := note.Title
+		if name == "" {
+			name = note.Id
+		}
+		uri := noteURIPrefix + note.Id
+		if note.Workspace != "" {
+			uri = workspaceURIPrefix + note.Workspace + "/notes/" + note.Id
+		}
+		resources = append(resources, mcp.Resource{
+			URI:      uri,
+			Name:     name,
+			MimeType: "text/markdown",
+		})
+	}
+	return resources, nil
+}
+
+func (b notesBackend) ResourceTemplates() []mcp.ResourceTemplate {
+	return []mcp.ResourceTemplate{
+		{
+			URITemplate: noteURIPrefix + "{id}",
+			Name:        "Note",
+			Description: "A note from the users notes by its id",
+			MimeType:    "text/markdown",
+		},
+		{
+			URITemplate: workspaceURIPrefix + "{workspace}/notes/{id}",
+			Name:        "Workspace note",
+			Description: "A note from a workspace searched in this conversation by its id",
+			MimeType:    "text/markdown",
+		},
+	}
+}
+
+// index returns the index of the workspace, or the personal index if workspace is empty. Only workspaces in the search
+// scope of the session can be read.
+func (b notesBackend) index(workspace string) (*pineconeIndex, bool) {
+	if workspace == "" {
+		_, index := b.sess.clients()
+		return index, true
+	}
+	w, ok := b.sess.searchScope().workspace(workspace)
+	return w.index, ok
+}
+
+func (b notesBackend) ReadResource(ctx context.Context, uri string) ([]mcp.ResourceContents, error) {
+	workspace := ""
+	id, ok := strings.CutPrefix(uri, noteURIPrefix)
+	if !ok {
+		rest, isWorkspace := strings.CutPrefix(uri, workspaceURIPrefix)
+		workspace, id, ok = strings.Cut(rest, "/notes/")
+		ok = ok && isWorkspace && workspace != ""
+	}
+	if !ok || id == "" {
+		return nil, nil
+	}
+	index, ok := b.index(workspace)
+	if !ok {
+		return nil, nil
+	}
+	note, found, err := fetchNote(ctx, index, id)
+	if err != nil {
+		return nil, errors.New("unable to fetch note")
+	}
+	if !found {
+		return nil, nil
+	}
+	return []mcp.ResourceContents{{
+		URI:      uri,
+		MimeType: "text/markdown",
+		Text:     note.Content,
+	}}, nil
+}
+
+// mcpEndpoint is the endpoint at /mcp, the streamable HTTP transport of the MCP server. The quota is checked by the tool
+// calls, the other methods don't use tokens and an over quota client still gets JSON-RPC errors it understands.
+func mcpEndpoint(c *gin.Context) {
+	sess := sessionForRequest(c, authenticatedUid(c))
+	if sess == nil {
+		return
+	}
+	mcpServer.ServeHTTP(c.Writer, c.Request, notesBackend{sess: sess})
+}
+
+// serveMCPStdio runs the MCP server over stdin and stdout as the user that owns the token
+func serveMCPStdio(token string) error {
+	if token == "" {
+		return errors.New("OPENNOTE_TOKEN or mcp.token must be set to a personal access token with the query scope")
+	}
+	ctx := context.Background()
+	record, err := lookupAccessToken(ctx, token)
+	if err != nil {
+		return errors.New("invalid access token")
+	}
+	if !record.hasScope(ScopeQuery) {
+		return errors.New("access token is missing the query scope")
+	}
+	user, err := findUser(ctx, record.Uid)
+	if err != nil {
+		return err
+	}
+	sess, err := GetSession(ctx, user)
+	if err != nil {
+		return err
+	}
+	return mcpServer.ServeStdio(context.Background(), notesBackend{sess: sess}, os.Stdin, os.Stdout)
+}
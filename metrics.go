@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/abimek/opennote/metrics"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	httpRequests = metrics.NewCounter("opennote_http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	httpDuration = metrics.NewHistogram("opennote_http_request_duration_seconds",
+		"Time to handle HTTP requests by route and method, streamed responses count until the stream ends.",
+		metrics.DefaultBuckets, "route", "method")
+	openaiRequests = metrics.NewCounter("opennote_openai_requests_total",
+		"Calls to OpenAI by operation and status, the status is error when no response came back.", "operation", "status")
+	openaiDuration = metrics.NewHistogram("opennote_openai_request_duration_seconds",
+		"Time until OpenAI answered by operation, for streams it's the time until the stream started.",
+		metrics.DefaultBuckets, "operation")
+	pineconeDuration = metrics.NewHistogram("opennote_pinecone_query_duration_seconds",
+		"Time of Pinecone queries by result, ok or error.", metrics.DefaultBuckets, "result")
+	upstreamRetries = metrics.NewCounter("opennote_upstream_retries_total",
+		"Calls to OpenAI or Pinecone that were retried after a rate limit, server error or no answer, by upstream.", "upstream")
+	breakerChanges = metrics.NewCounter("opennote_circuit_breaker_changes_total",
+		"Times the circuit breaker of an upstream opened or closed, by upstream and the state it changed to.", "upstream", "state")
+	toolCalls = metrics.NewCounter("opennote_tool_calls_total",
+		"Tool calls executed for the model or an MCP client, by tool.", "tool")
+	sessionEvictions = metrics.NewCounter("opennote_session_evictions_total",
+		"Sessions the session timer removed after they were idle.")
+	streamedTokens = metrics.NewCounter("opennote_streamed_tokens_total",
+		"Estimated tokens of answer content streamed to clients.")
+	_ = metrics.NewGaugeFunc("opennote_active_sessions", "Sessions in memory.", func() float64 {
+		sessionsMutex.Lock()
+		defer sessionsMutex.Unlock()
+		return float64(len(sessions))
+	})
+)
+
+// observeRequests counts every request by the route it matched, unmatched requests share one label so scanners can't
+// blow up the number of series
+func observeRequests(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.Inc(route, c.Request.Method, strconv.Itoa(c.Writer.Status()))
+	httpDuration.Observe(time.Since(start).Seconds(), route, c.Request.Method)
+}
+
+// openaiOperation names the OpenAI api a call went to
+func openaiOperation(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		return "chat"
+	case strings.HasSuffix(path, "/embeddings"):
+		return "embedding"
+	case strings.HasSuffix(path, "/models"):
+		return "models"
+	}
+	return "other"
+}
+
+// observePinecone records the duration of a pinecone query that started at start
+func observePinecone(start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	pineconeDuration.Observe(time.Since(start).Seconds(), result)
+}
+
+// metricsEndpoint is the endpoint at /metrics that Prometheus scrapes. If a token is configured the scraper has to send
+// it as a bearer token, the metrics show which routes are used and how much.
+func metricsEndpoint(token string) gin.HandlerFunc {
+	handler := metrics.Handler()
+	return func(c *gin.Context) {
+		if token != "" {
+			if !bearerMatches(c, token) {
+				c.AbortWithStatus(http.StatusUnauthorized)
+				return
+			}
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,251 @@
+// Package metrics keeps counters, histograms and gauges and writes them in the Prometheus text format. It only has
+// what the server needs, metrics are registered once at startup and labelled by a fixed list of label names.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the histogram buckets in seconds, they go up to a minute since chat completions can be that slow
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// metric is anything that can write itself in the text format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+var (
+	registered   []metric
+	registeredMu sync.Mutex
+)
+
+func register(m metric) {
+	registeredMu.Lock()
+	registered = append(registered, m)
+	registeredMu.Unlock()
+}
+
+// labelSeparator joins label values into the key of a series, it can't be part of a valid utf-8 label value
+const labelSeparator = "\xff"
+
+// family is what counters and histograms share, the name, help and label names
+type family struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (f family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic("metric " + f.name + " takes " + strconv.Itoa(len(f.labels)) + " label values")
+	}
+	return strings.Join(values, labelSeparator)
+}
+
+func (f family) header(w *bufio.Writer, kind string) {
+	w.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+	w.WriteString("# TYPE " + f.name + " " + kind + "\n")
+}
+
+// labelPairs formats the labels of a series like {route="/query",status="200"}, extra is appended after them
+func (f family) labelPairs(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, value := range strings.Split(key, labelSeparator) {
+			pairs = append(pairs, f.labels[i]+`="`+escapeLabel(value)+`"`)
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+escapeLabel(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Counter is a value per label combination that only goes up
+type Counter struct {
+	family
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+// NewCounter registers a counter, the label values passed to Add and Inc are in the order of labels
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{family: family{name: name, help: help, labels: labels}, values: map[string]float64{}}
+	register(c)
+	return c
+}
+
+// Inc adds one to the series of the label values
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series of the label values, negative values are ignored since counters only go up
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		return
+	}
+	key := c.key(values)
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.header(w, "counter")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// a counter without labels has a single series, it's shown as 0 before it's first counted
+	if len(c.labels) == 0 && len(c.values) == 0 {
+		w.WriteString(c.name + " 0\n")
+	}
+	for _, key := range sortedKeys(c.values) {
+		w.WriteString(c.name + c.labelPairs(key) + " " + formatValue(c.values[key]) + "\n")
+	}
+}
+
+// Histogram counts observations into buckets per label combination
+type Histogram struct {
+	family
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	// counts are the observations per bucket, not cumulative, the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// NewHistogram registers a histogram with the upper bounds of its buckets, they have to be sorted
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		family:  family{name: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  map[string]*histogramSeries{},
+	}
+	register(h)
+	return h
+}
+
+// Observe adds v to the series of the label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+	bucket := sort.SearchFloat64s(h.buckets, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+	s.counts[bucket]++
+	s.sum += v
+	s.count++
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.header(w, "histogram")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		cumulative := uint64(0)
+		for i, count := range s.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(h.buckets) {
+				le = formatValue(h.buckets[i])
+			}
+			w.WriteString(h.name + "_bucket" + h.labelPairs(key, "le", le) + " " + strconv.FormatUint(cumulative, 10) + "\n")
+		}
+		w.WriteString(h.name + "_sum" + h.labelPairs(key) + " " + formatValue(s.sum) + "\n")
+		w.WriteString(h.name + "_count" + h.labelPairs(key) + " " + strconv.FormatUint(s.count, 10) + "\n")
+	}
+}
+
+// GaugeFunc is a gauge whose value is read when the metrics are scraped, for values the server already keeps like the
+// number of sessions
+type GaugeFunc struct {
+	family
+	value func() float64
+}
+
+// NewGaugeFunc registers a gauge that calls value on every scrape
+func NewGaugeFunc(name string, help string, value func() float64) *GaugeFunc {
+	g := &GaugeFunc{family: family{name: name, help: help}, value: value}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.header(w, "gauge")
+	w.WriteString(g.name + " " + formatValue(g.value()) + "\n")
+}
+
+// Write writes every registered metric in the Prometheus text format
+func Write(out io.Writer) error {
+	registeredMu.Lock()
+	metrics := append([]metric{}, registered...)
+	registeredMu.Unlock()
+
+	w := bufio.NewWriter(out)
+	for _, m := range metrics {
+		m.write(w)
+	}
+	return w.Flush()
+}
+
+// Handler answers scrapes with every registered metric
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
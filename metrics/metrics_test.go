@@ -0,0 +1,195 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// output writes a single metric in the text format
+func output(m metric) string {
+	var out strings.Builder
+	w := bufio.NewWriter(&out)
+	m.write(w)
+	w.Flush()
+	return out.String()
+}
+
+func TestCounter(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels []string
+		add    func(c *Counter)
+		want   string
+	}{
+		{
+			name: "unlabelled before the first count",
+			add:  func(c *Counter) {},
+			want: "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 0\n",
+		},
+		{
+			name: "unlabelled",
+			add: func(c *Counter) {
+				c.Inc()
+				c.Add(1.5)
+			},
+			want: "# HELP test_total Test.\n# TYPE test_total counter\ntest_total 2.5\n",
+		},
+		{
+			name:   "series are sorted by label values",
+			labels: []string{"route", "status"},
+			add: func(c *Counter) {
+				c.Inc("/query", "500")
+				c.Inc("/messager", "200")
+				c.Inc("/query", "200")
+				c.Inc("/query", "200")
+			},
+			want: "# HELP test_total Test.\n# TYPE test_total counter\n" +
+				`test_total{route="/messager",status="200"} 1` + "\n" +
+				`test_total{route="/query",status="200"} 2` + "\n" +
+				`test_total{route="/query",status="500"} 1` + "\n",
+		},
+		{
+			name:   "negative values are ignored",
+			labels: []string{"route"},
+			add: func(c *Counter) {
+				c.Add(2, "/query")
+				c.Add(-1, "/query")
+			},
+			want: "# HELP test_total Test.\n# TYPE test_total counter\n" + `test_total{route="/query"} 2` + "\n",
+		},
+		{
+			name:   "empty label value",
+			labels: []string{"route"},
+			add:    func(c *Counter) { c.Inc("") },
+			want:   "# HELP test_total Test.\n# TYPE test_total counter\n" + `test_total{route=""} 1` + "\n",
+		},
+		{
+			name:   "escaped label values",
+			labels: []string{"route"},
+			add:    func(c *Counter) { c.Inc("a\\b\"c\nd") },
+			want:   "# HELP test_total Test.\n# TYPE test_total counter\n" + `test_total{route="a\\b\"c\nd"} 1` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Counter{family: family{name: "test_total", help: "Test.", labels: tt.labels}, values: map[string]float64{}}
+			tt.add(c)
+			if got := output(c); got != tt.want {
+				t.Fatalf("got\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterLabelCount(t *testing.T) {
+	c := &Counter{family: family{name: "test_total", labels: []string{"route"}}, values: map[string]float64{}}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("counting with the wrong number of label values didn't panic")
+		}
+	}()
+	c.Inc("/query", "200")
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{
+		family:  family{name: "test_seconds", help: "Test.", labels: []string{"route"}},
+		buckets: []float64{.1, 1},
+		series:  map[string]*histogramSeries{},
+	}
+	// an observation on a bound counts in that bucket, le is inclusive
+	h.Observe(.05, "/query")
+	h.Observe(.1, "/query")
+	h.Observe(.5, "/query")
+	h.Observe(30, "/query")
+	h.Observe(.5, "/messager")
+
+	want := "# HELP test_seconds Test.\n# TYPE test_seconds histogram\n" +
+		`test_seconds_bucket{route="/messager",le="0.1"} 0` + "\n" +
+		`test_seconds_bucket{route="/messager",le="1"} 1` + "\n" +
+		`test_seconds_bucket{route="/messager",le="+Inf"} 1` + "\n" +
+		`test_seconds_sum{route="/messager"} 0.5` + "\n" +
+		`test_seconds_count{route="/messager"} 1` + "\n" +
+		`test_seconds_bucket{route="/query",le="0.1"} 2` + "\n" +
+		`test_seconds_bucket{route="/query",le="1"} 3` + "\n" +
+		`test_seconds_bucket{route="/query",le="+Inf"} 4` + "\n" +
+		`test_seconds_sum{route="/query"} 30.65` + "\n" +
+		`test_seconds_count{route="/query"} 4` + "\n"
+	if got := output(h); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramUnlabelled(t *testing.T) {
+	h := &Histogram{
+		family:  family{name: "test_seconds", help: "Test."},
+		buckets: []float64{1},
+		series:  map[string]*histogramSeries{},
+	}
+	h.Observe(2)
+	want := "# HELP test_seconds Test.\n# TYPE test_seconds histogram\n" +
+		`test_seconds_bucket{le="1"} 0` + "\n" +
+		`test_seconds_bucket{le="+Inf"} 1` + "\n" +
+		"test_seconds_sum 2\n" +
+		"test_seconds_count 1\n"
+	if got := output(h); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	g := &GaugeFunc{family: family{name: "test_sessions", help: "Sessions\nwith a \\ in the help."}, value: func() float64 { return 3 }}
+	want := "# HELP test_sessions Sessions\\nwith a \\\\ in the help.\n# TYPE test_sessions gauge\ntest_sessions 3\n"
+	if got := output(g); got != want {
+		t.Fatalf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{value: 0, want: "0"},
+		{value: 42, want: "42"},
+		{value: 0.005, want: "0.005"},
+		{value: 1e21, want: "1e+21"},
+		{value: math.Inf(1), want: "+Inf"},
+		{value: math.Inf(-1), want: "-Inf"},
+		{value: math.NaN(), want: "NaN"},
+	}
+	for _, tt := range tests {
+		if got := formatValue(tt.value); got != tt.want {
+			t.Errorf("formatValue(%v) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	registeredMu.Lock()
+	saved := registered
+	registered = nil
+	registeredMu.Unlock()
+	defer func() {
+		registeredMu.Lock()
+		registered = saved
+		registeredMu.Unlock()
+	}()
+	NewCounter("first_total", "First.").Inc()
+	NewGaugeFunc("second", "Second.", func() float64 { return 1 })
+
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("content type %q", ct)
+	}
+	want := "# HELP first_total First.\n# TYPE first_total counter\nfirst_total 1\n" +
+		"# HELP second Second.\n# TYPE second gauge\nsecond 1\n"
+	if w.Body.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", w.Body.String(), want)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/api/iterator"
+	"sort"
+	"time"
+)
+
+// migrateUsers rewrites the user documents that were created with random ids under users/{uid}. Users that signed up
+// twice at the same time have several documents, they are merged field by field with the most recently updated
+// document winning, and the old documents are deleted in the same batch as the merged one is written.
+func migrateUsers() error {
+	store, ok := userStore.(firestoreUserStore)
+	if !ok {
+		return errors.New("only the firestore user store needs migrating")
+	}
+	ctx := context.Background()
+
+	type legacyDoc struct {
+		id        string
+		user      User
+		updatedAt time.Time
+	}
+	byUid := map[string][]legacyDoc{}
+	iter := store.users().Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		record, err := recordFromDoc(doc)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("Document", doc.Ref.ID).
+				Msg("Skipping unreadable user document")
+			continue
+		}
+		user, err := record.open()
+		if err != nil {
+			return err
+		}
+		byUid[record.Uid] = append(byUid[record.Uid], legacyDoc{id: doc.Ref.ID, user: user, updatedAt: doc.UpdateTime})
+	}
+
+	rewritten, merged, skipped := 0, 0, 0
+	for uid, docs := range byUid {
+		if len(docs) == 1 && docs[0].id == uid {
+			skipped++
+			continue
+		}
+		// oldest first, so the newest value of every field wins
+		sort.Slice(docs, func(i, j int) bool {
+			return docs[i].updatedAt.Before(docs[j].updatedAt)
+		})
+		user := docs[0].user
+		for _, doc := range docs[1:] {
+			user = mergeUsers(user, doc.user)
+		}
+		record, err := sealUser(user)
+		if err != nil {
+			return err
+		}
+
+		batch := store.client.Batch()
+		batch.Set(store.users().Doc(uid), record)
+		for _, doc := range docs {
+			if doc.id != uid {
+				batch.Delete(store.users().Doc(doc.id))
+			}
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			log.Error().
+				Err(err).
+				Str("User", uid).
+				Msg("Unable to migrate user")
+			return err
+		}
+		if len(docs) > 1 {
+			merged++
+		}
+		rewritten++
+	}
+	log.Info().
+		Int("Rewritten", rewritten).
+		Int("Merged", merged).
+		Int("Skipped", skipped).
+		Msg("Finished migrating users")
+	return nil
+}
+
+// errUsersNotMigrated is returned by the operations that only see users/{uid}, with legacy documents left they would
+// overwrite newer settings with stale ones or leave plaintext keys behind
+var errUsersNotMigrated = errors.New(`there are user documents with random ids left, run "opennote user migrate" first`)
+
+// checkUsersMigrated returns errUsersNotMigrated if the firestore store still has legacy documents with random ids, of
+// the user with the uid or of any user if uid is empty. The other stores never had them.
+func checkUsersMigrated(ctx context.Context, uid string) error {
+	store, ok := userStore.(firestoreUserStore)
+	if !ok {
+		return nil
+	}
+	query := store.users().Query
+	if uid != "" {
+		query = query.Where("Uid", "==", uid)
+	}
+	iter := query.Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// documents without a uid can't be migrated either, migrateUsers skips them too
+		docUid, err := doc.DataAt("Uid")
+		if err != nil {
+			continue
+		}
+		if docUid != doc.Ref.ID {
+			return errUsersNotMigrated
+		}
+	}
+}
+
+// mergeUsers returns older with every field that is set in newer replaced
+func mergeUsers(older User, newer User) User {
+	if newer.OpenAIApiKey != "" {
+		older.OpenAIApiKey = newer.OpenAIApiKey
+	}
+	if newer.PineconeApiKey != "" {
+		older.PineconeApiKey = newer.PineconeApiKey
+	}
+	if newer.PineconeIndex != "" {
+		older.PineconeIndex = newer.PineconeIndex
+	}
+	if newer.PineconeEnvironment != "" {
+		older.PineconeEnvironment = newer.PineconeEnvironment
+	}
+	if newer.PineconeProjectName != "" {
+		older.PineconeProjectName = newer.PineconeProjectName
+	}
+	if newer.TopK != 0 {
+		older.TopK = newer.TopK
+	}
+	return older
+}
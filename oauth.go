@@ -0,0 +1,582 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// oauthAccessTokenPrefix and oauthRefreshTokenPrefix mark tokens issued through the OAuth flow so the auth
+	// middleware can tell them apart from personal access tokens and firebase ID tokens
+	oauthAccessTokenPrefix  = "ona_"
+	oauthRefreshTokenPrefix = "onr_"
+	oauthClientSecretPrefix = "ons_"
+	oauthCodePrefix         = "onc_"
+
+	oauthCodeLifetime         = 10 * time.Minute
+	oauthAccessTokenLifetime  = time.Hour
+	oauthRefreshTokenLifetime = 30 * 24 * time.Hour
+	// oauthCleanupBatch is how many expired codes and tokens are deleted each time tokens are issued
+	oauthCleanupBatch = 100
+
+	oauthAuthorizePage = "resources/oauth/authorize.html"
+)
+
+var errOAuthTokenExpired = errors.New("oauth token expired")
+
+var authorizePageTemplate *template.Template
+
+// firebaseWeb is the web config of the firebase sign in on the authorize page
+var firebaseWeb config.FirebaseWeb
+
+// oauthClientRecord is a registered third party assistant, stored at oauthClients/{client id}
+type oauthClientRecord struct {
+	Name         string
+	OwnerUid     string
+	SecretHash   string
+	RedirectUris []string
+	CreatedAt    time.Time
+}
+
+func (r oauthClientRecord) allowsRedirect(redirectUri string) bool {
+	for _, uri := range r.RedirectUris {
+		if uri == redirectUri {
+			return true
+		}
+	}
+	return false
+}
+
+// oauthCodeRecord is an authorization code waiting to be exchanged, stored at oauthCodes/{sha256 of the code}
+type oauthCodeRecord struct {
+	Uid                 string
+	ClientId            string
+	RedirectUri         string
+	Scopes              []string
+	CodeChallenge       string
+	CodeChallengeMethod string
+	ExpiresAt           time.Time
+}
+
+// oauthTokenRecord is an issued access or refresh token, stored at oauthTokens/{sha256 of the token}
+type oauthTokenRecord struct {
+	Uid       string
+	ClientId  string
+	Scopes    []string
+	Refresh   bool
+	ExpiresAt time.Time
+}
+
+func (r oauthTokenRecord) hasScope(scope string) bool {
+	for _, s := range r.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeOAuthGrants deletes the oauth tokens and pending codes issued to apps for the user, and the apps the user
+// registered
+func revokeOAuthGrants(ctx context.Context, uid string) error {
+	if err := deleteWhere(ctx, "oauthTokens", "Uid", uid); err != nil {
+		return err
+	}
+	if err := deleteWhere(ctx, "oauthCodes", "Uid", uid); err != nil {
+		return err
+	}
+	return deleteWhere(ctx, "oauthClients", "OwnerUid", uid)
+}
+
+// newSecret returns a random token with the prefix, tokens and codes all share the format of personal access tokens
+func newSecret(prefix string) (string, error) {
+	token, err := newAccessToken()
+	if err != nil {
+		return "", err
+	}
+	return prefix + strings.TrimPrefix(token, accessTokenPrefix), nil
+}
+
+// oauthSetup parses the authorize page
+func oauthSetup(web config.FirebaseWeb) {
+	firebaseWeb = web
+	var err error
+	authorizePageTemplate, err = template.ParseFiles(oauthAuthorizePage)
+	if err != nil {
+		panic("Unable to parse the oauth authorize page: " + err.Error())
+	}
+}
+
+// lookupOAuthAccessToken finds the record of an access token issued by the token endpoint
+func lookupOAuthAccessToken(ctx context.Context, token string) (oauthTokenRecord, error) {
+	if firestoreClient == nil {
+		return oauthTokenRecord{}, errFirestoreDisabled
+	}
+	doc, err := firestoreClient.Collection("oauthTokens").Doc(hashAccessToken(token)).Get(ctx)
+	if err != nil {
+		return oauthTokenRecord{}, err
+	}
+	var record oauthTokenRecord
+	if err := doc.DataTo(&record); err != nil {
+		return oauthTokenRecord{}, err
+	}
+	if record.Refresh || time.Now().After(record.ExpiresAt) {
+		return oauthTokenRecord{}, errOAuthTokenExpired
+	}
+	return record, nil
+}
+
+// RegisterClientRequest is the request sent to /oauth/register to register a third party assistant.
+type RegisterClientRequest struct {
+	Name         string   `json:"client_name"`
+	RedirectUris []string `json:"redirect_uris"`
+}
+
+// RegisterClientResponse is the response of /oauth/register, the secret is only ever shown here.
+type RegisterClientResponse struct {
+	ClientId     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Name         string   `json:"client_name"`
+	RedirectUris []string `json:"redirect_uris"`
+}
+
+// registerClientEndpoint is the endpoint at /oauth/register, it registers a client owned by the signed in user
+func registerClientEndpoint(c *gin.Context) {
+	var request RegisterClientRequest
+	if err := c.BindJSON(&request); err != nil || request.Name == "" || len(request.RedirectUris) == 0 {
+		oauthError(c, http.StatusBadRequest, "invalid_client_metadata", "client_name and redirect_uris are required")
+		return
+	}
+	for _, uri := range request.RedirectUris {
+		parsed, err := url.Parse(uri)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" || parsed.Fragment != "" {
+			oauthError(c, http.StatusBadRequest, "invalid_redirect_uri", "redirect uris must be absolute https urls")
+			return
+		}
+	}
+
+	clientId, err := newSecret("")
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to generate client id")
+		return
+	}
+	secret, err := newSecret(oauthClientSecretPrefix)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to generate client secret")
+		return
+	}
+	record := oauthClientRecord{
+		Name:         request.Name,
+		OwnerUid:     authenticatedUid(c),
+		SecretHash:   hashAccessToken(secret),
+		RedirectUris: request.RedirectUris,
+		CreatedAt:    time.Now(),
+	}
+	if _, err = firestoreClient.Collection("oauthClients").Doc(clientId).Create(c.Request.Context(), record); err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", record.OwnerUid).
+			Msg("Unable to store oauth client")
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to store client")
+		return
+	}
+	c.JSON(http.StatusCreated, RegisterClientResponse{
+		ClientId:     clientId,
+		ClientSecret: secret,
+		Name:         record.Name,
+		RedirectUris: record.RedirectUris,
+	})
+}
+
+// AuthorizeRequest are the parameters of the authorization request, sent as query parameters to GET /oauth/authorize
+// and echoed back with the users ID token by the authorize page to POST /oauth/authorize.
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientId            string `form:"client_id" json:"client_id"`
+	RedirectUri         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	IdToken             string `form:"-" json:"id_token"`
+}
+
+// oauthScopes are the scopes third party clients can be granted, they can search notes but never read the settings or
+// chat on the users OpenAI key
+var oauthScopes = []string{ScopeQuery}
+
+func oauthScope(scope string) bool {
+	for _, s := range oauthScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// validate checks the request against the registered client and returns the requested scopes. Errors before the
+// redirect uri is known to be valid must never redirect, otherwise the endpoint becomes an open redirect.
+func (r AuthorizeRequest) validate(ctx context.Context) (oauthClientRecord, []string, error) {
+	if r.ResponseType != "code" {
+		return oauthClientRecord{}, nil, errors.New("response_type must be code")
+	}
+	if r.ClientId == "" {
+		return oauthClientRecord{}, nil, errors.New("missing client_id")
+	}
+	doc, err := firestoreClient.Collection("oauthClients").Doc(r.ClientId).Get(ctx)
+	if err != nil {
+		return oauthClientRecord{}, nil, errors.New("unknown client")
+	}
+	var client oauthClientRecord
+	if err := doc.DataTo(&client); err != nil {
+		return oauthClientRecord{}, nil, errors.New("unknown client")
+	}
+	if !client.allowsRedirect(r.RedirectUri) {
+		return oauthClientRecord{}, nil, errors.New("redirect_uri is not registered for this client")
+	}
+	if r.CodeChallenge != "" && r.CodeChallengeMethod != "S256" {
+		return oauthClientRecord{}, nil, errors.New("only the S256 code_challenge_method is supported")
+	}
+
+	scopes := strings.Fields(r.Scope)
+	if len(scopes) == 0 {
+		scopes = []string{ScopeQuery}
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return oauthClientRecord{}, nil, errors.New("unknown scope " + scope)
+		}
+		if !oauthScope(scope) {
+			return oauthClientRecord{}, nil, errors.New("scope " + scope + " can't be granted to third party clients")
+		}
+	}
+	return client, scopes, nil
+}
+
+// authorizePageData is what the authorize page is templated with
+type authorizePageData struct {
+	Request        AuthorizeRequest
+	ClientName     string
+	Scopes         []string
+	FirebaseConfig config.FirebaseWeb
+	// LocalAuth shows a username and password form instead of the firebase sign in
+	LocalAuth bool
+}
+
+// authorizePageEndpoint is the endpoint at GET /oauth/authorize, it shows the sign in page that asks the user to let
+// the client search their notes
+func authorizePageEndpoint(c *gin.Context) {
+	// the page asks the user to approve the client, it mustn't be framed by a site that could click through it
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	var request AuthorizeRequest
+	if err := c.ShouldBindQuery(&request); err != nil {
+		c.String(http.StatusBadRequest, "Invalid authorization request")
+		return
+	}
+	client, scopes, err := request.validate(c.Request.Context())
+	if err != nil {
+		c.String(http.StatusBadRequest, "Invalid authorization request: "+err.Error())
+		return
+	}
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	err = authorizePageTemplate.Execute(c.Writer, authorizePageData{
+		Request:        request,
+		ClientName:     client.Name,
+		Scopes:         scopes,
+		FirebaseConfig: firebaseWeb,
+		LocalAuth:      localAuth() != nil,
+	})
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Msg("Unable to render the oauth authorize page")
+	}
+}
+
+// AuthorizeResponse is the response of POST /oauth/authorize, the page navigates to RedirectUri.
+type AuthorizeResponse struct {
+	RedirectUri string `json:"redirect_uri"`
+}
+
+// authorizeEndpoint is the endpoint at POST /oauth/authorize, the authorize page sends the session token of the auth
+// provider (a firebase ID token or a local session) once they signed in and approved the client, and gets back where to redirect with the authorization code.
+func authorizeEndpoint(c *gin.Context) {
+	var request AuthorizeRequest
+	if err := c.BindJSON(&request); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "content doesn't match expected structure")
+		return
+	}
+	_, scopes, err := request.validate(c.Request.Context())
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	uid, err := authProvider.VerifyToken(c.Request.Context(), request.IdToken)
+	if err != nil {
+		oauthError(c, http.StatusUnauthorized, "access_denied", "invalid ID token")
+		return
+	}
+
+	code, err := newSecret(oauthCodePrefix)
+	if err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to generate code")
+		return
+	}
+	record := oauthCodeRecord{
+		Uid:                 uid,
+		ClientId:            request.ClientId,
+		RedirectUri:         request.RedirectUri,
+		Scopes:              scopes,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		ExpiresAt:           time.Now().Add(oauthCodeLifetime),
+	}
+	if _, err = firestoreClient.Collection("oauthCodes").Doc(hashAccessToken(code)).Create(c.Request.Context(), record); err != nil {
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to store code")
+		return
+	}
+
+	redirect, _ := url.Parse(request.RedirectUri)
+	query := redirect.Query()
+	query.Set("code", code)
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+	redirect.RawQuery = query.Encode()
+	c.JSON(http.StatusOK, AuthorizeResponse{RedirectUri: redirect.String()})
+}
+
+// TokenRequest is the request sent to /oauth/token, either form encoded or as json.
+type TokenRequest struct {
+	GrantType    string `form:"grant_type" json:"grant_type"`
+	Code         string `form:"code" json:"code"`
+	RedirectUri  string `form:"redirect_uri" json:"redirect_uri"`
+	ClientId     string `form:"client_id" json:"client_id"`
+	ClientSecret string `form:"client_secret" json:"client_secret"`
+	CodeVerifier string `form:"code_verifier" json:"code_verifier"`
+	RefreshToken string `form:"refresh_token" json:"refresh_token"`
+}
+
+// TokenResponse is the response of /oauth/token.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// tokenEndpoint is the endpoint at /oauth/token, it exchanges authorization codes and refresh tokens for tokens.
+// Refresh tokens are rotated, every refresh returns a new one and revokes the old one.
+func tokenEndpoint(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	var request TokenRequest
+	if err := c.ShouldBind(&request); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_request", "content doesn't match expected structure")
+		return
+	}
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		request.ClientId, request.ClientSecret = id, secret
+	}
+	if !authenticateClient(c.Request.Context(), request.ClientId, request.ClientSecret) {
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return
+	}
+
+	var uid string
+	var scopes []string
+	var err error
+	switch request.GrantType {
+	case "authorization_code":
+		uid, scopes, err = redeemCode(c.Request.Context(), request)
+	case "refresh_token":
+		uid, scopes, err = redeemRefreshToken(c.Request.Context(), request)
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", "grant_type must be authorization_code or refresh_token")
+		return
+	}
+	if err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", err.Error())
+		return
+	}
+
+	resp, err := issueOAuthTokens(c.Request.Context(), uid, request.ClientId, scopes)
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", uid).
+			Msg("Unable to issue oauth tokens")
+		oauthError(c, http.StatusInternalServerError, "server_error", "unable to issue tokens")
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// authenticateClient checks the client secret against the registered client
+func authenticateClient(ctx context.Context, clientId string, secret string) bool {
+	if clientId == "" || secret == "" {
+		return false
+	}
+	doc, err := firestoreClient.Collection("oauthClients").Doc(clientId).Get(ctx)
+	if err != nil {
+		return false
+	}
+	var client oauthClientRecord
+	if err := doc.DataTo(&client); err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashAccessToken(secret))) == 1
+}
+
+// redeemCode exchanges an authorization code, codes can only be used once
+func redeemCode(ctx context.Context, request TokenRequest) (string, []string, error) {
+	ref := firestoreClient.Collection("oauthCodes").Doc(hashAccessToken(request.Code))
+	var record oauthCodeRecord
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return errors.New("unknown authorization code")
+		}
+		if err := doc.DataTo(&record); err != nil {
+			return err
+		}
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+
+	if time.Now().After(record.ExpiresAt) {
+		return "", nil, errors.New("authorization code expired")
+	}
+	if record.ClientId != request.ClientId || record.RedirectUri != request.RedirectUri {
+		return "", nil, errors.New("authorization code was issued to another client")
+	}
+	if record.CodeChallenge != "" && !verifyCodeChallenge(record.CodeChallenge, request.CodeVerifier) {
+		return "", nil, errors.New("invalid code_verifier")
+	}
+	return record.Uid, record.Scopes, nil
+}
+
+// verifyCodeChallenge checks the code_verifier against the S256 code_challenge of RFC 7636
+func verifyCodeChallenge(challenge string, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// redeemRefreshToken exchanges a refresh token and revokes it
+func redeemRefreshToken(ctx context.Context, request TokenRequest) (string, []string, error) {
+	ref := firestoreClient.Collection("oauthTokens").Doc(hashAccessToken(request.RefreshToken))
+	var record oauthTokenRecord
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return errors.New("unknown refresh token")
+		}
+		if err := doc.DataTo(&record); err != nil {
+			return err
+		}
+		return tx.Delete(ref)
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if !record.Refresh || record.ClientId != request.ClientId {
+		return "", nil, errors.New("unknown refresh token")
+	}
+	if time.Now().After(record.ExpiresAt) {
+		return "", nil, errors.New("refresh token expired")
+	}
+	return record.Uid, record.Scopes, nil
+}
+
+// issueOAuthTokens creates a new access and refresh token pair
+func issueOAuthTokens(ctx context.Context, uid string, clientId string, scopes []string) (TokenResponse, error) {
+	access, err := newSecret(oauthAccessTokenPrefix)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	refresh, err := newSecret(oauthRefreshTokenPrefix)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	now := time.Now()
+	tokens := firestoreClient.Collection("oauthTokens")
+	batch := firestoreClient.Batch()
+	batch.Create(tokens.Doc(hashAccessToken(access)), oauthTokenRecord{
+		Uid:       uid,
+		ClientId:  clientId,
+		Scopes:    scopes,
+		ExpiresAt: now.Add(oauthAccessTokenLifetime),
+	})
+	batch.Create(tokens.Doc(hashAccessToken(refresh)), oauthTokenRecord{
+		Uid:       uid,
+		ClientId:  clientId,
+		Scopes:    scopes,
+		Refresh:   true,
+		ExpiresAt: now.Add(oauthRefreshTokenLifetime),
+	})
+	if _, err := batch.Commit(ctx); err != nil {
+		return TokenResponse{}, err
+	}
+	for _, collection := range []string{"oauthCodes", "oauthTokens"} {
+		if err := deleteExpired(ctx, collection, now); err != nil {
+			log.Ctx(ctx).Warn().
+				Err(err).
+				Str("Collection", collection).
+				Msg("Unable to delete expired oauth records")
+		}
+	}
+	return TokenResponse{
+		AccessToken:  access,
+		TokenType:    "bearer",
+		ExpiresIn:    int(oauthAccessTokenLifetime.Seconds()),
+		RefreshToken: refresh,
+		Scope:        strings.Join(scopes, " "),
+	}, nil
+}
+
+// deleteExpired deletes up to oauthCleanupBatch documents of the collection that expired before now, codes that were
+// never exchanged and tokens that were never refreshed would otherwise stay forever
+func deleteExpired(ctx context.Context, collection string, now time.Time) error {
+	docs, err := firestoreClient.Collection(collection).
+		Where("ExpiresAt", "<", now).
+		Limit(oauthCleanupBatch).
+		Documents(ctx).
+		GetAll()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return nil
+	}
+	batch := firestoreClient.Batch()
+	for _, doc := range docs {
+		batch.Delete(doc.Ref)
+	}
+	_, err = batch.Commit(ctx)
+	return err
+}
+
+// oauthError writes an error in the format of RFC 6749 section 5.2
+func oauthError(c *gin.Context, status int, code string, description string) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"error":             code,
+		"error_description": description,
+	})
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	const (
+		verifier  = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+		challenge = "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	)
+	tests := []struct {
+		name      string
+		challenge string
+		verifier  string
+		valid     bool
+	}{
+		{name: "rfc example", challenge: challenge, verifier: verifier, valid: true},
+		{name: "other verifier", challenge: challenge, verifier: verifier + "x", valid: false},
+		{name: "empty verifier", challenge: challenge, verifier: "", valid: false},
+		{name: "plain challenge", challenge: verifier, verifier: verifier, valid: false},
+		{name: "padded challenge", challenge: challenge + "=", verifier: verifier, valid: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyCodeChallenge(tt.challenge, tt.verifier); got != tt.valid {
+				t.Fatalf("got %v, want %v", got, tt.valid)
+			}
+		})
+	}
+}
@@ -2,20 +2,78 @@ package main
 
 import (
 	"context"
+	"github.com/abimek/opennote/resilience"
+	"github.com/abimek/opennote/routing"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"strconv"
+	"time"
 )
 
+// openaiRequestIDHeader is the header OpenAI keeps with a request in its own logs, it gets the id of the request the
+// call is made for so a failed call can be matched on both sides.
+const openaiRequestIDHeader = "X-Client-Request-Id"
+
+// newOpenAIClient returns a client for the api key whose calls carry the request id of their context and are measured.
+// Failed calls are retried and stopped while the OpenAI circuit breaker is open, every attempt is measured on its own.
+func newOpenAIClient(apiKey string) *openai.Client {
+	conf := openai.DefaultConfig(apiKey)
+	conf.HTTPClient = &http.Client{Transport: resilience.Transport{
+		Next:    openaiTransport{next: http.DefaultTransport},
+		Policy:  openaiPolicy,
+		Breaker: openaiBreaker,
+	}}
+	return openai.NewClientWithConfig(conf)
+}
+
+// openaiTransport adds the request id of every call to its headers and records how long OpenAI took
+// to answer and with which status
+type openaiTransport struct {
+	next http.RoundTripper
+}
+
+func (t openaiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if id := routing.RequestIDFrom(req.Context()); id != "" {
+		req.Header.Set(openaiRequestIDHeader, id)
+	}
+	operation := openaiOperation(req.URL.Path)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	openaiDuration.Observe(time.Since(start).Seconds(), operation)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+		trace.SpanFromContext(req.Context()).SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+	}
+	openaiRequests.Inc(operation, status)
+	return resp, err
+}
+
 // method that returns a list of embedding information in the right order that we sent, the Embedding field of each of these is the vector represneation
-func openaiEmbedding(client *openai.Client, model openai.EmbeddingModel, user string, texts []string) ([][]float32, error) {
+// along with the tokens used
+func openaiEmbedding(ctx context.Context, client *openai.Client, model openai.EmbeddingModel, user string, texts []string) ([][]float32, tokenUsage, error) {
 	request := openai.EmbeddingRequest{
 		Input: texts,
 		Model: model,
 		User:  user,
 	}
 
-	resp, err := client.CreateEmbeddings(context.Background(), request)
+	ctx, span := tracer.Start(ctx, "openai.embedding",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("llm.model", model.String()),
+			attribute.Int("llm.inputs", len(texts)),
+		),
+	)
+	resp, err := client.CreateEmbeddings(ctx, request)
+	span.SetAttributes(attribute.Int("llm.usage.total_tokens", resp.Usage.TotalTokens))
+	endSpan(span, err)
 	if err != nil {
-		return nil, err
+		return nil, tokenUsage{}, err
 	}
 
 	embeddingObjects := resp.Data
@@ -24,9 +82,5 @@ func openaiEmbedding(client *openai.Client, model openai.EmbeddingModel, user st
 	for i, embedding := range embeddingObjects {
 		embeddingVectors[i] = embedding.Embedding
 	}
-	return embeddingVectors, nil
-}
-
-func ada002Embeddings(client *openai.Client, user string, texts []string) ([][]float32, error) {
-	return openaiEmbedding(client, openai.AdaEmbeddingV2, user, texts)
+	return embeddingVectors, tokenUsage{EmbeddingTokens: int64(resp.Usage.TotalTokens)}, nil
 }
@@ -0,0 +1,231 @@
+package openapi
+
+import (
+	"bytes"
+	"github.com/abimek/opennote/routing"
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Document is an OpenAPI 3 document, only the parts opennote uses are modeled.
+type Document struct {
+	OpenAPI    string               `yaml:"openapi"`
+	Info       Info                 `yaml:"info"`
+	Servers    []Server             `yaml:"servers,omitempty"`
+	Paths      map[string]*PathItem `yaml:"paths"`
+	Components Components           `yaml:"components,omitempty"`
+}
+
+type Info struct {
+	Title       string `yaml:"title"`
+	Description string `yaml:"description,omitempty"`
+	Version     string `yaml:"version"`
+}
+
+type Server struct {
+	URL string `yaml:"url"`
+}
+
+type PathItem struct {
+	Get    *Operation `yaml:"get,omitempty"`
+	Post   *Operation `yaml:"post,omitempty"`
+	Patch  *Operation `yaml:"patch,omitempty"`
+	Delete *Operation `yaml:"delete,omitempty"`
+}
+
+type Operation struct {
+	OperationId string               `yaml:"operationId,omitempty"`
+	Summary     string               `yaml:"summary,omitempty"`
+	RequestBody *RequestBody         `yaml:"requestBody,omitempty"`
+	Responses   map[string]*Response `yaml:"responses"`
+}
+
+type RequestBody struct {
+	Required bool                  `yaml:"required,omitempty"`
+	Content  map[string]*MediaType `yaml:"content"`
+}
+
+type Response struct {
+	Description string                `yaml:"description"`
+	Content     map[string]*MediaType `yaml:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `yaml:"schema"`
+}
+
+type Components struct {
+	Schemas map[string]*Schema `yaml:"schemas,omitempty"`
+}
+
+// Schema is a JSON schema, Ref is set instead of everything else when it points at a component.
+type Schema struct {
+	Ref                  string             `yaml:"$ref,omitempty"`
+	Title                string             `yaml:"title,omitempty"`
+	Description          string             `yaml:"description,omitempty"`
+	Required             []string           `yaml:"required,omitempty"`
+	Type                 string             `yaml:"type,omitempty"`
+	Format               string             `yaml:"format,omitempty"`
+	Nullable             bool               `yaml:"nullable,omitempty"`
+	Items                *Schema            `yaml:"items,omitempty"`
+	Properties           map[string]*Schema `yaml:"properties,omitempty"`
+	AdditionalProperties *Schema            `yaml:"additionalProperties,omitempty"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// Generate builds the document out of the routes that were described with routing.Describe, routes without a
+// description aren't part of the public api and are left out.
+func Generate(info Info, serverURL string) *Document {
+	doc := &Document{
+		OpenAPI: "3.0.2",
+		Info:    info,
+		Servers: []Server{{URL: serverURL}},
+		Paths:   map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{},
+		},
+	}
+	for _, route := range routing.Routes() {
+		if route.Spec == nil {
+			continue
+		}
+		item, ok := doc.Paths[route.Path]
+		if !ok {
+			item = &PathItem{}
+			doc.Paths[route.Path] = item
+		}
+		op := doc.operation(route)
+		switch route.Method {
+		case http.MethodGet:
+			item.Get = op
+		case http.MethodPost:
+			item.Post = op
+		case http.MethodPatch:
+			item.Patch = op
+		case http.MethodDelete:
+			item.Delete = op
+		}
+	}
+	return doc
+}
+
+func (d *Document) operation(route routing.RegisteredRoute) *Operation {
+	spec := route.Spec
+	op := &Operation{
+		OperationId: spec.OperationId,
+		Summary:     spec.Summary,
+		Responses:   map[string]*Response{},
+	}
+	if spec.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content: map[string]*MediaType{
+				"application/json": {Schema: d.schema(reflect.TypeOf(spec.Request))},
+			},
+		}
+	}
+	response := &Response{Description: spec.ResponseDescription}
+	if response.Description == "" {
+		response.Description = "Successful response"
+	}
+	if spec.Response != nil {
+		response.Content = map[string]*MediaType{
+			"application/json": {Schema: d.schema(reflect.TypeOf(spec.Response))},
+		}
+	}
+	op.Responses["200"] = response
+	return op
+}
+
+// schema returns the schema of t, named structs are added to the components and referenced.
+func (d *Document) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Kind() == reflect.Struct:
+		name := t.Name()
+		if _, ok := d.Components.Schemas[name]; !ok {
+			// reserve the name first so recursive types terminate
+			d.Components.Schemas[name] = &Schema{}
+			d.Components.Schemas[name] = d.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: d.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schema(t.Elem())}
+	}
+	return &Schema{}
+}
+
+// structSchema builds the schema of a struct from its json tags, fields without omitempty are required. A description
+// tag on the field becomes the description of the property.
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	s := &Schema{
+		Title:      t.Name(),
+		Type:       "object",
+		Properties: map[string]*Schema{},
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, opts, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		prop := d.schema(field.Type)
+		if prop.Ref == "" {
+			prop.Title = field.Name
+			prop.Description = field.Tag.Get("description")
+			prop.Nullable = field.Type.Kind() == reflect.Pointer
+		}
+		s.Properties[name] = prop
+		if !strings.Contains(opts, "omitempty") {
+			s.Required = append(s.Required, name)
+		}
+	}
+	sort.Strings(s.Required)
+	return s
+}
+
+// Marshal encodes the document as yaml
+func (d *Document) Marshal() ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(d); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -2,12 +2,49 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"github.com/nekomeowww/go-pinecone"
 	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"time"
 )
 
-// Querys pinecone and returns the content
-func queryPinecone(indexClient *pinecone.IndexClient, topK int64, embedding []float32) []string {
+// pineconeIndex is the client of a pinecone index along with the host it calls, calls to it go through the circuit
+// breaker of that host so one broken index doesn't stop the calls to every other one
+type pineconeIndex struct {
+	*pinecone.IndexClient
+	host string
+}
+
+// newPineconeIndex builds the client of an index, the host is the one the pinecone client builds its urls with
+func newPineconeIndex(apiKey string, index string, project string, environment string) *pineconeIndex {
+	client, _ := pinecone.NewIndexClient(
+		pinecone.WithIndexName(index),
+		pinecone.WithAPIKey(apiKey),
+		pinecone.WithEnvironment(environment),
+		pinecone.WithProjectName(project),
+	)
+	return &pineconeIndex{
+		IndexClient: client,
+		host:        fmt.Sprintf("%s-%s.svc.%s.pinecone.io", index, project, environment),
+	}
+}
+
+// noteMatch is a note returned by a pinecone query, Title is only set if the note was indexed with one. Workspace is the
+// id of the workspace the note is from, it's empty for notes of the users personal index.
+type noteMatch struct {
+	Id        string
+	Title     string
+	Content   string
+	Score     float32
+	Workspace string
+}
+
+// queryPineconeMatches queries pinecone and returns the matching notes along with their ids. Failed queries are retried,
+// an error means the notes couldn't be searched, not that there are no matches.
+func queryPineconeMatches(ctx context.Context, indexClient *pineconeIndex, topK int64, embedding []float32) ([]noteMatch, error) {
 	params := pinecone.QueryParams{
 		IncludeMetadata: true,
 		Vector:          embedding,
@@ -15,22 +52,187 @@ func queryPinecone(indexClient *pinecone.IndexClient, topK int64, embedding []fl
 		Namespace:       "",
 	}
 
-	resp, err := indexClient.Query(context.Background(), params)
+	ctx, span := tracer.Start(ctx, "pinecone.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int64("pinecone.top_k", topK)),
+	)
+	var resp *pinecone.QueryResponse
+	err := callPinecone(ctx, indexClient, func(ctx context.Context) (err error) {
+		start := time.Now()
+		resp, err = indexClient.Query(ctx, params)
+		observePinecone(start, err)
+		return err
+	})
+	if err == nil {
+		span.SetAttributes(attribute.Int("pinecone.matches", len(resp.Matches)))
+	}
+	endSpan(span, err)
 	if err != nil {
-		log.Error().
-			Err(err).
-			Msg("Invalid Pinecone Index On Request")
-		return []string{}
+		return nil, err
 	}
 
-	var results []string
-
+	var results []noteMatch
 	for _, match := range resp.Matches {
-		content, ok := match.Vector.Metadata["content"].(string)
+		note, ok := noteFromVector(match.Vector)
 		if !ok {
 			continue
 		}
-		results = append(results, content)
+		note.Score = match.Score
+		results = append(results, note)
+	}
+	return results, nil
+}
+
+// fetchNote fetches a single note by its vector id, it returns false if there is no such note
+func fetchNote(ctx context.Context, indexClient *pineconeIndex, id string) (noteMatch, bool, error) {
+	ctx, span := tracer.Start(ctx, "pinecone.fetch", trace.WithSpanKind(trace.SpanKindClient))
+	var resp *pinecone.FetchVectorsResponse
+	err := callPinecone(ctx, indexClient, func(ctx context.Context) (err error) {
+		resp, err = indexClient.FetchVectors(ctx, pinecone.FetchVectorsParams{
+			IDs: []string{id},
+		})
+		return err
+	})
+	endSpan(span, err)
+	if err != nil {
+		return noteMatch{}, false, err
+	}
+	vector, ok := resp.Vectors[id]
+	if !ok || vector == nil {
+		return noteMatch{}, false, nil
+	}
+	note, ok := noteFromVector(*vector)
+	return note, ok, nil
+}
+
+func noteFromVector(vector pinecone.Vector) (noteMatch, bool) {
+	content, ok := vector.Metadata["content"].(string)
+	if !ok {
+		return noteMatch{}, false
+	}
+	note := noteMatch{Id: vector.ID, Content: content}
+	for _, key := range []string{"title", "path", "file"} {
+		if title, ok := vector.Metadata[key].(string); ok && title != "" {
+			note.Title = title
+			break
+		}
+	}
+	return note, true
+}
+
+// maxListedNotes is the largest topK pinecone allows for a query
+const maxListedNotes = 10000
+
+// listNoteIds returns the ids of the notes in the index. Pinecone has no way to list an index, so it queries with an
+// arbitrary vector for as many matches as it allows, the returned bool is true if the index has more notes than that.
+func listNoteIds(ctx context.Context, indexClient *pineconeIndex) ([]string, bool, error) {
+	var stats *pinecone.DescribeIndexStatsResponse
+	err := callPinecone(ctx, indexClient, func(ctx context.Context) (err error) {
+		stats, err = indexClient.DescribeIndexStats(ctx, pinecone.DescribeIndexStatsParams{})
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if stats.TotalVectorCount == 0 || stats.Dimensions == 0 {
+		return []string{}, false, nil
+	}
+	vector := make([]float32, stats.Dimensions)
+	vector[0] = 1
+	var resp *pinecone.QueryResponse
+	err = callPinecone(ctx, indexClient, func(ctx context.Context) (err error) {
+		resp, err = indexClient.Query(ctx, pinecone.QueryParams{
+			Vector: vector,
+			TopK:   maxListedNotes,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	ids := make([]string, 0, len(resp.Matches))
+	for _, match := range resp.Matches {
+		ids = append(ids, match.ID)
+	}
+	return ids, stats.TotalVectorCount > int64(len(ids)), nil
+}
+
+// deleteAllNotes deletes every vector in the default namespace of the index
+func deleteAllNotes(ctx context.Context, indexClient *pineconeIndex) error {
+	return callPinecone(ctx, indexClient, func(ctx context.Context) error {
+		return indexClient.DeleteVectors(ctx, pinecone.DeleteVectorsParams{
+			DeleteAll: true,
+		})
+	})
+}
+
+// reindexBatch is how many notes are fetched, embedded and written back at once
+const reindexBatch = 100
+
+// reindexNotes embeds the content of every note in the index again with model and overwrites the vectors, the ids and
+// metadata are kept. It's how notes move to a new embedding model, the index needs the dimension of that model. Notes
+// without content are skipped, it returns how many notes were reindexed and the tokens the embeddings used.
+func reindexNotes(ctx context.Context, client *openai.Client, index *pineconeIndex, model openai.EmbeddingModel, uid string) (int, tokenUsage, error) {
+	var usage tokenUsage
+	ids, truncated, err := listNoteIds(ctx, index)
+	if err != nil {
+		return 0, usage, err
+	}
+	if truncated {
+		log.Ctx(ctx).Warn().
+			Str("User", uid).
+			Int("Listed", len(ids)).
+			Msg("Index has more notes than can be listed, only the listed ones are reindexed")
+	}
+
+	reindexed := 0
+	for start := 0; start < len(ids); start += reindexBatch {
+		end := start + reindexBatch
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var fetched *pinecone.FetchVectorsResponse
+		err := callPinecone(ctx, index, func(ctx context.Context) (err error) {
+			fetched, err = index.FetchVectors(ctx, pinecone.FetchVectorsParams{IDs: ids[start:end]})
+			return err
+		})
+		if err != nil {
+			return reindexed, usage, err
+		}
+		var vectors []*pinecone.Vector
+		var texts []string
+		for _, id := range ids[start:end] {
+			vector, ok := fetched.Vectors[id]
+			if !ok {
+				continue
+			}
+			content, ok := vector.Metadata["content"].(string)
+			if !ok || content == "" {
+				continue
+			}
+			vectors = append(vectors, vector)
+			texts = append(texts, content)
+		}
+		if len(vectors) == 0 {
+			continue
+		}
+
+		embeddings, used, err := openaiEmbedding(ctx, client, model, uid, texts)
+		usage.EmbeddingTokens += used.EmbeddingTokens
+		if err != nil {
+			return reindexed, usage, err
+		}
+		for i, vector := range vectors {
+			vector.Values = embeddings[i]
+		}
+		err = callPinecone(ctx, index, func(ctx context.Context) error {
+			_, err := index.UpsertVectors(ctx, pinecone.UpsertVectorsParams{Vectors: vectors})
+			return err
+		})
+		if err != nil {
+			return reindexed, usage, err
+		}
+		reindexed += len(vectors)
 	}
-	return results
+	return reindexed, usage, nil
 }
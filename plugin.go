@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"github.com/abimek/opennote/openapi"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+)
+
+const (
+	pluginManifestFile = "resources/ai-plugin.json"
+	pluginLogoFile     = "resources/logo.png"
+	// openapiSpecFile is the committed copy of the generated spec, it is regenerated with "go run . openapi"
+	openapiSpecFile = "resources/openapi.yaml"
+)
+
+// wellKnownFiles are the rendered plugin manifest and the generated openapi spec, they are rendered once at startup
+var wellKnownFiles struct {
+	manifest []byte
+	spec     []byte
+}
+
+// pluginTemplateData is what the plugin manifest is templated with
+type pluginTemplateData struct {
+	ServerURL               string
+	OpenAIVerificationToken string
+}
+
+// specServerURL is the server url of the committed openapi spec, servers render their own with the configured url
+var specServerURL = config.Default().Server.URL
+
+// pluginSetup renders the well-known files served to ChatGPT
+func pluginSetup(cfg config.Config) {
+	data := pluginTemplateData{
+		ServerURL:               strings.TrimSuffix(cfg.Server.URL, "/"),
+		OpenAIVerificationToken: cfg.Plugin.OpenAIVerificationToken,
+	}
+	var err error
+	if wellKnownFiles.manifest, err = renderTemplateFile(pluginManifestFile, data); err != nil {
+		panic("Unable to render plugin manifest: " + err.Error())
+	}
+	if wellKnownFiles.spec, err = renderOpenAPISpec(data.ServerURL); err != nil {
+		panic("Unable to generate openapi spec: " + err.Error())
+	}
+	if err = checkOpenAPISpec(); err != nil {
+		log.Warn().
+			Err(err).
+			Msg("Committed openapi spec is out of date, the generated one is served")
+	}
+}
+
+func renderTemplateFile(path string, data any) ([]byte, error) {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderOpenAPISpec generates the openapi spec of the plugin from the routes described with routing.Describe
+func renderOpenAPISpec(serverURL string) ([]byte, error) {
+	return openapi.Generate(openapi.Info{
+		Title:       "OpenNote",
+		Description: "A plugin that retrieves information from the users notes",
+		Version:     "v1",
+	}, serverURL).Marshal()
+}
+
+// checkOpenAPISpec returns an error if the committed spec isn't what the code generates
+func checkOpenAPISpec() error {
+	committed, err := os.ReadFile(openapiSpecFile)
+	if err != nil {
+		return err
+	}
+	generated, err := renderOpenAPISpec(specServerURL)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(committed, generated) {
+		return errors.New(openapiSpecFile + " differs from the generated spec")
+	}
+	return nil
+}
+
+// pluginManifestEndpoint is the endpoint at /.well-known/ai-plugin.json
+func pluginManifestEndpoint(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json", wellKnownFiles.manifest)
+}
+
+// openapiSpecEndpoint is the endpoint at /.well-known/openapi.yaml
+func openapiSpecEndpoint(c *gin.Context) {
+	c.Data(http.StatusOK, "application/yaml", wellKnownFiles.spec)
+}
+
+// pluginLogoEndpoint is the endpoint at /.well-known/logo.png
+func pluginLogoEndpoint(c *gin.Context) {
+	c.File(pluginLogoFile)
+}
+
+// queryEndpoint is the endpoint at /query that ChatGPT calls, it searches the users notes for a batch of queries.
+func queryEndpoint(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	var request QueryRequest
+	if err := c.BindJSON(&request); err != nil || len(request.Queries) == 0 {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+
+	uid := authenticatedUid(c)
+	if err := checkQuota(c.Request.Context(), uid); err != nil {
+		if isQuotaError(err) {
+			c.JSON(http.StatusTooManyRequests, RequestErrorResult{
+				ErrorCode: QuotaExceededError,
+				Content:   "Token quota exceeded, " + err.Error(),
+			})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to check token quota",
+		})
+		return
+	}
+	sess := sessionForRequest(c, uid)
+	if sess == nil {
+		return
+	}
+	sess.updateTimer()
+
+	resp, err := sess.searchNotes(c.Request.Context(), request.Queries)
+	if isUnavailableError(err) {
+		upstreamUnavailable(c)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to search notes",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, resp)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestCommittedOpenAPISpec(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter(config.Config{})
+
+	committed, err := os.ReadFile(openapiSpecFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := renderOpenAPISpec(specServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, generated) {
+		t.Fatalf("%s differs from the generated spec, run: go run . openapi > %s", openapiSpecFile, openapiSpecFile)
+	}
+}
+
+// a second router has to register its own OPTIONS handlers, the first one's don't carry over
+func TestNewRouterTwice(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newRouter(config.Config{})
+	r := newRouter(config.Config{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodOptions, "/query", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("OPTIONS /query answered %d", w.Code)
+	}
+	generated, err := renderOpenAPISpec(specServerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := os.ReadFile(openapiSpecFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(committed, generated) {
+		t.Fatal("the spec of a second router differs from the committed one")
+	}
+}
@@ -2,14 +2,15 @@ package main
 
 // QueryRequest is what is sent to the server by GPT for a response, it is a list of queries
 type QueryRequest struct {
-	Queries []string `json:"queries" binding:"required"`
+	Queries []string `json:"queries" binding:"required" description:"Detailed questions about a topic, like 'Where is a PCB used' rather than just 'PCB'"`
 }
 
+// QueryResponse is the response to a QueryRequest, it has a result for every query in the same order
 type QueryResponse struct {
 	Results []QueryResult `json:"results"`
 }
 
 type QueryResult struct {
 	Query  string   `json:"query"`
-	Result []string `json:"result"`
+	Result []string `json:"result" description:"The most relevant passages from the users notes"`
 }
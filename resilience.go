@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"github.com/abimek/opennote/resilience"
+	"github.com/gin-gonic/gin"
+	"github.com/nekomeowww/go-pinecone"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// upstreamBaseDelay is the backoff before the first retry of a call to OpenAI or Pinecone
+const upstreamBaseDelay = 500 * time.Millisecond
+
+// the retry policies and circuit breakers of the upstreams, they're set once by resilienceSetup. Until then calls are
+// made once and never stopped.
+var (
+	upstreamsConf  config.Upstreams
+	openaiPolicy   resilience.Policy
+	pineconePolicy resilience.Policy
+	openaiBreaker  *resilience.Breaker
+	// pineconeBreakers are the breakers of pinecone keyed by index host, every user brings their own index so an index
+	// that's deleted or misconfigured only stops the calls to itself
+	pineconeBreakers   = map[string]*resilience.Breaker{}
+	pineconeBreakersMu sync.Mutex
+	// unavailableRetryAfter is the Retry-After of requests failed by an open breaker, the cooldown in seconds
+	unavailableRetryAfter = "30"
+)
+
+// errNotesUnavailable is wrapped by the errors of searches that failed because the notes couldn't be reached
+var errNotesUnavailable = errors.New("notes unavailable")
+
+// maxPineconeBreakers is how many pinecone hosts get a breaker before the closed ones are dropped, a closed breaker
+// only loses its count of recent failures
+const maxPineconeBreakers = 10000
+
+// notesUnavailableResult is what query_notes returns to the model when the search failed, without it the model answers
+// as if the user had no notes about the topic
+const notesUnavailableResult = `{"error":"notes_unavailable","message":"The notes of the user couldn't be searched right now. Tell the user their notes are temporarily unavailable, don't answer as if they had no notes about this."}`
+
+// resilienceSetup sets up the retries and circuit breakers of OpenAI and Pinecone
+func resilienceSetup(conf config.Upstreams) {
+	upstreamsConf = conf
+	openaiPolicy = upstreamPolicy(conf, "openai")
+	pineconePolicy = upstreamPolicy(conf, "pinecone")
+	openaiBreaker = upstreamBreaker(conf, "openai", "api.openai.com")
+	unavailableRetryAfter = strconv.Itoa(int(conf.BreakerCooldown.Seconds()))
+}
+
+func upstreamPolicy(conf config.Upstreams, upstream string) resilience.Policy {
+	return resilience.Policy{
+		Attempts:  conf.Attempts,
+		BaseDelay: upstreamBaseDelay,
+		MaxDelay:  conf.MaxDelay,
+		OnRetry: func(ctx context.Context, retry int, delay time.Duration, err error) {
+			upstreamRetries.Inc(upstream)
+			log.Ctx(ctx).Warn().
+				Err(err).
+				Str("Upstream", upstream).
+				Int("Retry", retry).
+				Dur("Delay", delay).
+				Msg("Retrying call")
+		},
+	}
+}
+
+// upstreamBreaker builds the breaker of a host of the upstream
+func upstreamBreaker(conf config.Upstreams, upstream string, host string) *resilience.Breaker {
+	return resilience.NewBreaker(host, conf.BreakerFailures, conf.BreakerCooldown, func(open bool) {
+		if open {
+			breakerChanges.Inc(upstream, "open")
+			log.Error().
+				Str("Upstream", upstream).
+				Str("Host", host).
+				Int("Failures", conf.BreakerFailures).
+				Dur("Cooldown", conf.BreakerCooldown).
+				Msg("Circuit breaker opened, calls fail right away until the upstream answers again")
+			return
+		}
+		breakerChanges.Inc(upstream, "closed")
+		log.Info().
+			Str("Upstream", upstream).
+			Str("Host", host).
+			Msg("Circuit breaker closed")
+	})
+}
+
+// pineconeStatus finds the status code in the errors of the pinecone client, it doesn't return the response
+var pineconeStatus = regexp.MustCompile(`status code: (\d+)$`)
+
+// pineconeRateLimitDelay is the wait before retrying a pinecone call that was rate limited. The pinecone client doesn't
+// give access to the headers of its responses, so the Retry-After of a 429 can't be honored, instead it waits longer
+// than the usual backoff, up to the max delay of the policy.
+const pineconeRateLimitDelay = 5 * time.Second
+
+// classifyPinecone decides whether a failed pinecone call is retried
+func classifyPinecone(err error) resilience.Failure {
+	switch {
+	case errors.Is(err, pinecone.ErrRequestFailed):
+		if match := pineconeStatus.FindStringSubmatch(err.Error()); match != nil {
+			status, _ := strconv.Atoi(match[1])
+			var retryAfter time.Duration
+			if status == http.StatusTooManyRequests {
+				retryAfter = pineconeRateLimitDelay
+				if retryAfter > pineconePolicy.MaxDelay {
+					retryAfter = pineconePolicy.MaxDelay
+				}
+			}
+			return resilience.StatusFailure(status, retryAfter)
+		}
+		return resilience.Failure{}
+	case errors.Is(err, pinecone.ErrInvalidParams), errors.Is(err, pinecone.ErrIndexNotFound):
+		return resilience.Failure{}
+	}
+	return resilience.ErrorFailure(err)
+}
+
+// pineconeBreaker returns the breaker of the pinecone host, it's created on first use
+func pineconeBreaker(host string) *resilience.Breaker {
+	pineconeBreakersMu.Lock()
+	defer pineconeBreakersMu.Unlock()
+	if breaker, ok := pineconeBreakers[host]; ok {
+		return breaker
+	}
+	if len(pineconeBreakers) >= maxPineconeBreakers {
+		for h, breaker := range pineconeBreakers {
+			if !breaker.Open() {
+				delete(pineconeBreakers, h)
+			}
+		}
+	}
+	breaker := upstreamBreaker(upstreamsConf, "pinecone", host)
+	pineconeBreakers[host] = breaker
+	return breaker
+}
+
+// callPinecone makes a call to the index with retries, behind the circuit breaker of its host
+func callPinecone(ctx context.Context, index *pineconeIndex, call func(ctx context.Context) error) error {
+	return resilience.Do(ctx, pineconePolicy, pineconeBreaker(index.host), classifyPinecone, call)
+}
+
+// isUnavailableError reports whether the error is because OpenAI or Pinecone kept failing and calls to them are stopped
+func isUnavailableError(err error) bool {
+	return errors.Is(err, resilience.ErrOpen)
+}
+
+// upstreamUnavailable answers a request that failed because a circuit breaker is open
+func upstreamUnavailable(c *gin.Context) {
+	c.Header("Retry-After", unavailableRetryAfter)
+	c.JSON(http.StatusServiceUnavailable, RequestErrorResult{
+		ErrorCode: UpstreamUnavailableError,
+		Content:   "OpenAI or Pinecone are unavailable, try again later",
+	})
+}
@@ -0,0 +1,316 @@
+// Package resilience retries calls to the apis the server depends on and stops calling an api that keeps failing. A
+// short outage costs a retry instead of the chat turn, a long one fails fast instead of piling up waiting requests.
+package resilience
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned, wrapped with the name of the upstream, for calls made while its circuit breaker is open
+var ErrOpen = errors.New("circuit breaker is open")
+
+// Failure is how a failed call is handled
+type Failure struct {
+	// Retry is whether making the call again can succeed
+	Retry bool
+	// RetryAfter is how long the upstream asked to wait before the next call, zero if it didn't say
+	RetryAfter time.Duration
+	// Upstream is whether the upstream itself is failing, only those failures count towards opening the breaker
+	Upstream bool
+}
+
+// StatusFailure classifies a response with an error status, retryAfter is what its Retry-After header asked for
+func StatusFailure(status int, retryAfter time.Duration) Failure {
+	switch status {
+	case http.StatusTooManyRequests:
+		// rate limits are per api key, they don't say anything about the calls of other users
+		return Failure{Retry: true, RetryAfter: retryAfter}
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return Failure{Retry: true, RetryAfter: retryAfter, Upstream: true}
+	}
+	return Failure{}
+}
+
+// ErrorFailure classifies an error of a call that got no answer, like a refused connection or a timeout
+func ErrorFailure(err error) Failure {
+	if errors.Is(err, context.Canceled) || errors.Is(err, ErrOpen) {
+		return Failure{}
+	}
+	return Failure{Retry: true, Upstream: true}
+}
+
+// record tells the breaker about a failed call. Only failures of the upstream itself count, a call that failed because
+// of the callers api key, a rate limit or a cancellation says nothing about whether the upstream works.
+func (f Failure) record(b *Breaker) {
+	if f.Upstream {
+		b.Record(true)
+		return
+	}
+	b.Release()
+}
+
+// RetryAfter parses a Retry-After header, it's either seconds or a date. Missing or invalid headers are zero.
+func RetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(header); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// Policy is how often and how fast a call is retried
+type Policy struct {
+	// Attempts is how often the call is made at most, 1 or less makes it once
+	Attempts int
+	// BaseDelay is the backoff before the first retry, it doubles with every retry
+	BaseDelay time.Duration
+	// MaxDelay caps the backoff, a Retry-After asking for longer isn't waited for and the call fails
+	MaxDelay time.Duration
+	// OnRetry is called before every retry with the context of the call, the number of the retry, the wait and why the
+	// last attempt failed
+	OnRetry func(ctx context.Context, retry int, delay time.Duration, err error)
+}
+
+// Delay returns how long to wait before the retry, 1 is the first one. The backoff is jittered between half and all of
+// it so callers that failed together don't retry together. It returns false if the upstream asked to wait longer than
+// MaxDelay.
+func (p Policy) Delay(retry int, retryAfter time.Duration) (time.Duration, bool) {
+	if retryAfter > p.MaxDelay {
+		return 0, false
+	}
+	backoff := p.BaseDelay
+	for i := 1; i < retry && backoff < p.MaxDelay; i++ {
+		backoff *= 2
+	}
+	if backoff > p.MaxDelay {
+		backoff = p.MaxDelay
+	}
+	delay := backoff / 2
+	if backoff > 0 {
+		delay += time.Duration(rand.Int63n(int64(backoff/2) + 1))
+	}
+	if delay < retryAfter {
+		delay = retryAfter
+	}
+	return delay, true
+}
+
+// retry returns the wait before the next attempt after attempt failed, it returns false if the call shouldn't be made
+// again
+func (p Policy) retry(ctx context.Context, attempt int, failure Failure, err error) (time.Duration, bool) {
+	if !failure.Retry || attempt >= p.Attempts || ctx.Err() != nil {
+		return 0, false
+	}
+	delay, ok := p.Delay(attempt, failure.RetryAfter)
+	if ok && p.OnRetry != nil {
+		p.OnRetry(ctx, attempt, delay, err)
+	}
+	return delay, ok
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Do calls fn until it succeeds, fails in a way that can't be retried or runs out of attempts, and returns the error of
+// the last attempt. classify decides how an error is handled. The breaker is asked before every attempt and told how
+// it went, it can be nil.
+func Do(ctx context.Context, policy Policy, breaker *Breaker, classify func(error) Failure, fn func(ctx context.Context) error) error {
+	for attempt := 1; ; attempt++ {
+		if err := breaker.Allow(); err != nil {
+			return err
+		}
+		err := fn(ctx)
+		if err == nil {
+			breaker.Record(false)
+			return nil
+		}
+		failure := classify(err)
+		failure.record(breaker)
+		delay, ok := policy.retry(ctx, attempt, failure, err)
+		if !ok || sleep(ctx, delay) != nil {
+			return err
+		}
+	}
+}
+
+// Transport is an http.RoundTripper that retries requests that got a retryable status or no answer at all. Retries
+// only happen until response headers arrive, a stream that broke after it started isn't made again, and requests with a
+// body are only retried if the body can be replayed.
+type Transport struct {
+	Next    http.RoundTripper
+	Policy  Policy
+	Breaker *Breaker
+}
+
+func (t Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 1; ; attempt++ {
+		if err := t.Breaker.Allow(); err != nil {
+			return nil, err
+		}
+		if attempt > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+		resp, err := t.Next.RoundTrip(req)
+
+		var failure Failure
+		var cause error
+		switch {
+		case err != nil:
+			failure, cause = ErrorFailure(err), err
+		case resp.StatusCode >= 400:
+			failure = StatusFailure(resp.StatusCode, RetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+			cause = fmt.Errorf("%s answered %s", req.URL.Host, resp.Status)
+		case resp.StatusCode < 200 || resp.StatusCode >= 300:
+			// a redirect says nothing about whether the upstream works
+			t.Breaker.Release()
+			return resp, nil
+		default:
+			t.Breaker.Record(false)
+			return resp, nil
+		}
+		failure.record(t.Breaker)
+		if !replayable {
+			return resp, err
+		}
+		delay, ok := t.Policy.retry(ctx, attempt, failure, cause)
+		if !ok {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Breaker stops calls to an upstream that failed too often in a row. After a cooldown it lets a single call through to
+// try the upstream again, the breaker closes if it succeeds and stays open for another cooldown if it fails. All
+// methods work on a nil Breaker, which never opens.
+type Breaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	onChange  func(open bool)
+
+	mu       sync.Mutex
+	failures int
+	open     bool
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker returns a closed breaker that opens after threshold failures in a row, onChange is called when it opens
+// or closes and can be nil. A threshold of 0 returns nil, a breaker that never opens.
+func NewBreaker(name string, threshold int, cooldown time.Duration, onChange func(open bool)) *Breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &Breaker{name: name, threshold: threshold, cooldown: cooldown, onChange: onChange}
+}
+
+// Allow returns an error wrapping ErrOpen if the call shouldn't be made
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	if !b.probing && time.Since(b.openedAt) >= b.cooldown {
+		b.probing = true
+		return nil
+	}
+	return fmt.Errorf("%s: %w", b.name, ErrOpen)
+}
+
+// Record tells the breaker how an allowed call went, failed is whether the upstream itself failed. Only calls the
+// upstream answered successfully should be recorded as not failed, they close the breaker.
+func (b *Breaker) Record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	changed := false
+	switch {
+	case !failed:
+		b.failures = 0
+		changed = b.open
+		b.open = false
+	case b.open:
+		// the probe failed
+		b.openedAt = time.Now()
+	default:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.open = true
+			b.openedAt = time.Now()
+			changed = true
+		}
+	}
+	open := b.open
+	b.mu.Unlock()
+	if changed && b.onChange != nil {
+		b.onChange(open)
+	}
+}
+
+// Release tells the breaker an allowed call ended without saying anything about the upstream, like a call rejected for
+// the api key of the caller. The count of failures and whether the breaker is open stay the same, a probe that ended
+// this way lets the next call probe again.
+func (b *Breaker) Release() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.probing = false
+	b.mu.Unlock()
+}
+
+// Open reports whether the breaker is open
+func (b *Breaker) Open() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.open
+}
@@ -0,0 +1,358 @@
+package resilience
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errUpstream = errors.New("upstream failed")
+
+// classify retries errUpstream as an upstream failure and fails everything else right away
+func classify(err error) Failure {
+	if errors.Is(err, errUpstream) {
+		return Failure{Retry: true, Upstream: true}
+	}
+	return Failure{}
+}
+
+func TestDo(t *testing.T) {
+	errBadRequest := errors.New("bad request")
+	tests := []struct {
+		name     string
+		attempts int
+		results  []error
+		calls    int
+		err      error
+	}{
+		{name: "success", attempts: 3, results: []error{nil}, calls: 1},
+		{name: "retried until success", attempts: 3, results: []error{errUpstream, errUpstream, nil}, calls: 3},
+		{name: "out of attempts", attempts: 3, results: []error{errUpstream, errUpstream, errUpstream}, calls: 3, err: errUpstream},
+		{name: "not retryable", attempts: 3, results: []error{errBadRequest}, calls: 1, err: errBadRequest},
+		{name: "single attempt", attempts: 1, results: []error{errUpstream}, calls: 1, err: errUpstream},
+		{name: "no attempts set", attempts: 0, results: []error{errUpstream}, calls: 1, err: errUpstream},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			retries := 0
+			policy := Policy{
+				Attempts:  tt.attempts,
+				BaseDelay: time.Millisecond,
+				MaxDelay:  time.Millisecond,
+				OnRetry: func(ctx context.Context, retry int, delay time.Duration, err error) {
+					retries++
+				},
+			}
+			err := Do(context.Background(), policy, nil, classify, func(ctx context.Context) error {
+				err := tt.results[calls]
+				calls++
+				return err
+			})
+			if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if calls != tt.calls {
+				t.Fatalf("made %d calls, want %d", calls, tt.calls)
+			}
+			if retries != tt.calls-1 {
+				t.Fatalf("OnRetry was called %d times, want %d", retries, tt.calls-1)
+			}
+		})
+	}
+}
+
+func TestDoCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := Policy{Attempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	calls := 0
+	err := Do(ctx, policy, nil, classify, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return errUpstream
+	})
+	if !errors.Is(err, errUpstream) || calls != 1 {
+		t.Fatalf("got %v after %d calls, want errUpstream after 1", err, calls)
+	}
+}
+
+func TestDoOpensBreaker(t *testing.T) {
+	breaker := NewBreaker("test", 2, time.Hour, nil)
+	policy := Policy{Attempts: 1}
+	fail := func(ctx context.Context) error { return errUpstream }
+	for i := 0; i < 2; i++ {
+		if err := Do(context.Background(), policy, breaker, classify, fail); !errors.Is(err, errUpstream) {
+			t.Fatalf("call %d: got %v, want errUpstream", i, err)
+		}
+	}
+	called := false
+	err := Do(context.Background(), policy, breaker, classify, func(ctx context.Context) error {
+		called = true
+		return nil
+	})
+	if !errors.Is(err, ErrOpen) || called {
+		t.Fatalf("got %v and called %v, want ErrOpen without a call", err, called)
+	}
+}
+
+// failures that aren't the upstreams fault, like a rejected api key, neither count nor close an open breaker
+func TestDoNonUpstreamFailure(t *testing.T) {
+	breaker := NewBreaker("test", 2, time.Hour, nil)
+	policy := Policy{Attempts: 1}
+	errBadKey := errors.New("bad api key")
+	fail := func(err error) func(ctx context.Context) error {
+		return func(ctx context.Context) error { return err }
+	}
+	Do(context.Background(), policy, breaker, classify, fail(errUpstream))
+	Do(context.Background(), policy, breaker, classify, fail(errBadKey))
+	Do(context.Background(), policy, breaker, classify, fail(errUpstream))
+	if !breaker.Open() {
+		t.Fatal("a rejected key reset the count of upstream failures")
+	}
+
+	breaker.mu.Lock()
+	breaker.openedAt = breaker.openedAt.Add(-2 * breaker.cooldown)
+	breaker.mu.Unlock()
+	if err := Do(context.Background(), policy, breaker, classify, fail(errBadKey)); !errors.Is(err, errBadKey) {
+		t.Fatalf("probe: got %v, want the error of the call", err)
+	}
+	if !breaker.Open() {
+		t.Fatal("a probe with a rejected key closed the breaker")
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTransportRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		// failures is the count of the breaker after a failure, then a call answered with status
+		failures int
+	}{
+		{name: "2xx resets", status: http.StatusOK, failures: 0},
+		{name: "401 keeps the count", status: http.StatusUnauthorized, failures: 1},
+		{name: "429 keeps the count", status: http.StatusTooManyRequests, failures: 1},
+		{name: "3xx keeps the count", status: http.StatusFound, failures: 1},
+		{name: "503 counts", status: http.StatusServiceUnavailable, failures: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			breaker := NewBreaker("test", 10, time.Hour, nil)
+			breaker.Record(true)
+			transport := Transport{
+				Breaker: breaker,
+				Next: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+					return &http.Response{StatusCode: tt.status, Body: http.NoBody, Header: http.Header{}}, nil
+				}),
+			}
+			req, _ := http.NewRequest(http.MethodGet, "http://upstream.test", nil)
+			if _, err := transport.RoundTrip(req); err != nil {
+				t.Fatal(err)
+			}
+			breaker.mu.Lock()
+			failures := breaker.failures
+			breaker.mu.Unlock()
+			if failures != tt.failures {
+				t.Fatalf("the breaker counts %d failures, want %d", failures, tt.failures)
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	type step struct {
+		// wait moves the clock of the breaker past its cooldown before the step
+		wait bool
+		// record is how the call went if it was allowed, nil skips recording
+		record *bool
+		// release ends the allowed call without saying how the upstream did, like a 4xx
+		release bool
+		allow   bool
+		open    bool
+	}
+	failed, succeeded := true, false
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{name: "stays closed below the threshold", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{allow: true},
+		}},
+		{name: "opens at the threshold", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &failed, allow: true, open: true},
+			{allow: false, open: true},
+		}},
+		{name: "a success resets the count", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &succeeded, allow: true},
+			{record: &failed, allow: true},
+			{allow: true},
+		}},
+		{name: "probe closes", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &failed, allow: true, open: true},
+			{wait: true, record: &succeeded, allow: true},
+			{allow: true},
+		}},
+		{name: "failed probe stays open", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &failed, allow: true, open: true},
+			{wait: true, record: &failed, allow: true, open: true},
+			{allow: false, open: true},
+		}},
+		{name: "a 4xx doesn't reset the count", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{release: true, allow: true},
+			{record: &failed, allow: true, open: true},
+		}},
+		{name: "a 4xx during a probe doesn't close", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &failed, allow: true, open: true},
+			{wait: true, release: true, allow: true, open: true},
+			// the probe didn't tell anything, so the next call probes again
+			{record: &failed, allow: true, open: true},
+			{allow: false, open: true},
+		}},
+		{name: "one probe at a time", steps: []step{
+			{record: &failed, allow: true},
+			{record: &failed, allow: true},
+			{record: &failed, allow: true, open: true},
+			{wait: true, allow: true, open: true},
+			{allow: false, open: true},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var changes []bool
+			b := NewBreaker("test", 3, time.Hour, func(open bool) { changes = append(changes, open) })
+			wasOpen := false
+			for i, s := range tt.steps {
+				if s.wait {
+					b.mu.Lock()
+					b.openedAt = b.openedAt.Add(-2 * b.cooldown)
+					b.mu.Unlock()
+				}
+				err := b.Allow()
+				if (err == nil) != s.allow {
+					t.Fatalf("step %d: Allow returned %v, want allowed %v", i, err, s.allow)
+				}
+				if err != nil && !errors.Is(err, ErrOpen) {
+					t.Fatalf("step %d: Allow returned %v, want ErrOpen", i, err)
+				}
+				if err == nil && s.record != nil {
+					b.Record(*s.record)
+				}
+				if err == nil && s.release {
+					b.Release()
+				}
+				if b.Open() != s.open {
+					t.Fatalf("step %d: open is %v, want %v", i, b.Open(), s.open)
+				}
+				if b.Open() != wasOpen {
+					if len(changes) == 0 || changes[len(changes)-1] != b.Open() {
+						t.Fatalf("step %d: onChange wasn't told the breaker is open %v, got %v", i, b.Open(), changes)
+					}
+					wasOpen = b.Open()
+				}
+			}
+		})
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	b := NewBreaker("test", 0, time.Hour, nil)
+	if b != nil {
+		t.Fatal("a threshold of 0 should return nil")
+	}
+	for i := 0; i < 10; i++ {
+		b.Record(true)
+	}
+	if err := b.Allow(); err != nil || b.Open() {
+		t.Fatalf("nil breaker: Allow returned %v, open %v", err, b.Open())
+	}
+}
+
+func TestStatusFailure(t *testing.T) {
+	tests := []struct {
+		status int
+		want   Failure
+	}{
+		{http.StatusTooManyRequests, Failure{Retry: true, RetryAfter: time.Second}},
+		{http.StatusInternalServerError, Failure{Retry: true, RetryAfter: time.Second, Upstream: true}},
+		{http.StatusServiceUnavailable, Failure{Retry: true, RetryAfter: time.Second, Upstream: true}},
+		{http.StatusBadRequest, Failure{}},
+		{http.StatusUnauthorized, Failure{}},
+		{http.StatusNotFound, Failure{}},
+	}
+	for _, tt := range tests {
+		if got := StatusFailure(tt.status, time.Second); got != tt.want {
+			t.Errorf("StatusFailure(%d) = %+v, want %+v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"", 0},
+		{"5", 5 * time.Second},
+		{"-1", 0},
+		{"soon", 0},
+		{now.Add(10 * time.Second).Format(http.TimeFormat), 10 * time.Second},
+		{now.Add(-10 * time.Second).Format(http.TimeFormat), 0},
+	}
+	for _, tt := range tests {
+		if got := RetryAfter(tt.header, now); got != tt.want {
+			t.Errorf("RetryAfter(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyDelay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	tests := []struct {
+		name       string
+		retry      int
+		retryAfter time.Duration
+		min, max   time.Duration
+		ok         bool
+	}{
+		{name: "first retry", retry: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond, ok: true},
+		{name: "doubles", retry: 3, min: 200 * time.Millisecond, max: 400 * time.Millisecond, ok: true},
+		{name: "capped", retry: 10, min: 500 * time.Millisecond, max: time.Second, ok: true},
+		{name: "retry after", retry: 1, retryAfter: 700 * time.Millisecond, min: 700 * time.Millisecond, max: 700 * time.Millisecond, ok: true},
+		{name: "retry after too long", retry: 1, retryAfter: 2 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i++ {
+				delay, ok := p.Delay(tt.retry, tt.retryAfter)
+				if ok != tt.ok {
+					t.Fatalf("ok is %v, want %v", ok, tt.ok)
+				}
+				if ok && (delay < tt.min || delay > tt.max) {
+					t.Fatalf("delay %v isn't between %v and %v", delay, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package routing
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultAppOrigins are the origins of the opennote website during development and the Obsidian app on desktop and
+// mobile.
+var DefaultAppOrigins = []string{
+	"http://localhost:3000",
+	"app://obsidian.md",
+	"capacitor://localhost",
+	"http://localhost",
+}
+
+// CORSPolicy describes which browser origins may call a group of routes.
+type CORSPolicy struct {
+	// AllowedOrigins are exact origins like "app://obsidian.md", wildcard subdomains like "https://*.example.com" or
+	// "*" for any origin.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts are allowed to read
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+// AppCORSPolicy is the policy for the routes used by the website and the Obsidian plugin.
+func AppCORSPolicy(origins []string) CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins: origins,
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "ChatData", "OpenNote-Workspaces", RequestIDHeader, "traceparent", "tracestate"},
+		ExposedHeaders: []string{"Retry-After", RequestIDHeader},
+		MaxAge:         24 * time.Hour,
+	}
+}
+
+// PluginCORSPolicy is the policy for the ChatGPT plugin routes, ChatGPT calls them from its own origin.
+func PluginCORSPolicy() CORSPolicy {
+	return CORSPolicy{
+		AllowedOrigins: []string{"https://chat.openai.com"},
+		AllowedMethods: []string{http.MethodGet, http.MethodPost, http.MethodOptions},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "openai-conversation-id", "openai-ephemeral-user-id"},
+		MaxAge:         24 * time.Hour,
+	}
+}
+
+// allowOrigin returns the value of the Access-Control-Allow-Origin header for origin, or "" if it isn't allowed. A
+// wildcard is only echoed as "*" when credentials aren't allowed, browsers reject "*" together with credentials.
+func (p CORSPolicy) allowOrigin(origin string) string {
+	for _, allowed := range p.AllowedOrigins {
+		switch {
+		case allowed == "*":
+			if p.AllowCredentials {
+				return origin
+			}
+			return "*"
+		case strings.EqualFold(allowed, origin):
+			return origin
+		case matchWildcardOrigin(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// matchWildcardOrigin matches patterns like "https://*.example.com", the wildcard has to match at least one subdomain
+// so "https://example.com" itself needs its own entry.
+func matchWildcardOrigin(pattern string, origin string) bool {
+	scheme, host, ok := strings.Cut(pattern, "://*.")
+	if !ok {
+		return false
+	}
+	originScheme, originHost, ok := strings.Cut(origin, "://")
+	if !ok || !strings.EqualFold(scheme, originScheme) {
+		return false
+	}
+	originHost = strings.ToLower(originHost)
+	suffix := "." + strings.ToLower(host)
+	return strings.HasSuffix(originHost, suffix) && len(originHost) > len(suffix)
+}
+
+// Middleware returns the gin middleware that applies the policy. Preflight requests from allowed origins are answered
+// directly, requests from other origins get no CORS headers at all so the browser blocks them.
+func (p CORSPolicy) Middleware() gin.HandlerFunc {
+	methods := strings.Join(p.AllowedMethods, ", ")
+	headers := strings.Join(p.AllowedHeaders, ", ")
+	exposed := strings.Join(p.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(int(p.MaxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		// the response depends on the origin, so caches must not serve it to other origins
+		c.Writer.Header().Add("Vary", "Origin")
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+		if preflight {
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Method")
+			c.Writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		allowed := p.allowOrigin(origin)
+		if allowed == "" {
+			c.Next()
+			return
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Origin", allowed)
+		if p.AllowCredentials {
+			c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if preflight {
+			c.Writer.Header().Set("Access-Control-Allow-Methods", methods)
+			c.Writer.Header().Set("Access-Control-Allow-Headers", headers)
+			c.Writer.Header().Set("Access-Control-Max-Age", maxAge)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		if exposed != "" {
+			c.Writer.Header().Set("Access-Control-Expose-Headers", exposed)
+		}
+		c.Next()
+	}
+}
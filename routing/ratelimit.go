@@ -0,0 +1,181 @@
+package routing
+
+import (
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UidKey is the gin context key the authentication middleware stores the verified uid of the caller under
+const UidKey = "uid"
+
+// limiterIdleTime is how long a bucket is kept after its last request, a full bucket is the same as a new one so there
+// is no reason to keep it around forever.
+const limiterIdleTime = 10 * time.Minute
+
+// Limit is a token bucket, Rate tokens are added per second up to Burst.
+type Limit struct {
+	Rate  rate.Limit
+	Burst int
+}
+
+// PerMinute returns a limit that allows n requests a minute with bursts of up to burst requests.
+func PerMinute(n int, burst int) Limit {
+	return Limit{Rate: rate.Limit(float64(n) / 60), Burst: burst}
+}
+
+// RouteLimit is the limit of a route for each verified user and for each client ip. The ip limit is looser since
+// several users can share an ip.
+type RouteLimit struct {
+	User Limit
+	IP   Limit
+}
+
+// DefaultRouteLimit is used for routes that don't have an entry in RouteLimits
+var DefaultRouteLimit = RouteLimit{
+	User: PerMinute(120, 30),
+	IP:   PerMinute(300, 60),
+}
+
+// RouteLimits are the limits of the routes that are expensive to serve, keyed by the route path. Every chat message,
+// note query and credential check calls OpenAI and Pinecone.
+var RouteLimits = map[string]RouteLimit{
+	"/messager": {
+		User: PerMinute(20, 5),
+		IP:   PerMinute(60, 10),
+	},
+	"/v1/chat/completions": {
+		User: PerMinute(20, 5),
+		IP:   PerMinute(60, 10),
+	},
+	"/api/validateCredentials": {
+		User: PerMinute(5, 2),
+		IP:   PerMinute(10, 5),
+	},
+	// creating and updating a workspace checks its pinecone credentials like validateCredentials
+	"/api/workspaces/create": {
+		User: PerMinute(5, 2),
+		IP:   PerMinute(10, 5),
+	},
+	"/api/workspaces/update": {
+		User: PerMinute(5, 2),
+		IP:   PerMinute(10, 5),
+	},
+	// there is no uid before logging in so only the ip limit applies, it slows down guessing passwords
+	"/auth/login": {
+		User: PerMinute(10, 5),
+		IP:   PerMinute(10, 5),
+	},
+	"/auth/signup": {
+		User: PerMinute(2, 2),
+		IP:   PerMinute(2, 2),
+	},
+	// an export lists every note in the users index
+	"/api/account/export": {
+		User: PerMinute(2, 2),
+		IP:   PerMinute(5, 2),
+	},
+	"/query": {
+		User: PerMinute(30, 10),
+		IP:   PerMinute(60, 20),
+	},
+	"/mcp": {
+		User: PerMinute(30, 10),
+		IP:   PerMinute(60, 20),
+	},
+}
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	buckets   = map[string]*bucket{}
+	bucketsMu sync.Mutex
+	lastSweep time.Time
+)
+
+// LimitIP is a middleware that limits requests per route by the client ip, it runs before the authentication
+// middleware so guessing tokens and passwords is limited too. The client ip is only taken from forwarding headers sent
+// by the trusted proxies of the engine. Limited requests get a 429 with a Retry-After header.
+func LimitIP(c *gin.Context) {
+	limitRequest(c, "ip:"+c.ClientIP(), func(limit RouteLimit) Limit { return limit.IP })
+}
+
+// LimitUser is a middleware that limits requests per route by the verified uid, it has to run after the
+// authentication middleware for the uid to be known. Requests without a uid aren't limited by it.
+func LimitUser(c *gin.Context) {
+	uid := c.GetString(UidKey)
+	if uid == "" {
+		c.Next()
+		return
+	}
+	limitRequest(c, "uid:"+uid, func(limit RouteLimit) Limit { return limit.User })
+}
+
+// limitRequest takes a token from the bucket of key for the route of the request and aborts it with a 429 if there is
+// none left
+func limitRequest(c *gin.Context, key string, pick func(RouteLimit) Limit) {
+	route := c.FullPath()
+	limit, ok := RouteLimits[route]
+	if !ok {
+		limit = DefaultRouteLimit
+	}
+
+	now := time.Now()
+	bucketsMu.Lock()
+	sweepBuckets(now)
+	r := reserve(key+":"+route, pick(limit), now)
+	bucketsMu.Unlock()
+
+	var wait time.Duration
+	if !r.OK() {
+		wait = time.Duration(math.MaxInt64)
+	} else {
+		wait = r.DelayFrom(now)
+	}
+	if wait == 0 {
+		c.Next()
+		return
+	}
+	// the request isn't going through, so give back the token it took
+	r.CancelAt(now)
+
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	if wait == time.Duration(math.MaxInt64) {
+		retryAfter = 60
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+		"error": "Too many requests",
+	})
+}
+
+// reserve takes a token from the bucket of key, bucketsMu must be held
+func reserve(key string, limit Limit, now time.Time) *rate.Reservation {
+	b, ok := buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(limit.Rate, limit.Burst)}
+		buckets[key] = b
+	}
+	b.lastSeen = now
+	return b.limiter.ReserveN(now, 1)
+}
+
+// sweepBuckets removes the buckets that have been idle for limiterIdleTime, bucketsMu must be held
+func sweepBuckets(now time.Time) {
+	if now.Sub(lastSweep) < limiterIdleTime {
+		return
+	}
+	lastSweep = now
+	for k, b := range buckets {
+		if now.Sub(b.lastSeen) > limiterIdleTime {
+			delete(buckets, k)
+		}
+	}
+}
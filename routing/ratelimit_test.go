@@ -0,0 +1,141 @@
+package routing
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newLimitedRouter serves /limited, /other and /ip/limited with a burst of 2 requests a minute, the uid of a request is taken from
+// the X-Uid header like the authentication middleware would
+func newLimitedRouter(t *testing.T) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	bucketsMu.Lock()
+	buckets = map[string]*bucket{}
+	bucketsMu.Unlock()
+	for _, route := range []string{"/limited", "/other", "/ip/limited"} {
+		route := route
+		RouteLimits[route] = RouteLimit{User: PerMinute(1, 2), IP: PerMinute(1, 2)}
+		t.Cleanup(func() { delete(RouteLimits, route) })
+	}
+
+	r := gin.New()
+	setUid := func(c *gin.Context) {
+		if uid := c.GetHeader("X-Uid"); uid != "" {
+			c.Set(UidKey, uid)
+		}
+	}
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	ip := r.Group("/ip", LimitIP)
+	ip.GET("/limited", ok)
+	user := r.Group("", setUid, LimitUser)
+	user.GET("/limited", ok)
+	user.GET("/other", ok)
+	return r
+}
+
+func TestLimit(t *testing.T) {
+	type request struct {
+		path   string
+		uid    string
+		ip     string
+		status int
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{
+			name: "burst then limited",
+			requests: []request{
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusTooManyRequests},
+			},
+		},
+		{
+			name: "users have their own buckets",
+			requests: []request{
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "bob", status: http.StatusOK},
+			},
+		},
+		{
+			name: "routes have their own buckets",
+			requests: []request{
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/other", uid: "alice", status: http.StatusOK},
+			},
+		},
+		{
+			name: "requests without a uid aren't limited by user",
+			requests: []request{
+				{path: "/limited", status: http.StatusOK},
+				{path: "/limited", status: http.StatusOK},
+				{path: "/limited", status: http.StatusOK},
+			},
+		},
+		{
+			name: "limited by ip",
+			requests: []request{
+				{path: "/ip/limited", ip: "10.0.0.1", status: http.StatusOK},
+				{path: "/ip/limited", ip: "10.0.0.1", status: http.StatusOK},
+				{path: "/ip/limited", ip: "10.0.0.2", status: http.StatusOK},
+				{path: "/ip/limited", ip: "10.0.0.1", status: http.StatusTooManyRequests},
+			},
+		},
+		{
+			// a limited request gives its token back, otherwise retrying too early would push the next token further out
+			name: "limited requests don't take a token",
+			requests: []request{
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusOK},
+				{path: "/limited", uid: "alice", status: http.StatusTooManyRequests},
+				{path: "/limited", uid: "alice", status: http.StatusTooManyRequests},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newLimitedRouter(t)
+			for i, req := range tt.requests {
+				httpReq := httptest.NewRequest(http.MethodGet, req.path, nil)
+				if req.uid != "" {
+					httpReq.Header.Set("X-Uid", req.uid)
+				}
+				if req.ip != "" {
+					httpReq.RemoteAddr = req.ip + ":1234"
+				}
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httpReq)
+				if w.Code != req.status {
+					t.Fatalf("request %d: got %d, want %d", i, w.Code, req.status)
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "60" {
+					t.Fatalf("request %d: Retry-After %q, want 60", i, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
+
+func TestSweepBuckets(t *testing.T) {
+	now := time.Now()
+	bucketsMu.Lock()
+	defer bucketsMu.Unlock()
+	buckets = map[string]*bucket{}
+	lastSweep = time.Time{}
+	reserve("idle", PerMinute(1, 1), now.Add(-2*limiterIdleTime))
+	reserve("recent", PerMinute(1, 1), now.Add(-time.Minute))
+	sweepBuckets(now)
+	if _, ok := buckets["idle"]; ok {
+		t.Fatal("idle bucket wasn't swept")
+	}
+	if _, ok := buckets["recent"]; !ok {
+		t.Fatal("recent bucket was swept")
+	}
+}
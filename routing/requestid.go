@@ -0,0 +1,87 @@
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"time"
+)
+
+// RequestIDHeader is the header the id of a request is answered in. A proxy in front of the server can set it on the
+// request so its logs and ours share the id.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength is the longest id taken from a client, anything longer gets a new id instead
+const maxRequestIDLength = 64
+
+type requestIDKey struct{}
+
+// RequestID gives every request an id and puts a logger tagged with it in the context of the request, so everything
+// that logs with log.Ctx(ctx) while handling it can be found by the id.
+func RequestID(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	c.Header(RequestIDHeader, id)
+	logger := log.Logger.With().Str("RequestId", id).Logger()
+	ctx := context.WithValue(c.Request.Context(), requestIDKey{}, id)
+	c.Request = c.Request.WithContext(logger.WithContext(ctx))
+	c.Next()
+}
+
+// RequestIDFrom returns the id of the request ctx belongs to, or "" if it doesn't belong to one
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// validRequestID only accepts ids made of letters, digits, '-' and '_', the id ends up in logs and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AccessLog logs every request once it's handled. Only the path is logged, query strings can carry OAuth codes and
+// bodies carry api keys and notes.
+func AccessLog(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	status := c.Writer.Status()
+	level := zerolog.InfoLevel
+	switch {
+	case status >= 500:
+		level = zerolog.ErrorLevel
+	case status >= 400:
+		level = zerolog.WarnLevel
+	}
+	event := log.Ctx(c.Request.Context()).WithLevel(level).
+		Str("Method", c.Request.Method).
+		Str("Path", c.Request.URL.Path).
+		Int("Status", status).
+		Dur("Latency", time.Since(start)).
+		Str("IP", c.ClientIP())
+	if uid := c.GetString(UidKey); uid != "" {
+		event = event.Str("User", uid)
+	}
+	event.Msg("Request")
+}
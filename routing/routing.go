@@ -3,24 +3,33 @@ package routing
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
-	"strings"
+	"path"
+	"sync"
 )
 
-// Route calls gin's routing function based on method and also calls OPTION on the route
-func Route(router *gin.Engine, method string, route string, handler gin.HandlerFunc) {
-	router.OPTIONS(route, empty)
+// Route calls gin's routing function based on method and also calls OPTION on the route, handlers are run in order so
+// middleware for just this route can be passed before the handler. The router can be a group so the route gets the
+// middleware of the group, like its CORS policy.
+func Route(router gin.IRoutes, method string, route string, handlers ...gin.HandlerFunc) {
+	// gin panics if a path gets two OPTIONS handlers, so only the first method of a path adds one
+	if register(router, method, route) {
+		router.OPTIONS(route, empty)
+	}
 	switch method {
 	case http.MethodGet:
-		router.GET(route, handler)
+		router.GET(route, handlers...)
 		return
 	case http.MethodPost:
-		router.POST(route, handler)
+		router.POST(route, handlers...)
 		return
 	case http.MethodOptions:
-		router.OPTIONS(route, handler)
+		router.OPTIONS(route, handlers...)
+		return
+	case http.MethodPatch:
+		router.PATCH(route, handlers...)
 		return
 	case http.MethodDelete:
-		router.DELETE(route, handler)
+		router.DELETE(route, handlers...)
 	}
 }
 
@@ -29,39 +38,79 @@ func empty(c *gin.Context) {
 	c.Status(http.StatusOK)
 }
 
-// CORS is a function that handles the CORS system for browser app interactions, this is a middleware function
-func GENERAL(c *gin.Context) {
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
-	c.Writer.Header().Set("Access-Control-Max-Age", "86400")
-	c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Request.Header["Access-Control-Request-Headers"][:], ", "))
-	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-	c.Next()
+func EMPTY_HANDLER(c *gin.Context) {
+
 }
 
-// CORS is a function that handles the CORS system for browser app interactions, this is a middleware function
-func CORS(c *gin.Context) {
-	c.Writer.Header().Set("Content-Type", "application/json")
-	c.Writer.Header().Set("Access-Control-Allow-Origin", "http://localhost:3000")
-	c.Writer.Header().Set("Access-Control-Max-Age", "86400")
-	c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Request.Header["Access-Control-Request-Headers"][:], ", "))
-	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-	c.Next()
+// Spec describes the request and response of a route for the generated openapi document, Request and Response are
+// zero values of the Go types that are bound and returned.
+type Spec struct {
+	OperationId         string
+	Summary             string
+	Request             any
+	Response            any
+	ResponseDescription string
 }
 
-// CORS is a function that handles the CORS system for browser app interactions, this is a middleware function
-func CORS_STREAM(c *gin.Context) {
-	c.Writer.Header().Set("Content-Type", "text/event-stream")
-	c.Writer.Header().Set("Cache-Control", "no-cache")
-	c.Writer.Header().Set("Connection", "keep-alive")
-	c.Writer.Header().Set("Access-Control-Max-Age", "86400")
-	c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	c.Writer.Header().Set("Access-Control-Allow-Headers", strings.Join(c.Request.Header["Access-Control-Request-Headers"][:], ", "))
-	c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-	c.Next()
+// RegisteredRoute is a route registered with Route, Spec is nil unless the route was described with Describe.
+type RegisteredRoute struct {
+	Method string
+	Path   string
+	Spec   *Spec
 }
 
-func EMPTY_HANDLER(c *gin.Context) {
+var (
+	registeredRoutes []RegisteredRoute
+	specs            = map[string]*Spec{}
+	registryMu       sync.Mutex
+)
+
+// Reset forgets the registered routes and their specs, it's called before a router is built so every router registers
+// its OPTIONS handlers and the spec only has the routes of the newest router
+func Reset() {
+	registryMu.Lock()
+	registeredRoutes = nil
+	specs = map[string]*Spec{}
+	registryMu.Unlock()
+}
 
+// register records a route so it can be documented, the path includes the base path of the group. It returns whether
+// the path wasn't registered with any method before.
+func register(router gin.IRoutes, method string, route string) bool {
+	if group, ok := router.(interface{ BasePath() string }); ok {
+		route = path.Join(group.BasePath(), route)
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	newPath := true
+	for _, r := range registeredRoutes {
+		if r.Path != route {
+			continue
+		}
+		if r.Method == method {
+			return false
+		}
+		newPath = false
+	}
+	registeredRoutes = append(registeredRoutes, RegisteredRoute{Method: method, Path: route})
+	return newPath
+}
+
+// Describe attaches a spec to a route, only described routes are part of the generated openapi document.
+func Describe(method string, route string, spec Spec) {
+	registryMu.Lock()
+	specs[method+" "+route] = &spec
+	registryMu.Unlock()
+}
+
+// Routes returns every route registered with Route in the order they were registered.
+func Routes() []RegisteredRoute {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	routes := make([]RegisteredRoute, len(registeredRoutes))
+	for i, r := range registeredRoutes {
+		r.Spec = specs[r.Method+" "+r.Path]
+		routes[i] = r
+	}
+	return routes
 }
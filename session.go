@@ -5,20 +5,50 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/abimek/opennote/config"
 	"github.com/gin-gonic/gin"
 	"github.com/nekomeowww/go-pinecone"
 	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"io"
+	"sort"
 	"sync"
 	"time"
 )
 
-// SessionTimeLimit is the max duration of a session, it is in minutes
-const SessionTimeLimit = 5
-
 var sessions map[string]*session
 
+// sessionSettings are the parts of the config every session is created with
+type sessionSettings struct {
+	// timeLimit is how long a session lives after its last request
+	timeLimit time.Duration
+	// maxConversationChars is how long the conversation gets before the oldest messages are dropped
+	maxConversationChars int
+	chatModel            string
+	embeddingModel       openai.EmbeddingModel
+}
+
+// defaultSessionSettings are what new sessions are created with, they are set once by sessionsSetup
+var defaultSessionSettings sessionSettings
+
+// sessionsSetup creates the sessions map and the settings of new sessions
+func sessionsSetup(conf config.Sessions, models config.Models) {
+	var embeddingModel openai.EmbeddingModel
+	embeddingModel.UnmarshalText([]byte(models.Embedding))
+	if embeddingModel == openai.Unknown {
+		panic("Unknown embedding model " + models.Embedding)
+	}
+	defaultSessionSettings = sessionSettings{
+		timeLimit:            conf.TimeLimit,
+		maxConversationChars: conf.MaxConversationChars,
+		chatModel:            models.Chat,
+		embeddingModel:       embeddingModel,
+	}
+	sessions = map[string]*session{}
+}
+
 // Make this read write mutex if performance is an issue
 var sessionsMutex sync.Mutex
 
@@ -26,20 +56,47 @@ type session struct {
 	user   User
 	userMu sync.RWMutex
 
-	index      *pinecone.IndexClient
+	index      *pineconeIndex
 	chatClient *openai.Client
-	req        openai.ChatCompletionRequest
 	deleteTime time.Time
+	settings   sessionSettings
+
+	// req is the conversation, the chat calls get a copy of it so reading the conversation doesn't wait for a stream
+	req        openai.ChatCompletionRequest
 	charLength int
+	reqMu      sync.Mutex
+
+	// recentNotes are the notes returned by the latest searches, oldest first
+	recentNotes   []noteMatch
+	recentNotesMu sync.Mutex
+
+	// configChanged is closed when the settings of the session change and replaced with a new channel, streams watch it
+	// to tell the client. It's guarded by userMu like chatClient and index.
+	configChanged chan struct{}
+
+	// scope is which indexes query_notes searches in the conversation, it is also guarded by userMu
+	scope searchScope
 }
 
-// sessionTimer will timeout sessions that should be expired, the default is 5 min per session for now
-func sessionTimer() {
-	for range time.Tick(time.Minute) {
+// maxRecentNotes is how many of the notes returned by searches a session remembers
+const maxRecentNotes = 100
+
+// sessionTimer will timeout sessions that should be expired, the default is 5 min per session for now. It runs until
+// ctx is done.
+func sessionTimer(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
 		sessionsMutex.Lock()
 		for k, v := range sessions {
 			if time.Now().After(v.deleteTime) {
 				delete(sessions, k)
+				sessionEvictions.Inc()
 			}
 		}
 		sessionsMutex.Unlock()
@@ -58,207 +115,477 @@ func GetSessionIfExists(uid string) *session {
 	return nil
 }
 
-// updateTimer will update the session delete time to be SessionTimeLimit minutes in the future
+// updateTimer will update the session delete time to be the time limit of the session in the future
 func (s *session) updateTimer() {
-	s.deleteTime = time.Now().Add(SessionTimeLimit * time.Minute)
+	s.deleteTime = time.Now().Add(s.settings.timeLimit)
 }
-func GetSessionWithoutPermanance(user User) (*session, error) {
+
+// newSession returns a session with clients for the credentials of the user, they aren't validated
+func newSession(user User, settings sessionSettings) *session {
 	s := &session{
-		user: user,
-	}
-	pineconeIndex, _ := pinecone.NewIndexClient(
-		pinecone.WithIndexName(user.PineconeIndex),
-		pinecone.WithAPIKey(user.PineconeApiKey),
-		pinecone.WithEnvironment(user.PineconeEnvironment),
-		pinecone.WithProjectName(user.PineconeProjectName),
-	)
-	s.chatClient = openai.NewClient(user.OpenAIApiKey)
-	s.index = pineconeIndex
-
-	if err := s.ValidateCredentials(); err != nil {
+		user:          user,
+		configChanged: make(chan struct{}),
+		scope:         personalScope,
+		settings:      settings,
+	}
+	s.chatClient, s.index = newClients(user)
+	return s
+}
+
+// newClients builds the OpenAI and Pinecone clients of the user
+func newClients(user User) (*openai.Client, *pineconeIndex) {
+	pineconeIndex := newPineconeIndex(user.PineconeApiKey, user.PineconeIndex, user.PineconeProjectName, user.PineconeEnvironment)
+	return newOpenAIClient(user.OpenAIApiKey), pineconeIndex
+}
+
+func GetSessionWithoutPermanance(ctx context.Context, user User) (*session, error) {
+	s := newSession(user, defaultSessionSettings)
+	if err := s.ValidateCredentials(ctx); err != nil {
 		return nil, err
 	}
 
+	s.reqMu.Lock()
 	s.req = openai.ChatCompletionRequest{
-		Model:     openai.GPT3Dot5Turbo0613,
+		Model:     s.settings.chatModel,
 		Messages:  []openai.ChatCompletionMessage{},
 		Stream:    true,
 		Functions: function_call_defintions(),
 	}
+	s.reqMu.Unlock()
 	return s, nil
 
 }
 
 // GetSession will see if a session exists, if so return it, otherwise it will validate the credentials in the passed
 // in user object (credentials for pinecone and openai) and then create a session and return it.
-func GetSession(user User) (*session, error) {
+func GetSession(ctx context.Context, user User) (*session, error) {
 	sessionsMutex.Lock()
 	s, ok := sessions[user.Uid]
 	sessionsMutex.Unlock()
 	if ok {
 		return s, nil
 	}
-	s = &session{
-		user: user,
-	}
-	pineconeIndex, _ := pinecone.NewIndexClient(
-		pinecone.WithIndexName(user.PineconeIndex),
-		pinecone.WithAPIKey(user.PineconeApiKey),
-		pinecone.WithEnvironment(user.PineconeEnvironment),
-		pinecone.WithProjectName(user.PineconeProjectName),
-	)
-	s.chatClient = openai.NewClient(user.OpenAIApiKey)
-	s.index = pineconeIndex
+	s = newSession(user, defaultSessionSettings)
 
 	sessionsMutex.Lock()
 	sessions[user.Uid] = s
 	sessionsMutex.Unlock()
 
-	if err := s.ValidateCredentials(); err != nil {
+	if err := s.ValidateCredentials(ctx); err != nil {
 		return nil, err
 	}
 
+	s.reqMu.Lock()
 	s.req = openai.ChatCompletionRequest{
-		Model:     openai.GPT3Dot5Turbo0613,
+		Model:     s.settings.chatModel,
 		Messages:  []openai.ChatCompletionMessage{},
 		Functions: function_call_defintions(),
 	}
+	s.reqMu.Unlock()
 	return s, nil
 }
 
 // ValidateCredentials will check to see if the Pinecone credentials and the OpenAI credentials are invalid
-func (s *session) ValidateCredentials() error {
-	_, err := s.chatClient.ListModels(context.Background())
+func (s *session) ValidateCredentials(ctx context.Context) error {
+	chatClient, index := s.clients()
+	return validateClients(ctx, s.uid(), chatClient, index)
+}
+
+func validateClients(ctx context.Context, uid string, chatClient *openai.Client, index *pineconeIndex) error {
+	_, err := chatClient.ListModels(ctx)
 	if err != nil {
-		log.Error().
+		log.Ctx(ctx).Error().
 			Err(err).
-			Str("User", s.user.Uid).
+			Str("User", uid).
 			Msg("Invalid OpenAI Token")
 		return errors.New("Invalid OpenAI API Key")
 	}
 
 	// validate credentials
-	_, err = s.index.DescribeIndexStats(context.Background(), pinecone.DescribeIndexStatsParams{})
+	_, err = index.DescribeIndexStats(ctx, pinecone.DescribeIndexStatsParams{})
 	if err != nil {
-		s.userMu.RLock()
-		log.Error().
+		log.Ctx(ctx).Error().
 			Err(err).
-			Str("User", s.user.Uid).
+			Str("User", uid).
 			Msg("Invalaid Pinecone Credentials")
-		s.userMu.RUnlock()
 		return errors.New("Invalid Pinecone Credentials")
 	}
 	return nil
 }
 
+// clients returns the current OpenAI and Pinecone clients, they are replaced when the user changes their credentials
+func (s *session) clients() (*openai.Client, *pineconeIndex) {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+	return s.chatClient, s.index
+}
+
+// configChanges returns a channel that is closed the next time the settings of the session change
+func (s *session) configChanges() <-chan struct{} {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+	return s.configChanged
+}
+
+// reconfigure applies new settings of the user to the session. If the credentials or the index changed, new clients
+// are built and validated before they replace the old ones, and the notes remembered from the old index are dropped.
+// Streams that are running are told through configChanges, they finish on the clients they started with.
+func (s *session) reconfigure(ctx context.Context, user User) error {
+	s.userMu.RLock()
+	old := s.user
+	s.userMu.RUnlock()
+
+	indexChanged := old.PineconeApiKey != user.PineconeApiKey ||
+		old.PineconeIndex != user.PineconeIndex ||
+		old.PineconeEnvironment != user.PineconeEnvironment ||
+		old.PineconeProjectName != user.PineconeProjectName
+	if !indexChanged && old.OpenAIApiKey == user.OpenAIApiKey {
+		s.setUser(user)
+		return nil
+	}
+
+	chatClient, index := newClients(user)
+	if err := validateClients(ctx, user.Uid, chatClient, index); err != nil {
+		return err
+	}
+	s.userMu.Lock()
+	s.user = user
+	s.chatClient = chatClient
+	s.index = index
+	changed := s.configChanged
+	s.configChanged = make(chan struct{})
+	s.userMu.Unlock()
+
+	if indexChanged {
+		s.recentNotesMu.Lock()
+		s.recentNotes = nil
+		s.recentNotesMu.Unlock()
+	}
+	close(changed)
+	return nil
+}
+
+// RemoveSession drops the session of the user, the next request builds a new one from the stored user
+func RemoveSession(uid string) {
+	sessionsMutex.Lock()
+	delete(sessions, uid)
+	sessionsMutex.Unlock()
+}
+
+// reconfigureSession applies new settings to the live session of the user if they have one. A session whose new
+// credentials don't work is removed, so the next request reports the invalid credentials instead of using the old ones.
+func reconfigureSession(ctx context.Context, user User) {
+	sess := GetSessionIfExists(user.Uid)
+	if sess == nil {
+		return
+	}
+	if err := sess.reconfigure(ctx, user); err != nil {
+		log.Ctx(ctx).Warn().
+			Err(err).
+			Str("User", user.Uid).
+			Msg("New credentials are invalid, removing session")
+		RemoveSession(user.Uid)
+	}
+}
+
+// searchScope returns the indexes the conversation searches
+func (s *session) searchScope() searchScope {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+	return s.scope
+}
+
+// setSearchScope picks the indexes the conversation searches from now on
+func (s *session) setSearchScope(scope searchScope) {
+	s.updateSearchScope(func(searchScope) searchScope {
+		return scope
+	})
+}
+
+// updateSearchScope replaces the scope with what update returns, the scope can't change in between
+func (s *session) updateSearchScope(update func(searchScope) searchScope) {
+	s.userMu.Lock()
+	s.scope = update(s.scope)
+	s.userMu.Unlock()
+}
+
+// setUser replaces the user of the session after their settings changed
+func (s *session) setUser(user User) {
+	s.userMu.Lock()
+	s.user = user
+	s.userMu.Unlock()
+}
+
+// uid returns the uid of the sessions user
+func (s *session) uid() string {
+	s.userMu.RLock()
+	defer s.userMu.RUnlock()
+	return s.user.Uid
+}
+
 func RemoveIndex(s []openai.ChatCompletionMessage, index int) []openai.ChatCompletionMessage {
 	return append(s[:index], s[index+1:]...)
 }
 
 // Message will send a message to the chatbot with the context
-func (s *session) Message(message string) (string, error) {
-	fmt.Println(message)
-	fmt.Println("MESSAGE^^^")
-	s.updateTimer()
-	if s.charLength+len(message) > 4097 {
-		s.charLength -= len(s.req.Messages[0].Content)
-		s.req.Messages = RemoveIndex(s.req.Messages, 0)
+func (s *session) Message(ctx context.Context, message string) (string, error) {
+	uid := s.uid()
+	if err := checkQuota(ctx, uid); err != nil {
+		return "", err
 	}
-	s.req.Messages = append(s.req.Messages, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
-		Content: message,
-	})
-	resp, err := s.chatClient.CreateChatCompletion(context.Background(), s.req)
+	s.updateTimer()
+	req := s.addUserMessage(message)
+	chatClient, _ := s.clients()
+	chatCtx, span := startChatSpan(ctx, req, false)
+	resp, err := chatClient.CreateChatCompletion(chatCtx, req)
+	endChatSpan(span, chatUsage(resp.Usage), err)
 	if err != nil {
-		fmt.Println("Why Here")
 		return "", err
 	}
+	recordUsage(ctx, uid, chatUsage(resp.Usage))
 	call := resp.Choices[0].Message.FunctionCall
 	if call != nil {
 		switch call.Name {
 		case "query_notes":
 			// query our notes for information
-			response := s.queryNotes(call.Arguments)
-			fmt.Println("resp")
-			fmt.Println(response)
-			s.req.Messages = append(s.req.Messages, resp.Choices[0].Message)
-			s.req.Messages = append(s.req.Messages, openai.ChatCompletionMessage{
+			response := s.queryNotes(ctx, call.Arguments)
+			req = s.addMessages(resp.Choices[0].Message, openai.ChatCompletionMessage{
 				Role:    openai.ChatMessageRoleFunction,
 				Name:    QueryNotesName,
 				Content: response,
 			})
-			resp, err = s.chatClient.CreateChatCompletion(context.Background(), s.req)
+			chatCtx, span := startChatSpan(ctx, req, false)
+			resp, err = chatClient.CreateChatCompletion(chatCtx, req)
+			endChatSpan(span, chatUsage(resp.Usage), err)
 			if err != nil {
-				fmt.Println("here is a joke")
 				return "", err
 			}
+			recordUsage(ctx, uid, chatUsage(resp.Usage))
 		}
 	}
-	s.req.Messages = append(s.req.Messages, resp.Choices[0].Message)
+	s.addMessages(resp.Choices[0].Message)
 	return resp.Choices[0].Message.Content, nil
 }
 
 // queryNotes will query embed the query and use the embedding to query pinecone and get the content and return it
-func (s *session) queryNotes(query string) string {
-	fmt.Println("queyr Notes")
+func (s *session) queryNotes(ctx context.Context, query string) string {
+	return s.queryNotesIn(ctx, s.searchScope(), query)
+}
+
+// invalidQueryResult is what query_notes returns to the model when its arguments aren't a QueryRequest, so it can call
+// the tool again instead of answering as if nothing was found
+const invalidQueryResult = `{"error":"invalid_query","message":"The arguments must be a JSON object with a non empty \"queries\" array of strings. Call query_notes again with valid arguments."}`
+
+// queryNotesIn is queryNotes searching the indexes of scope instead of the ones picked for the conversation
+func (s *session) queryNotesIn(ctx context.Context, scope searchScope, query string) string {
+	toolCalls.Inc(QueryNotesName)
 	var request QueryRequest
-	if err := json.Unmarshal([]byte(query), &request); err != nil {
-		// we're going to keep this specific log because it's important for bug testing and logging in the future
-		s.userMu.RLock()
-		log.Error().
+	err := json.Unmarshal([]byte(query), &request)
+	if err == nil && len(request.Queries) == 0 {
+		err = errors.New("no queries")
+	}
+	if err != nil {
+		// the arguments are the question of the user, only their length is logged
+		log.Ctx(ctx).Error().
 			Err(err).
-			Str("User", s.user.Uid).
-			Str("Content", query).
+			Str("User", s.uid()).
+			Int("Length", len(query)).
 			Msg("Invalid json data trying to unmarshal in QueryRequest")
-		s.userMu.RUnlock()
-		return ""
+		return invalidQueryResult
 	}
 
-	queries := request.Queries
+	resp, err := s.searchNotesIn(ctx, scope, request.Queries)
+	if err != nil {
+		log.Ctx(ctx).Error().
+			Err(err).
+			Str("User", s.uid()).
+			Msg("Unable to search notes")
+		return notesUnavailableResult
+	}
+	data, _ := json.Marshal(resp)
+	return string(data)
+}
+
+// searchNotes embeds every query and returns the notes closest to each of them in the indexes the conversation searches
+func (s *session) searchNotes(ctx context.Context, queries []string) (QueryResponse, error) {
+	return s.searchNotesIn(ctx, s.searchScope(), queries)
+}
+
+// searchNotesIn embeds every query and returns the notes closest to each of them in the indexes of scope. The matches
+// of every index are ranked together by score and cut to the largest TopK of the searched indexes, so adding a
+// workspace doesn't multiply how many notes end up in the context. If any index can't be searched the error wraps
+// errNotesUnavailable, an empty result always means there were no matches.
+func (s *session) searchNotesIn(ctx context.Context, scope searchScope, queries []string) (resp QueryResponse, err error) {
+	ctx, span := tracer.Start(ctx, "notes.search", trace.WithAttributes(
+		attribute.Int("opennote.queries", len(queries)),
+		attribute.Bool("opennote.personal", scope.personal),
+		attribute.Int("opennote.workspaces", len(scope.workspaces)),
+	))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	uid := s.uid()
+	chatClient, index := s.clients()
+	embeddings, usage, err := openaiEmbedding(ctx, chatClient, s.settings.embeddingModel, uid, queries)
+	if err != nil {
+		return QueryResponse{}, fmt.Errorf("%w: %w", errNotesUnavailable, err)
+	}
+	recordUsage(ctx, uid, usage)
 
 	s.userMu.RLock()
-	embeddings, err := ada002Embeddings(s.chatClient, s.user.Uid, queries)
+	topK := s.user.TopK
 	s.userMu.RUnlock()
 
-	if err != nil {
-		return ""
+	limit := int64(0)
+	if scope.personal {
+		limit = topK
 	}
+	for _, workspace := range scope.workspaces {
+		if workspace.topK > limit {
+			limit = workspace.topK
+		}
+	}
+
+	span.SetAttributes(attribute.Int64("opennote.top_k", limit))
 
 	// handle the response
-	resp := QueryResponse{}
+	resp = QueryResponse{}
 	for i, embedding := range embeddings {
-		s.userMu.RLock()
-		content := queryPinecone(s.index, s.user.TopK, embedding)
-		s.userMu.RUnlock()
+		var matches []noteMatch
+		if scope.personal {
+			if matches, err = queryPineconeMatches(ctx, index, topK, embedding); err != nil {
+				return QueryResponse{}, fmt.Errorf("%w: %w", errNotesUnavailable, err)
+			}
+		}
+		for _, workspace := range scope.workspaces {
+			workspaceMatches, err := queryPineconeMatches(ctx, workspace.index, workspace.topK, embedding)
+			if err != nil {
+				return QueryResponse{}, fmt.Errorf("%w: workspace %s: %w", errNotesUnavailable, workspace.id, err)
+			}
+			for _, match := range workspaceMatches {
+				match.Workspace = workspace.id
+				matches = append(matches, match)
+			}
+		}
+		if len(scope.workspaces) > 0 {
+			sort.SliceStable(matches, func(i, j int) bool {
+				return matches[i].Score > matches[j].Score
+			})
+			if limit > 0 && int64(len(matches)) > limit {
+				matches = matches[:limit]
+			}
+		}
+		s.rememberNotes(matches)
+
+		var content []string
+		for _, match := range matches {
+			content = append(content, match.Content)
+		}
 		resp.Results = append(resp.Results, QueryResult{
 			Query:  queries[i],
 			Result: content,
 		})
 	}
-	data, _ := json.Marshal(resp)
-	return string(data)
+	return resp, nil
 }
 
-type ClientChan chan string
+// rememberNotes adds notes to the recent notes, a note that is already remembered moves to the end
+func (s *session) rememberNotes(notes []noteMatch) {
+	s.recentNotesMu.Lock()
+	defer s.recentNotesMu.Unlock()
+	for _, note := range notes {
+		for i, recent := range s.recentNotes {
+			if recent.Id == note.Id && recent.Workspace == note.Workspace {
+				s.recentNotes = append(s.recentNotes[:i], s.recentNotes[i+1:]...)
+				break
+			}
+		}
+		s.recentNotes = append(s.recentNotes, note)
+	}
+	if len(s.recentNotes) > maxRecentNotes {
+		s.recentNotes = s.recentNotes[len(s.recentNotes)-maxRecentNotes:]
+	}
+}
 
-// Message will send a message to the chatbot with the context
-func (s *session) Message2(message string, c *gin.Context) (string, error) {
-	fmt.Println("WE DOING IT")
-	s.updateTimer()
-	if s.charLength+len(message) > 4097 {
+// notes returns a copy of the recent notes
+func (s *session) notes() []noteMatch {
+	s.recentNotesMu.Lock()
+	defer s.recentNotesMu.Unlock()
+	return append([]noteMatch{}, s.recentNotes...)
+}
+
+// addUserMessage appends the message of the user to the conversation, dropping the oldest message if the conversation
+// gets too long, and returns a copy of the request with it
+func (s *session) addUserMessage(message string) openai.ChatCompletionRequest {
+	s.reqMu.Lock()
+	if s.charLength+len(message) > s.settings.maxConversationChars && len(s.req.Messages) > 0 {
 		s.charLength -= len(s.req.Messages[0].Content)
 		s.req.Messages = RemoveIndex(s.req.Messages, 0)
 	}
-	s.req.Messages = append(s.req.Messages, openai.ChatCompletionMessage{
+	s.reqMu.Unlock()
+	return s.addMessages(openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleUser,
 		Content: message,
 	})
-	stream, err := s.chatClient.CreateChatCompletionStream(context.Background(), s.req)
+}
+
+// addMessages appends the messages to the conversation and returns a copy of the request with them
+func (s *session) addMessages(messages ...openai.ChatCompletionMessage) openai.ChatCompletionRequest {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	s.req.Messages = append(s.req.Messages, messages...)
+	req := s.req
+	req.Messages = append([]openai.ChatCompletionMessage{}, s.req.Messages...)
+	return req
+}
+
+// conversation returns a copy of the messages of the conversation without the system prompt
+func (s *session) conversation() []openai.ChatCompletionMessage {
+	s.reqMu.Lock()
+	defer s.reqMu.Unlock()
+	messages := []openai.ChatCompletionMessage{}
+	for _, message := range s.req.Messages {
+		if message.Role == openai.ChatMessageRoleSystem {
+			continue
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+type ClientChan chan string
+
+// Message will send a message to the chatbot with the context
+func (s *session) Message2(message string, c *gin.Context) (string, error) {
+	ctx := c.Request.Context()
+	uid := s.uid()
+	if err := checkQuota(ctx, uid); err != nil {
+		return "", err
+	}
+	s.updateTimer()
+	req := s.addUserMessage(message)
+	chatClient, _ := s.clients()
+	configChanged := s.configChanges()
+	chatCtx, span := startChatSpan(ctx, req, true)
+	stream, err := chatClient.CreateChatCompletionStream(chatCtx, req)
 	if err != nil {
-		fmt.Println("Why Here")
+		endSpan(span, err)
 		return "", err
 	}
 	defer stream.Close()
+	// streamed completions don't report their usage, so it's estimated from the request and what was streamed back
+	usage := tokenUsage{PromptTokens: estimatePromptTokens(req)}
+	// every stream has its own span, spanStart is the usage before the stream of the current span started
+	spanStart := tokenUsage{}
+	endStreamSpan := func(err error) {
+		streamUsage := tokenUsage{
+			PromptTokens:     usage.PromptTokens - spanStart.PromptTokens,
+			CompletionTokens: usage.CompletionTokens - spanStart.CompletionTokens,
+		}
+		streamUsage.Estimated = streamUsage.total()
+		endChatSpan(span, streamUsage, err)
+	}
 	charComp := openai.ChatCompletionMessage{
 		Role:    openai.ChatMessageRoleAssistant,
 		Content: "",
@@ -274,17 +601,32 @@ func (s *session) Message2(message string, c *gin.Context) (string, error) {
 			}
 
 			if err != nil {
-				fmt.Printf("Stream error: %v\n", err)
+				endStreamSpan(err)
+				log.Ctx(ctx).Error().
+					Err(err).
+					Str("User", uid).
+					Msg("Chat stream failed")
 				return false
 			}
+			select {
+			case <-configChanged:
+				// the rest of the answer still comes from the old settings, the next message uses the new ones
+				c.SSEvent("config", "changed")
+				c.Writer.Flush()
+				configChanged = nil
+			default:
+			}
 			call := resp.Choices[0].Delta.FunctionCall
 			if resp.Choices[0].Delta.Content != "" {
 				c.SSEvent("message", resp.Choices[0].Delta.Content)
 				c.Writer.Flush()
 				charComp.Content += resp.Choices[0].Delta.Content
-				fmt.Println(resp.Choices[0].Delta.Content)
+				tokens := estimateTokens(resp.Choices[0].Delta.Content)
+				usage.CompletionTokens += tokens
+				streamedTokens.Add(float64(tokens))
 			}
 			if call != nil {
+				usage.CompletionTokens += estimateTokens(call.Arguments)
 				callArgs += call.Arguments
 				if callName == "" {
 					callName = call.Name
@@ -293,24 +635,35 @@ func (s *session) Message2(message string, c *gin.Context) (string, error) {
 			if resp.Choices[0].FinishReason == openai.FinishReasonFunctionCall {
 				switch callName {
 				case "query_notes":
-					fmt.Println("here reached")
 					// query our notes for information
-					response := s.queryNotes(callArgs)
-					s.req.Messages = append(s.req.Messages, openai.ChatCompletionMessage{
+					response := s.queryNotes(ctx, callArgs)
+					req = s.addMessages(openai.ChatCompletionMessage{
 						Role:    openai.ChatMessageRoleFunction,
 						Name:    QueryNotesName,
 						Content: response,
 					})
-					stream, err = s.chatClient.CreateChatCompletionStream(context.Background(), s.req)
+					endStreamSpan(nil)
+					spanStart = usage
+					chatCtx, span = startChatSpan(ctx, req, true)
+					stream, err = chatClient.CreateChatCompletionStream(chatCtx, req)
 					if err != nil {
-						fmt.Println("here is a joke")
+						endStreamSpan(err)
+						log.Ctx(ctx).Error().
+							Err(err).
+							Str("User", uid).
+							Msg("Unable to continue chat stream after query_notes")
 						return false
 					}
+					usage.PromptTokens += estimatePromptTokens(req)
 				}
 			}
 		}
 		return false
 	})
-	s.req.Messages = append(s.req.Messages, charComp)
+	// ending a span twice does nothing, so this only ends the span of a stream that ran to the end
+	endStreamSpan(nil)
+	usage.Estimated = usage.PromptTokens + usage.CompletionTokens
+	recordUsage(ctx, uid, usage)
+	s.addMessages(charComp)
 	return charComp.Content, nil
 }
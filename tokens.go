@@ -0,0 +1,292 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"time"
+)
+
+const (
+	// accessTokenPrefix marks personal access tokens so the auth middleware can tell them apart from firebase ID tokens
+	accessTokenPrefix = "onp_"
+	// accessTokenLastUsedInterval limits how often the last used time of a token is written to firestore
+	accessTokenLastUsedInterval = time.Minute
+)
+
+// Scopes that can be granted to a personal access token
+const (
+	ScopeChat         = "chat"
+	ScopeReadSettings = "read-settings"
+	ScopeQuery        = "query"
+)
+
+var accessTokenScopes = []string{ScopeChat, ScopeReadSettings, ScopeQuery}
+
+var errAccessTokenExpired = errors.New("access token expired")
+
+// accessTokenRecord is how a personal access token is stored in firestore, the document id is the sha256 of the token
+// so the token itself is never stored.
+type accessTokenRecord struct {
+	Uid        string
+	Name       string
+	Scopes     []string
+	Hint       string
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+	LastUsedAt time.Time
+}
+
+func (r accessTokenRecord) hasScope(scope string) bool {
+	for _, s := range r.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (r accessTokenRecord) expired() bool {
+	return !r.ExpiresAt.IsZero() && time.Now().After(r.ExpiresAt)
+}
+
+// AccessTokenInfo is the description of a token returned by the api, it never contains the token itself.
+type AccessTokenInfo struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	Hint       string     `json:"hint"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func (r accessTokenRecord) info(id string) AccessTokenInfo {
+	info := AccessTokenInfo{
+		Id:        id,
+		Name:      r.Name,
+		Scopes:    r.Scopes,
+		Hint:      r.Hint,
+		CreatedAt: r.CreatedAt,
+	}
+	if !r.ExpiresAt.IsZero() {
+		info.ExpiresAt = &r.ExpiresAt
+	}
+	if !r.LastUsedAt.IsZero() {
+		info.LastUsedAt = &r.LastUsedAt
+	}
+	return info
+}
+
+// hashAccessToken returns the id the token is stored under
+func hashAccessToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAccessToken generates a random token
+func newAccessToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return accessTokenPrefix + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// lookupAccessToken finds the record of a token and bumps its last used time
+func lookupAccessToken(ctx context.Context, token string) (accessTokenRecord, error) {
+	if firestoreClient == nil {
+		return accessTokenRecord{}, errFirestoreDisabled
+	}
+	doc, err := firestoreClient.Collection("tokens").Doc(hashAccessToken(token)).Get(ctx)
+	if err != nil {
+		return accessTokenRecord{}, err
+	}
+	var record accessTokenRecord
+	if err := doc.DataTo(&record); err != nil {
+		return accessTokenRecord{}, err
+	}
+	if record.expired() {
+		return accessTokenRecord{}, errAccessTokenExpired
+	}
+
+	if time.Since(record.LastUsedAt) > accessTokenLastUsedInterval {
+		now := time.Now()
+		_, err = doc.Ref.Update(ctx, []firestore.Update{{Path: "LastUsedAt", Value: now}})
+		if err != nil {
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("User", record.Uid).
+				Msg("Unable to update access token last used time")
+		}
+		record.LastUsedAt = now
+	}
+	return record, nil
+}
+
+// CreateTokenRequest is the request sent to /api/createToken.
+type CreateTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInDays is how long the token is valid for, 0 means it never expires
+	ExpiresInDays int `json:"expires_in_days"`
+}
+
+// CreateTokenResponse is the response of /api/createToken, this is the only time the token is ever shown.
+type CreateTokenResponse struct {
+	Token string          `json:"token"`
+	Info  AccessTokenInfo `json:"info"`
+}
+
+// createTokenEndpoint is the endpoint at /api/createToken, it creates a personal access token for the plugin and scripts
+func createTokenEndpoint(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	var request CreateTokenRequest
+	if err := c.BindJSON(&request); err != nil || request.Name == "" || len(request.Scopes) == 0 || request.ExpiresInDays < 0 {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	for _, scope := range request.Scopes {
+		if !validScope(scope) {
+			c.JSON(http.StatusBadRequest, RequestErrorResult{
+				ErrorCode: InvalidRequestContent,
+				Content:   "Unknown scope " + scope,
+			})
+			return
+		}
+	}
+
+	token, err := newAccessToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to generate token",
+		})
+		return
+	}
+	record := accessTokenRecord{
+		Uid:       authenticatedUid(c),
+		Name:      request.Name,
+		Scopes:    request.Scopes,
+		Hint:      token[:len(accessTokenPrefix)+4] + "...",
+		CreatedAt: time.Now(),
+	}
+	if request.ExpiresInDays > 0 {
+		record.ExpiresAt = record.CreatedAt.AddDate(0, 0, request.ExpiresInDays)
+	}
+
+	id := hashAccessToken(token)
+	if _, err = firestoreClient.Collection("tokens").Doc(id).Create(c.Request.Context(), record); err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", record.Uid).
+			Msg("Unable to store access token")
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to upload document to firestore",
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, CreateTokenResponse{
+		Token: token,
+		Info:  record.info(id),
+	})
+}
+
+// listTokensEndpoint is the endpoint at /api/listTokens, it lists the access tokens of the user
+func listTokensEndpoint(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	infos, err := listAccessTokens(c.Request.Context(), authenticatedUid(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to list tokens",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, infos)
+}
+
+// listAccessTokens returns the access tokens of the user
+func listAccessTokens(ctx context.Context, uid string) ([]AccessTokenInfo, error) {
+	docs, err := firestoreClient.Collection("tokens").Where("Uid", "==", uid).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	infos := []AccessTokenInfo{}
+	for _, doc := range docs {
+		var record accessTokenRecord
+		if err := doc.DataTo(&record); err != nil {
+			continue
+		}
+		infos = append(infos, record.info(doc.Ref.ID))
+	}
+	return infos, nil
+}
+
+// revokeAccessTokens deletes every access token of the user
+func revokeAccessTokens(ctx context.Context, uid string) error {
+	return deleteWhere(ctx, "tokens", "Uid", uid)
+}
+
+// RevokeTokenRequest is the request sent to /api/revokeToken.
+type RevokeTokenRequest struct {
+	Id string `json:"id"`
+}
+
+// revokeTokenEndpoint is the endpoint at /api/revokeToken, it deletes an access token of the user
+func revokeTokenEndpoint(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	var request RevokeTokenRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	ref := firestoreClient.Collection("tokens").Doc(request.Id)
+	doc, err := ref.Get(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Token does not exist",
+		})
+		return
+	}
+	var record accessTokenRecord
+	if err := doc.DataTo(&record); err != nil || record.Uid != authenticatedUid(c) {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Token does not exist",
+		})
+		return
+	}
+	if _, err = ref.Delete(c.Request.Context()); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to delete token",
+		})
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func validScope(scope string) bool {
+	for _, s := range accessTokenScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
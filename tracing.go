@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"net/url"
+)
+
+// tracer starts every span of the server, it does nothing until tracingSetup installs a provider
+var tracer = otel.Tracer("github.com/abimek/opennote")
+
+// tracingSetup installs the W3C trace context propagator and, if a collector is configured, a provider that exports to
+// it. The returned function flushes the spans that weren't exported yet.
+func tracingSetup(conf config.Tracing) func(context.Context) error {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if conf.Endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+	endpoint, err := url.Parse(conf.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		log.Fatal().
+			Str("Endpoint", conf.Endpoint).
+			Msg("The tracing endpoint must be a url like http://localhost:4318/v1/traces")
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(endpoint.Host),
+		otlptracehttp.WithHeaders(conf.Headers),
+	}
+	if endpoint.Path != "" {
+		options = append(options, otlptracehttp.WithURLPath(endpoint.Path))
+	}
+	if endpoint.Scheme == "http" {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	// the exporter doesn't connect until the first export, so this only fails on invalid options
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("Unable to create the trace exporter")
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		log.Warn().
+			Err(err).
+			Msg("Unable to export traces")
+	}))
+	// callers can continue their trace through traceparent, but whether it's kept is always up to SampleRatio, a
+	// caller setting the sampled flag on every request mustn't be able to make the server export all its traces
+	sampler := sdktrace.TraceIDRatioBased(conf.SampleRatio)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(conf.ServiceName))),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler,
+			sdktrace.WithRemoteParentSampled(sampler),
+			sdktrace.WithRemoteParentNotSampled(sampler),
+		)),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown
+}
+
+// traceRequests starts the server span of every request, continuing the trace of the caller if it sent a traceparent.
+// The trace id is added to the logger of the request so logs and traces can be matched.
+func traceRequests(c *gin.Context) {
+	ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+	route := c.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	ctx, span := tracer.Start(ctx, c.Request.Method+" "+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(c.Request.Method),
+			semconv.HTTPRouteKey.String(route),
+		),
+	)
+	defer span.End()
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger := log.Ctx(ctx).With().Str("TraceId", sc.TraceID().String()).Logger()
+		ctx = logger.WithContext(ctx)
+	}
+	c.Request = c.Request.WithContext(ctx)
+	c.Next()
+
+	status := c.Writer.Status()
+	span.SetAttributes(semconv.HTTPStatusCodeKey.Int(status))
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+}
+
+// endSpan records err on the span if there is one and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// startFirestoreSpan starts the span of a firestore operation
+func startFirestoreSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "firestore."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemKey.String("firestore"),
+			semconv.DBOperationKey.String(operation),
+		),
+	)
+}
+
+// startChatSpan starts the span of a chat completion call to OpenAI
+func startChatSpan(ctx context.Context, req openai.ChatCompletionRequest, stream bool) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "openai.chat",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("llm.model", req.Model),
+			attribute.Int("llm.messages", len(req.Messages)),
+			attribute.Bool("llm.stream", stream),
+		),
+	)
+}
+
+// endChatSpan adds the tokens the call used to the span and ends it, the tokens of streams are estimates
+func endChatSpan(span trace.Span, usage tokenUsage, err error) {
+	span.SetAttributes(
+		attribute.Int64("llm.usage.prompt_tokens", usage.PromptTokens),
+		attribute.Int64("llm.usage.completion_tokens", usage.CompletionTokens),
+		attribute.Bool("llm.usage.estimated", usage.Estimated > 0),
+	)
+	endSpan(span, err)
+}
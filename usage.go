@@ -0,0 +1,318 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/sashabaranov/go-openai"
+	"go.opentelemetry.io/otel/attribute"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	dayLayout   = "2006-01-02"
+	monthLayout = "2006-01"
+)
+
+var (
+	dailyTokenLimit   int64
+	monthlyTokenLimit int64
+)
+
+var (
+	errDailyQuotaExceeded   = errors.New("daily token quota exceeded")
+	errMonthlyQuotaExceeded = errors.New("monthly token quota exceeded")
+)
+
+// tokenUsage is the number of tokens used by one or more OpenAI calls. Streamed chat completions don't report usage so
+// they are estimated, Estimated counts how many of the tokens are estimates.
+type tokenUsage struct {
+	PromptTokens     int64
+	CompletionTokens int64
+	EmbeddingTokens  int64
+	Estimated        int64
+}
+
+func (u tokenUsage) total() int64 {
+	return u.PromptTokens + u.CompletionTokens + u.EmbeddingTokens
+}
+
+// usageRecord is the aggregated usage of a user for a period, a day ("2006-01-02") or a month ("2006-01"). They're
+// stored at usage/{uid}_{period}.
+type usageRecord struct {
+	Uid              string
+	Period           string
+	PromptTokens     int64
+	CompletionTokens int64
+	EmbeddingTokens  int64
+	Estimated        int64
+}
+
+func (r usageRecord) total() int64 {
+	return r.PromptTokens + r.CompletionTokens + r.EmbeddingTokens
+}
+
+// chatUsage converts the usage reported for a chat completion
+func chatUsage(usage openai.Usage) tokenUsage {
+	return tokenUsage{
+		PromptTokens:     int64(usage.PromptTokens),
+		CompletionTokens: int64(usage.CompletionTokens),
+	}
+}
+
+// estimateTokens estimates the tokens in text with the usual 4 characters per token rule
+func estimateTokens(text string) int64 {
+	return int64(len(text)+3) / 4
+}
+
+// estimatePromptTokens estimates the prompt tokens of a chat request, it is used for streamed completions
+func estimatePromptTokens(req openai.ChatCompletionRequest) int64 {
+	var tokens int64
+	for _, message := range req.Messages {
+		// every message has a few tokens of overhead for the role and separators
+		tokens += 4 + estimateTokens(message.Content)
+		if message.FunctionCall != nil {
+			tokens += estimateTokens(message.FunctionCall.Name + message.FunctionCall.Arguments)
+		}
+	}
+	for _, function := range req.Functions {
+		tokens += estimateTokens(function.Name + function.Description)
+	}
+	return tokens
+}
+
+func usageDoc(uid string, period string) *firestore.DocumentRef {
+	return firestoreClient.Collection("usage").Doc(uid + "_" + period)
+}
+
+// recordUsage adds the usage to the daily and monthly totals of the user
+func recordUsage(ctx context.Context, uid string, usage tokenUsage) {
+	if usage.total() == 0 || firestoreClient == nil {
+		return
+	}
+	// the write isn't tied to the request, usage is recorded even if the client is gone
+	_, span := startFirestoreSpan(ctx, "record_usage")
+	defer span.End()
+	now := time.Now().UTC()
+	for _, period := range []string{now.Format(dayLayout), now.Format(monthLayout)} {
+		_, err := usageDoc(uid, period).Set(context.Background(), map[string]interface{}{
+			"Uid":              uid,
+			"Period":           period,
+			"PromptTokens":     firestore.Increment(usage.PromptTokens),
+			"CompletionTokens": firestore.Increment(usage.CompletionTokens),
+			"EmbeddingTokens":  firestore.Increment(usage.EmbeddingTokens),
+			"Estimated":        firestore.Increment(usage.Estimated),
+		}, firestore.MergeAll)
+		if err != nil {
+			span.RecordError(err)
+			log.Ctx(ctx).Error().
+				Err(err).
+				Str("User", uid).
+				Str("Period", period).
+				Msg("Unable to record token usage")
+		}
+	}
+}
+
+// getUsage returns the usage of the user for a period, periods without usage return an empty record
+func getUsage(uid string, period string) (usageRecord, error) {
+	doc, err := usageDoc(uid, period).Get(context.Background())
+	if err != nil {
+		if doc != nil && !doc.Exists() {
+			return usageRecord{Uid: uid, Period: period}, nil
+		}
+		return usageRecord{}, err
+	}
+	var record usageRecord
+	if err := doc.DataTo(&record); err != nil {
+		return usageRecord{}, err
+	}
+	return record, nil
+}
+
+// listUsage returns every daily and monthly usage record of the user
+func listUsage(ctx context.Context, uid string) ([]UsagePeriod, error) {
+	docs, err := firestoreClient.Collection("usage").Where("Uid", "==", uid).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	periods := []UsagePeriod{}
+	for _, doc := range docs {
+		var record usageRecord
+		if err := doc.DataTo(&record); err != nil {
+			continue
+		}
+		periods = append(periods, record.period())
+	}
+	return periods, nil
+}
+
+// usageReport returns the usage of every user in the period, a day or a month, the heaviest users first
+func usageReport(ctx context.Context, period string) ([]usageRecord, error) {
+	docs, err := firestoreClient.Collection("usage").Where("Period", "==", period).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]usageRecord, 0, len(docs))
+	for _, doc := range docs {
+		var record usageRecord
+		if err := doc.DataTo(&record); err != nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].total() != records[j].total() {
+			return records[i].total() > records[j].total()
+		}
+		return records[i].Uid < records[j].Uid
+	})
+	return records, nil
+}
+
+// deleteUsage removes the usage records of the user
+func deleteUsage(ctx context.Context, uid string) error {
+	return deleteWhere(ctx, "usage", "Uid", uid)
+}
+
+// checkQuota returns an error if the user used up their daily or monthly tokens, it is called before every call to
+// OpenAI that is made on behalf of the user. Usage is kept in firestore, so servers without it have no quotas.
+func checkQuota(ctx context.Context, uid string) (err error) {
+	if dailyTokenLimit <= 0 && monthlyTokenLimit <= 0 || firestoreClient == nil {
+		return nil
+	}
+	_, span := startFirestoreSpan(ctx, "check_quota")
+	defer func() {
+		if isQuotaError(err) {
+			span.SetAttributes(attribute.Bool("opennote.quota_exceeded", true))
+			span.End()
+			return
+		}
+		endSpan(span, err)
+	}()
+	now := time.Now().UTC()
+	if dailyTokenLimit > 0 {
+		day, err := getUsage(uid, now.Format(dayLayout))
+		if err != nil {
+			return err
+		}
+		if day.total() >= dailyTokenLimit {
+			return errDailyQuotaExceeded
+		}
+	}
+	if monthlyTokenLimit > 0 {
+		month, err := getUsage(uid, now.Format(monthLayout))
+		if err != nil {
+			return err
+		}
+		if month.total() >= monthlyTokenLimit {
+			return errMonthlyQuotaExceeded
+		}
+	}
+	return nil
+}
+
+// isQuotaError reports whether the error is because the user ran out of tokens
+func isQuotaError(err error) bool {
+	return errors.Is(err, errDailyQuotaExceeded) || errors.Is(err, errMonthlyQuotaExceeded)
+}
+
+// usageSetup sets the token caps per user, 0 means no cap
+func usageSetup(conf config.Usage) {
+	// usage is only counted in firestore, caps without it would look configured but never stop anyone
+	if (conf.DailyTokenLimit > 0 || conf.MonthlyTokenLimit > 0) && firestoreClient == nil {
+		log.Fatal().
+			Int64("DailyTokenLimit", conf.DailyTokenLimit).
+			Int64("MonthlyTokenLimit", conf.MonthlyTokenLimit).
+			Msg("Token limits need firestore to count usage, configure firebase or set the limits to 0")
+	}
+	dailyTokenLimit = conf.DailyTokenLimit
+	monthlyTokenLimit = conf.MonthlyTokenLimit
+}
+
+// UsageResponse is the response of /api/getUsage.
+type UsageResponse struct {
+	Day          UsagePeriod `json:"day"`
+	Month        UsagePeriod `json:"month"`
+	DailyLimit   int64       `json:"daily_limit"`
+	MonthlyLimit int64       `json:"monthly_limit"`
+}
+
+// UsagePeriod is the token usage of a single day or month.
+type UsagePeriod struct {
+	Period           string `json:"period"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+	EmbeddingTokens  int64  `json:"embedding_tokens"`
+	EstimatedTokens  int64  `json:"estimated_tokens"`
+	TotalTokens      int64  `json:"total_tokens"`
+}
+
+func (r usageRecord) period() UsagePeriod {
+	return UsagePeriod{
+		Period:           r.Period,
+		PromptTokens:     r.PromptTokens,
+		CompletionTokens: r.CompletionTokens,
+		EmbeddingTokens:  r.EmbeddingTokens,
+		EstimatedTokens:  r.Estimated,
+		TotalTokens:      r.total(),
+	}
+}
+
+// GetUsageRequest is the request sent to /api/getUsage, Day is optional and defaults to today (UTC).
+type GetUsageRequest struct {
+	Day string `json:"day"`
+}
+
+// getUsageEndpoint is the endpoint at /api/getUsage, it returns the token usage of the user for a day and its month
+func getUsageEndpoint(c *gin.Context) {
+	c.Writer.Header().Set("Content-Type", "application/json")
+	var request GetUsageRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	day := time.Now().UTC()
+	if request.Day != "" {
+		var err error
+		if day, err = time.Parse(dayLayout, request.Day); err != nil {
+			c.JSON(http.StatusBadRequest, RequestErrorResult{
+				ErrorCode: InvalidRequestContent,
+				Content:   "Day must be formatted as YYYY-MM-DD",
+			})
+			return
+		}
+	}
+
+	uid := authenticatedUid(c)
+	dayUsage, err := getUsage(uid, day.Format(dayLayout))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to read usage",
+		})
+		return
+	}
+	monthUsage, err := getUsage(uid, day.Format(monthLayout))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to read usage",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, UsageResponse{
+		Day:          dayUsage.period(),
+		Month:        monthUsage.period(),
+		DailyLimit:   dailyTokenLimit,
+		MonthlyLimit: monthlyTokenLimit,
+	})
+}
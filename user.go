@@ -1,5 +1,10 @@
 package main
 
+import (
+	"github.com/abimek/opennote/keyring"
+	"strings"
+)
+
 type User struct {
 	Uid                 string `json:"Uid"`
 	OpenAIApiKey        string `json:"OpenAIApiKey"`
@@ -9,3 +14,124 @@ type User struct {
 	PineconeProjectName string `json:"PineconeProjectName"`
 	TopK                int64  `json:"TopK"`
 }
+
+// UserSettings is the public view of a User that is sent to the frontend, secrets are never included in full. The
+// masked keys are only there so the user can recognize which key is set, they're sent in their own fields so a client
+// saving the settings it got back doesn't overwrite the keys with their masks.
+type UserSettings struct {
+	Uid                  string `json:"Uid"`
+	OpenAIApiKeyMasked   string `json:"OpenAIApiKeyMasked"`
+	OpenAIApiKeySet      bool   `json:"OpenAIApiKeySet"`
+	PineconeApiKeyMasked string `json:"PineconeApiKeyMasked"`
+	PineconeApiKeySet    bool   `json:"PineconeApiKeySet"`
+	PineconeIndex        string `json:"PineconeIndex"`
+	PineconeEnvironment  string `json:"PineconeEnvironment"`
+	PineconeProjectName  string `json:"PineconeProjectName"`
+	TopK                 int64  `json:"TopK"`
+}
+
+// Settings returns the redacted view of the user.
+func (u User) Settings() UserSettings {
+	return UserSettings{
+		Uid:                  u.Uid,
+		OpenAIApiKeyMasked:   maskSecret(u.OpenAIApiKey),
+		OpenAIApiKeySet:      u.OpenAIApiKey != "",
+		PineconeApiKeyMasked: maskSecret(u.PineconeApiKey),
+		PineconeApiKeySet:    u.PineconeApiKey != "",
+		PineconeIndex:        u.PineconeIndex,
+		PineconeEnvironment:  u.PineconeEnvironment,
+		PineconeProjectName:  u.PineconeProjectName,
+		TopK:                 u.TopK,
+	}
+}
+
+// maskSecret hides all of a secret except a short prefix like "sk-" and the last 4 characters, "sk-...abcd". Short
+// secrets are masked completely so the mask never gives away most of the key.
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	if len(secret) < 12 {
+		return "****"
+	}
+	prefix := ""
+	if i := strings.Index(secret, "-"); i >= 0 && i < 4 {
+		prefix = secret[:i+1]
+	}
+	return prefix + "..." + secret[len(secret)-4:]
+}
+
+// userRecord is how a User is stored in firestore. The secret fields hold ciphertext sealed with the records own data
+// key, and the data key itself is stored wrapped by the master key of version KeyVersion. Records written before
+// encryption existed have no DataKey and their secret fields are still plaintext.
+type userRecord struct {
+	Uid                 string
+	OpenAIApiKey        string
+	PineconeApiKey      string
+	PineconeIndex       string
+	PineconeEnvironment string
+	PineconeProjectName string
+	TopK                int64
+
+	DataKey    string
+	KeyVersion int
+}
+
+// userKeyring holds the master keys that wrap the data key of every userRecord
+var userKeyring *keyring.Keyring
+
+// sealUser encrypts the secret fields of the user with a fresh data key.
+func sealUser(user User) (userRecord, error) {
+	dataKey, err := keyring.NewDataKey()
+	if err != nil {
+		return userRecord{}, err
+	}
+	wrapped, version, err := userKeyring.Wrap(dataKey)
+	if err != nil {
+		return userRecord{}, err
+	}
+	record := userRecord{
+		Uid:                 user.Uid,
+		PineconeIndex:       user.PineconeIndex,
+		PineconeEnvironment: user.PineconeEnvironment,
+		PineconeProjectName: user.PineconeProjectName,
+		TopK:                user.TopK,
+		DataKey:             wrapped,
+		KeyVersion:          version,
+	}
+	if record.OpenAIApiKey, err = keyring.Encrypt(dataKey, user.OpenAIApiKey, user.Uid); err != nil {
+		return userRecord{}, err
+	}
+	if record.PineconeApiKey, err = keyring.Encrypt(dataKey, user.PineconeApiKey, user.Uid); err != nil {
+		return userRecord{}, err
+	}
+	return record, nil
+}
+
+// open decrypts the record back into a User.
+func (r userRecord) open() (User, error) {
+	user := User{
+		Uid:                 r.Uid,
+		OpenAIApiKey:        r.OpenAIApiKey,
+		PineconeApiKey:      r.PineconeApiKey,
+		PineconeIndex:       r.PineconeIndex,
+		PineconeEnvironment: r.PineconeEnvironment,
+		PineconeProjectName: r.PineconeProjectName,
+		TopK:                r.TopK,
+	}
+	// legacy plaintext record
+	if r.DataKey == "" {
+		return user, nil
+	}
+	dataKey, err := userKeyring.Unwrap(r.DataKey, r.KeyVersion)
+	if err != nil {
+		return User{}, err
+	}
+	if user.OpenAIApiKey, err = keyring.Decrypt(dataKey, r.OpenAIApiKey, r.Uid); err != nil {
+		return User{}, err
+	}
+	if user.PineconeApiKey, err = keyring.Decrypt(dataKey, r.PineconeApiKey, r.Uid); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const (
+	minTopK = 1
+	maxTopK = 20
+)
+
+// pineconeEnvironments are the environments pinecone runs indexes in
+var pineconeEnvironments = map[string]bool{
+	"gcp-starter":                 true,
+	"us-west1-gcp-free":           true,
+	"asia-southeast1-gcp-free":    true,
+	"us-west1-gcp":                true,
+	"us-west4-gcp":                true,
+	"us-central1-gcp":             true,
+	"us-east1-gcp":                true,
+	"us-east4-gcp":                true,
+	"northamerica-northeast1-gcp": true,
+	"asia-northeast1-gcp":         true,
+	"asia-southeast1-gcp":         true,
+	"eu-west1-gcp":                true,
+	"eu-west4-gcp":                true,
+	"us-east-1-aws":               true,
+	"eastus-azure":                true,
+}
+
+var (
+	openAIKeyPattern       = regexp.MustCompile(`^sk-[A-Za-z0-9_-]{20,}$`)
+	pineconeKeyPattern     = regexp.MustCompile(`^([0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}|pcsk_[A-Za-z0-9_]{20,})$`)
+	pineconeIndexPattern   = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,43}[a-z0-9])?$`)
+	pineconeProjectPattern = regexp.MustCompile(`^[a-z0-9]{1,32}$`)
+)
+
+// PatchUserRequest is the request sent to PATCH /api/user, only the fields that are sent are changed.
+type PatchUserRequest struct {
+	OpenAIApiKey        *string `json:"OpenAIApiKey"`
+	PineconeApiKey      *string `json:"PineconeApiKey"`
+	PineconeIndex       *string `json:"PineconeIndex"`
+	PineconeEnvironment *string `json:"PineconeEnvironment"`
+	PineconeProjectName *string `json:"PineconeProjectName"`
+	TopK                *int64  `json:"TopK"`
+}
+
+// FieldErrorsResult is the response of a patch with invalid fields, Fields maps every invalid field to what's wrong
+// with it.
+type FieldErrorsResult struct {
+	ErrorCode WebsiteRequestError `json:"error_code"`
+	Content   string              `json:"content"`
+	Fields    map[string]string   `json:"fields"`
+}
+
+// validate returns the problems with the fields that were sent, keyed by field name
+func (r PatchUserRequest) validate() map[string]string {
+	problems := map[string]string{}
+	check := func(field string, value *string, valid func(string) bool, problem string) {
+		if value == nil {
+			return
+		}
+		if !valid(strings.TrimSpace(*value)) {
+			problems[field] = problem
+		}
+	}
+	check("OpenAIApiKey", r.OpenAIApiKey, openAIKeyPattern.MatchString, "must be an OpenAI API key starting with sk-")
+	check("PineconeApiKey", r.PineconeApiKey, pineconeKeyPattern.MatchString, "must be a Pinecone API key")
+	check("PineconeIndex", r.PineconeIndex, pineconeIndexPattern.MatchString,
+		"must be 1 to 45 lowercase letters, digits or dashes and can't start or end with a dash")
+	check("PineconeEnvironment", r.PineconeEnvironment, func(env string) bool {
+		return pineconeEnvironments[env]
+	}, "must be a Pinecone environment like us-west1-gcp")
+	check("PineconeProjectName", r.PineconeProjectName, pineconeProjectPattern.MatchString,
+		"must be the lowercase project id from the Pinecone console")
+	if r.TopK != nil && (*r.TopK < minTopK || *r.TopK > maxTopK) {
+		problems["TopK"] = "must be between 1 and 20"
+	}
+	return problems
+}
+
+// apply returns the user with the fields that were sent replaced
+func (r PatchUserRequest) apply(user User) User {
+	set := func(dst *string, value *string) {
+		if value != nil {
+			*dst = strings.TrimSpace(*value)
+		}
+	}
+	set(&user.OpenAIApiKey, r.OpenAIApiKey)
+	set(&user.PineconeApiKey, r.PineconeApiKey)
+	set(&user.PineconeIndex, r.PineconeIndex)
+	set(&user.PineconeEnvironment, r.PineconeEnvironment)
+	set(&user.PineconeProjectName, r.PineconeProjectName)
+	if r.TopK != nil {
+		user.TopK = *r.TopK
+	}
+	return user
+}
+
+// patchUserEndpoint is the endpoint at PATCH /api/user, it changes the settings of the authenticated user that are in
+// the request and leaves the rest alone. It answers with the redacted settings after the change.
+func patchUserEndpoint(c *gin.Context) {
+	var request PatchUserRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
+		})
+		return
+	}
+	if problems := request.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, FieldErrorsResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid settings",
+			Fields:    problems,
+		})
+		return
+	}
+
+	uid := authenticatedUid(c)
+	// the patch is applied in the transaction of the update, two patches at once each keep the fields of the other
+	user, err := updateUser(c.Request.Context(), uid, request.apply)
+	if errors.Is(err, errUserNotFound) {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: NonExistentUser,
+			Content:   "Unable to find user",
+		})
+		return
+	}
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", uid).
+			Msg("Unable to update user")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to update user",
+		})
+		return
+	}
+	reconfigureSession(c.Request.Context(), user)
+	c.JSON(http.StatusOK, user.Settings())
+}
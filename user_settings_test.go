@@ -0,0 +1,85 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestPatchUserRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		request PatchUserRequest
+		invalid []string
+	}{
+		{name: "empty", request: PatchUserRequest{}},
+		{
+			name: "valid",
+			request: PatchUserRequest{
+				OpenAIApiKey:        ptr("sk-abcdefghijklmnopqrstuvwx"),
+				PineconeApiKey:      ptr("0123abcd-0123-abcd-0123-0123456789ab"),
+				PineconeIndex:       ptr("my-notes"),
+				PineconeEnvironment: ptr("us-west1-gcp"),
+				PineconeProjectName: ptr("a1b2c3d"),
+				TopK:                ptr(int64(5)),
+			},
+		},
+		{name: "new pinecone key", request: PatchUserRequest{PineconeApiKey: ptr("pcsk_abcdefghijklmnopqrstuvwx")}},
+		{name: "surrounding spaces are trimmed", request: PatchUserRequest{PineconeIndex: ptr("  notes ")}},
+		{name: "bounds of TopK", request: PatchUserRequest{TopK: ptr(int64(maxTopK))}},
+		{name: "openai key without prefix", request: PatchUserRequest{OpenAIApiKey: ptr("abcdefghijklmnopqrstuvwx")}, invalid: []string{"OpenAIApiKey"}},
+		{name: "short openai key", request: PatchUserRequest{OpenAIApiKey: ptr("sk-short")}, invalid: []string{"OpenAIApiKey"}},
+		{name: "empty openai key", request: PatchUserRequest{OpenAIApiKey: ptr("")}, invalid: []string{"OpenAIApiKey"}},
+		{name: "pinecone key", request: PatchUserRequest{PineconeApiKey: ptr("not-a-key")}, invalid: []string{"PineconeApiKey"}},
+		{name: "index with a leading dash", request: PatchUserRequest{PineconeIndex: ptr("-notes")}, invalid: []string{"PineconeIndex"}},
+		{name: "uppercase index", request: PatchUserRequest{PineconeIndex: ptr("Notes")}, invalid: []string{"PineconeIndex"}},
+		{name: "unknown environment", request: PatchUserRequest{PineconeEnvironment: ptr("mars-1")}, invalid: []string{"PineconeEnvironment"}},
+		{name: "project", request: PatchUserRequest{PineconeProjectName: ptr("My Project")}, invalid: []string{"PineconeProjectName"}},
+		{name: "TopK too low", request: PatchUserRequest{TopK: ptr(int64(minTopK - 1))}, invalid: []string{"TopK"}},
+		{name: "TopK too high", request: PatchUserRequest{TopK: ptr(int64(maxTopK + 1))}, invalid: []string{"TopK"}},
+		{
+			name: "every invalid field is reported",
+			request: PatchUserRequest{
+				OpenAIApiKey:  ptr("nope"),
+				PineconeIndex: ptr("no_underscores"),
+				TopK:          ptr(int64(0)),
+			},
+			invalid: []string{"OpenAIApiKey", "PineconeIndex", "TopK"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var invalid []string
+			for field := range tt.request.validate() {
+				invalid = append(invalid, field)
+			}
+			sort.Strings(invalid)
+			if !reflect.DeepEqual(invalid, tt.invalid) {
+				t.Fatalf("invalid fields %v, want %v", invalid, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestPatchUserRequestApply(t *testing.T) {
+	stored := User{
+		OpenAIApiKey:        "sk-old",
+		PineconeApiKey:      "old-key",
+		PineconeIndex:       "notes",
+		PineconeEnvironment: "us-west1-gcp",
+		PineconeProjectName: "project",
+		TopK:                5,
+	}
+	want := stored
+	want.PineconeIndex = "other"
+	want.TopK = 9
+
+	got := PatchUserRequest{PineconeIndex: ptr(" other "), TopK: ptr(int64(9))}.apply(stored)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"errors"
+	"github.com/abimek/opennote/config"
+	"google.golang.org/api/iterator"
+)
+
+var errUserNotFound = errors.New("user not found")
+
+// UserStore stores the sealed userRecords, secrets are encrypted before they reach the store so every backend keeps
+// them encrypted at rest.
+type UserStore interface {
+	// Get returns errUserNotFound if there is no user with the uid
+	Get(ctx context.Context, uid string) (userRecord, error)
+	// Create stores the record unless a user with its uid exists, it returns whether the record was stored
+	Create(ctx context.Context, record userRecord) (bool, error)
+	// Update replaces the stored user with what mutate returns for it, reading and writing in one transaction so
+	// concurrent updates don't overwrite each other. mutate can be called more than once if the transaction is retried.
+	// It returns the stored record, or errUserNotFound if there is no user with the uid.
+	Update(ctx context.Context, uid string, mutate func(userRecord) (userRecord, error)) (userRecord, error)
+	// Delete removes the user, deleting a user that doesn't exist isn't an error
+	Delete(ctx context.Context, uid string) error
+	// List returns every stored user
+	List(ctx context.Context) ([]userRecord, error)
+	// Ping checks that the store can be reached, it's what /readyz reports
+	Ping(ctx context.Context) error
+	// Close releases the store when the server stops
+	Close() error
+}
+
+var userStore UserStore
+
+// userStoreSetup opens the configured store
+func userStoreSetup(conf config.Users) {
+	switch conf.Store {
+	case "firestore":
+		userStore = firestoreUserStore{client: firestoreClient}
+	case "memory":
+		userStore = newMemoryUserStore()
+	case "bolt":
+		store, err := openBoltUserStore(conf.Path)
+		if err != nil {
+			panic("Unable to open user store: " + err.Error())
+		}
+		userStore = store
+	default:
+		panic("Unknown user store " + conf.Store)
+	}
+}
+
+// findUser reads and decrypts the user with the uid
+func findUser(ctx context.Context, uid string) (User, error) {
+	record, err := userStore.Get(ctx, uid)
+	if err != nil {
+		return User{}, err
+	}
+	return record.open()
+}
+
+// updateUser decrypts the stored user, applies change to it and stores it sealed again in one transaction, it returns
+// the user as stored
+func updateUser(ctx context.Context, uid string, change func(User) User) (User, error) {
+	var updated User
+	_, err := userStore.Update(ctx, uid, func(record userRecord) (userRecord, error) {
+		user, err := record.open()
+		if err != nil {
+			return userRecord{}, err
+		}
+		updated = change(user)
+		updated.Uid = uid
+		return sealUser(updated)
+	})
+	if err != nil {
+		return User{}, err
+	}
+	return updated, nil
+}
+
+// firestoreUserStore keeps users in the users collection at users/{uid}
+type firestoreUserStore struct {
+	client *firestore.Client
+}
+
+func (s firestoreUserStore) users() *firestore.CollectionRef {
+	return s.client.Collection("users")
+}
+
+// missing reports whether a failed get was because the document doesn't exist
+func missing(doc *firestore.DocumentSnapshot) bool {
+	return doc != nil && !doc.Exists()
+}
+
+func (s firestoreUserStore) Get(ctx context.Context, uid string) (userRecord, error) {
+	doc, err := s.users().Doc(uid).Get(ctx)
+	if err != nil {
+		if missing(doc) {
+			return userRecord{}, errUserNotFound
+		}
+		return userRecord{}, err
+	}
+	return recordFromDoc(doc)
+}
+
+// Create checks and writes the document in one transaction, so concurrent signups of the same user can't both create
+// it
+func (s firestoreUserStore) Create(ctx context.Context, record userRecord) (bool, error) {
+	ref := s.users().Doc(record.Uid)
+	created := false
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		created = false
+		doc, err := tx.Get(ref)
+		if err == nil {
+			return nil
+		}
+		if !missing(doc) {
+			return err
+		}
+		created = true
+		return tx.Create(ref, record)
+	})
+	return created, err
+}
+
+func (s firestoreUserStore) Update(ctx context.Context, uid string, mutate func(userRecord) (userRecord, error)) (userRecord, error) {
+	ref := s.users().Doc(uid)
+	var updated userRecord
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			if missing(doc) {
+				return errUserNotFound
+			}
+			return err
+		}
+		record, err := recordFromDoc(doc)
+		if err != nil {
+			return err
+		}
+		updated, err = mutate(record)
+		if err != nil {
+			return err
+		}
+		return tx.Set(ref, updated)
+	})
+	if err != nil {
+		return userRecord{}, err
+	}
+	return updated, nil
+}
+
+func (s firestoreUserStore) Delete(ctx context.Context, uid string) error {
+	_, err := s.users().Doc(uid).Delete(ctx)
+	return err
+}
+
+// List only returns the documents at users/{uid}, legacy documents with random ids are left out
+func (s firestoreUserStore) List(ctx context.Context) ([]userRecord, error) {
+	iter := s.users().Documents(ctx)
+	defer iter.Stop()
+	var records []userRecord
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record, err := recordFromDoc(doc)
+		if err != nil {
+			return nil, err
+		}
+		// documents with random ids are left from before users/{uid}, "user migrate" merges them into it
+		if doc.Ref.ID != record.Uid {
+			continue
+		}
+		records = append(records, record)
+	}
+}
+
+func (s firestoreUserStore) Ping(ctx context.Context) error {
+	iter := s.users().Limit(1).Documents(ctx)
+	defer iter.Stop()
+	if _, err := iter.Next(); err != nil && err != iterator.Done {
+		return err
+	}
+	return nil
+}
+
+// Close does nothing, the firestore client is shared and closed on its own
+func (s firestoreUserStore) Close() error {
+	return nil
+}
+
+// recordFromDoc reads the record stored in a firestore document.
+func recordFromDoc(doc *firestore.DocumentSnapshot) (userRecord, error) {
+	var record userRecord
+	if err := doc.DataTo(&record); err != nil {
+		return userRecord{}, err
+	}
+	if record.Uid == "" {
+		return userRecord{}, errors.New("user document has no Uid")
+	}
+	return record, nil
+}
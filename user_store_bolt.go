@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var boltUsersBucket = []byte("users")
+
+// boltUserStore keeps users in an embedded bolt database file, it lets opennote be self hosted without a firebase
+// project. Records are stored as json keyed by uid.
+type boltUserStore struct {
+	db *bbolt.DB
+}
+
+func openBoltUserStore(path string) (*boltUserStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	// the timeout keeps a second server on the same file from hanging on the file lock
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltUsersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltUserStore{db: db}, nil
+}
+
+func (s *boltUserStore) Get(ctx context.Context, uid string) (userRecord, error) {
+	var record userRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		data := tx.Bucket(boltUsersBucket).Get([]byte(uid))
+		if data == nil {
+			return errUserNotFound
+		}
+		return json.Unmarshal(data, &record)
+	})
+	return record, err
+}
+
+func (s *boltUserStore) Create(ctx context.Context, record userRecord) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	created := false
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		if bucket.Get([]byte(record.Uid)) != nil {
+			return nil
+		}
+		created = true
+		return bucket.Put([]byte(record.Uid), data)
+	})
+	return created, err
+}
+
+func (s *boltUserStore) Update(ctx context.Context, uid string, mutate func(userRecord) (userRecord, error)) (userRecord, error) {
+	var updated userRecord
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(boltUsersBucket)
+		stored := bucket.Get([]byte(uid))
+		if stored == nil {
+			return errUserNotFound
+		}
+		var record userRecord
+		if err := json.Unmarshal(stored, &record); err != nil {
+			return err
+		}
+		var err error
+		updated, err = mutate(record)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(updated)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(uid), data)
+	})
+	if err != nil {
+		return userRecord{}, err
+	}
+	return updated, nil
+}
+
+func (s *boltUserStore) Delete(ctx context.Context, uid string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).Delete([]byte(uid))
+	})
+}
+
+func (s *boltUserStore) List(ctx context.Context) ([]userRecord, error) {
+	var records []userRecord
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(boltUsersBucket).ForEach(func(k, v []byte) error {
+			var record userRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			records = append(records, record)
+			return nil
+		})
+	})
+	return records, err
+}
+
+func (s *boltUserStore) Ping(ctx context.Context) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		if tx.Bucket(boltUsersBucket) == nil {
+			return errors.New("users bucket is missing")
+		}
+		return nil
+	})
+}
+
+// Close releases the database file
+func (s *boltUserStore) Close() error {
+	return s.db.Close()
+}
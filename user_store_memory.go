@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// memoryUserStore keeps users in memory, they are gone when the server stops. It is meant for tests and trying
+// opennote out locally.
+type memoryUserStore struct {
+	mu    sync.RWMutex
+	users map[string]userRecord
+}
+
+func newMemoryUserStore() *memoryUserStore {
+	return &memoryUserStore{users: map[string]userRecord{}}
+}
+
+func (s *memoryUserStore) Get(ctx context.Context, uid string) (userRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	record, ok := s.users[uid]
+	if !ok {
+		return userRecord{}, errUserNotFound
+	}
+	return record, nil
+}
+
+func (s *memoryUserStore) Create(ctx context.Context, record userRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.users[record.Uid]; ok {
+		return false, nil
+	}
+	s.users[record.Uid] = record
+	return true, nil
+}
+
+func (s *memoryUserStore) Update(ctx context.Context, uid string, mutate func(userRecord) (userRecord, error)) (userRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record, ok := s.users[uid]
+	if !ok {
+		return userRecord{}, errUserNotFound
+	}
+	updated, err := mutate(record)
+	if err != nil {
+		return userRecord{}, err
+	}
+	s.users[uid] = updated
+	return updated, nil
+}
+
+func (s *memoryUserStore) Delete(ctx context.Context, uid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, uid)
+	return nil
+}
+
+func (s *memoryUserStore) List(ctx context.Context) ([]userRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := make([]userRecord, 0, len(s.users))
+	for _, record := range s.users {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Uid < records[j].Uid
+	})
+	return records, nil
+}
+
+func (s *memoryUserStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryUserStore) Close() error {
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testUserStore runs the contract of UserStore against a new empty store
+func testUserStore(t *testing.T, open func(t *testing.T) UserStore) {
+	ctx := context.Background()
+	record := userRecord{
+		Uid:           "alice",
+		OpenAIApiKey:  "sealed-openai",
+		PineconeIndex: "notes",
+		TopK:          5,
+		DataKey:       "wrapped",
+		KeyVersion:    2,
+	}
+
+	t.Run("get missing", func(t *testing.T) {
+		store := open(t)
+		if _, err := store.Get(ctx, "nobody"); !errors.Is(err, errUserNotFound) {
+			t.Fatalf("got %v, want errUserNotFound", err)
+		}
+	})
+
+	t.Run("create and get", func(t *testing.T) {
+		store := open(t)
+		created, err := store.Create(ctx, record)
+		if err != nil || !created {
+			t.Fatalf("create: created %v, err %v", created, err)
+		}
+		got, err := store.Get(ctx, record.Uid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, record) {
+			t.Fatalf("got %+v, want %+v", got, record)
+		}
+	})
+
+	t.Run("create existing", func(t *testing.T) {
+		store := open(t)
+		if _, err := store.Create(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		other := record
+		other.TopK = 9
+		created, err := store.Create(ctx, other)
+		if err != nil || created {
+			t.Fatalf("second create: created %v, err %v", created, err)
+		}
+		got, _ := store.Get(ctx, record.Uid)
+		if got.TopK != record.TopK {
+			t.Fatalf("second create replaced the record, TopK is %d", got.TopK)
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		store := open(t)
+		setIndex := func(record userRecord) (userRecord, error) {
+			record.PineconeIndex = "other"
+			return record, nil
+		}
+		if _, err := store.Update(ctx, record.Uid, setIndex); !errors.Is(err, errUserNotFound) {
+			t.Fatalf("update of a missing user: got %v, want errUserNotFound", err)
+		}
+		if _, err := store.Create(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		updated, err := store.Update(ctx, record.Uid, setIndex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := record
+		want.PineconeIndex = "other"
+		if !reflect.DeepEqual(updated, want) {
+			t.Fatalf("update returned %+v, want %+v", updated, want)
+		}
+		got, _ := store.Get(ctx, record.Uid)
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	})
+
+	t.Run("update sees the stored record", func(t *testing.T) {
+		store := open(t)
+		if _, err := store.Create(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		increment := func(record userRecord) (userRecord, error) {
+			record.TopK++
+			return record, nil
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := store.Update(ctx, record.Uid, increment); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, _ := store.Get(ctx, record.Uid)
+		if got.TopK != record.TopK+2 {
+			t.Fatalf("TopK is %d after two increments of %d", got.TopK, record.TopK)
+		}
+	})
+
+	t.Run("failed update", func(t *testing.T) {
+		store := open(t)
+		if _, err := store.Create(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		errMutate := errors.New("mutate failed")
+		_, err := store.Update(ctx, record.Uid, func(r userRecord) (userRecord, error) {
+			r.TopK = 9
+			return r, errMutate
+		})
+		if !errors.Is(err, errMutate) {
+			t.Fatalf("got %v, want the error of mutate", err)
+		}
+		got, _ := store.Get(ctx, record.Uid)
+		if !reflect.DeepEqual(got, record) {
+			t.Fatalf("failed update stored %+v", got)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := open(t)
+		if err := store.Delete(ctx, "nobody"); err != nil {
+			t.Fatalf("deleting a missing user: %v", err)
+		}
+		if _, err := store.Create(ctx, record); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(ctx, record.Uid); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get(ctx, record.Uid); !errors.Is(err, errUserNotFound) {
+			t.Fatalf("got %v after delete, want errUserNotFound", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		store := open(t)
+		records, err := store.List(ctx)
+		if err != nil || len(records) != 0 {
+			t.Fatalf("empty store listed %v, err %v", records, err)
+		}
+		for _, uid := range []string{"carol", "alice", "bob"} {
+			r := record
+			r.Uid = uid
+			if _, err := store.Create(ctx, r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		records, err = store.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uids []string
+		for _, r := range records {
+			uids = append(uids, r.Uid)
+		}
+		if want := []string{"alice", "bob", "carol"}; !reflect.DeepEqual(uids, want) {
+			t.Fatalf("listed %v, want %v", uids, want)
+		}
+	})
+
+	t.Run("ping", func(t *testing.T) {
+		if err := open(t).Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestMemoryUserStore(t *testing.T) {
+	testUserStore(t, func(t *testing.T) UserStore {
+		return newMemoryUserStore()
+	})
+}
+
+func TestBoltUserStore(t *testing.T) {
+	testUserStore(t, func(t *testing.T) UserStore {
+		store, err := openBoltUserStore(filepath.Join(t.TempDir(), "users.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
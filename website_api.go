@@ -3,35 +3,73 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
 	"net/http"
 )
 
-// RequestErrorResult is the error result when something does go the right way.
+// RequestErrorResult is the error result when something does go the right way, ErrorCode is sent as its name like
+// "QuotaExceededError".
 type RequestErrorResult struct {
-	errorCode WebsiteRequestError `json:"error_code"`
-	content   string              `json:"content"`
+	ErrorCode WebsiteRequestError `json:"error_code"`
+	Content   string              `json:"content"`
 }
 
 func validateUID(uid string, c *gin.Context) bool {
 	valid := validateUIDBool(uid)
 	if !valid {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: NonExistentUser,
-			content:   "This user does not exist, invalid UID",
+			ErrorCode: NonExistentUser,
+			Content:   "This user does not exist, invalid UID",
 		})
 	}
 	return valid
 }
 
 func validateUIDBool(uid string) bool {
-	_, err := fireauthClient.GetUser(context.Background(), uid)
+	exists, err := authProvider.UserExists(context.Background(), uid)
+	return err == nil && exists
+}
+
+// sessionForRequest returns the session of the user, creating it from the stored user if the user doesn't
+// have one yet. It writes the error response itself and returns nil if there is no usable session.
+func sessionForRequest(c *gin.Context, uid string) *session {
+	sess := GetSessionIfExists(uid)
+	if sess != nil {
+		return sess
+	}
+	if !validateUID(uid, c) {
+		return nil
+	}
+
+	ctx, span := tracer.Start(c.Request.Context(), "users.find")
+	user, err := findUser(ctx, uid)
+	endSpan(span, err)
+	if errors.Is(err, errUserNotFound) {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to find user",
+		})
+		return nil
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Data Format Error",
+		})
+		return nil
+	}
+
+	sess, err = GetSession(c.Request.Context(), user)
 	if err != nil {
-		return false
+		c.JSON(http.StatusExpectationFailed, RequestErrorResult{
+			ErrorCode: InvalidCredsError,
+			Content:   "Expected valid credentials for user",
+		})
+		return nil
 	}
-	return true
+	return sess
 }
 
 // QueryMessageRequest is the request sent to /message when sending a users message to the endpoint.
@@ -47,58 +85,42 @@ func queryMessageEndpoint(c *gin.Context) {
 	var request QueryMessageRequest
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
 
-	sess := GetSessionIfExists(request.Uid)
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
+	sess := sessionForRequest(c, request.Uid)
 	if sess == nil {
-		if !validateUID(request.Uid, c) {
-			return
-		}
-
-		docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-		if err != nil || len(docs) == 0 {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Unable to find user in firestore",
-			})
-			return
-		}
-
-		jsonData, _ := json.Marshal(docs[0].Data())
-		var user User
-		if err = json.Unmarshal(jsonData, &user); err != nil {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Data Format Error",
-			})
-			return
-		}
-
-		sess, err = GetSession(user)
-		if err != nil {
-			c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-				errorCode: InvalidCredsError,
-				content:   "Expected valid credentials for user",
-			})
-			fmt.Println(err)
-			return
-		}
+		return
 	}
 
-	content, err := sess.Message(request.Chat)
+	content, err := sess.Message(c.Request.Context(), request.Chat)
 
+	if isQuotaError(err) {
+		c.JSON(http.StatusTooManyRequests, RequestErrorResult{
+			ErrorCode: QuotaExceededError,
+			Content:   "Token quota exceeded, " + err.Error(),
+		})
+		return
+	}
+	if isUnavailableError(err) {
+		upstreamUnavailable(c)
+		return
+	}
 	if err != nil {
-		sess.userMu.RLock()
-		sess.userMu.RUnlock()
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", request.Uid).
+			Msg("Unable to answer message")
 		c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-			errorCode: InvalidCredsError,
-			content:   "Expected valid credentials for user",
+			ErrorCode: InvalidCredsError,
+			Content:   "Expected valid credentials for user",
 		})
-		fmt.Println(err)
 		return
 	}
 	c.String(http.StatusOK, content)
@@ -116,42 +138,51 @@ func initEmptyUserEndpoint(c *gin.Context) {
 	var request WebsiteCreateUserRequest
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
 	if request.Uid == "" {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Empty UID",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Empty UID",
 		})
 		return
 	}
 	//validate UID as an account
 	if !validateUIDBool(request.Uid) {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "User does not exist",
+			ErrorCode: InvalidRequestContent,
+			Content:   "User does not exist",
 		})
 		return
 	}
-	docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-	if err == nil && len(docs) > 0 {
-		c.Status(http.StatusCreated)
-		return
-	}
-
 	user := User{}
 	user.Uid = request.Uid
 	user.TopK = 1
+	record, err := sealUser(user)
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", request.Uid).
+			Msg("Unable to seal user secrets")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Unable to create user",
+		})
+		return
+	}
 
-	// upload to firestore (user object) only if it doesn't exist,
-	_, _, err = firestoreClient.Collection("users").Add(context.Background(), user)
+	// store the user only if it doesn't exist,
+	_, err = userStore.Create(context.Background(), record)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: FirestoreError,
-			content:   "Unable to upload document to firestore",
+			ErrorCode: FirestoreError,
+			Content:   "Unable to create user",
 		})
 		return
 	}
@@ -169,41 +200,43 @@ func getUserEndpoint(c *gin.Context) {
 	c.Writer.Header().Set("Content-Type", "application/json")
 	var request GetUserRequest
 	if err := c.BindJSON(&request); err != nil {
-		fmt.Println("1")
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
 
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
 	if request.Uid == "" {
-		fmt.Println("2")
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Empty UID",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Empty UID",
 		})
 		return
 	}
-	fmt.Println(request)
 	if !validateUID(request.Uid, c) {
-		fmt.Println("4")
 		return
 	}
-	fmt.Println("5")
 
-	docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-	if err != nil || len(docs) == 0 {
-		fmt.Println("6")
+	user, err := findUser(c.Request.Context(), request.Uid)
+	if errors.Is(err, errUserNotFound) {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: FirestoreError,
-			content:   "Unable to find user in firestore",
+			ErrorCode: FirestoreError,
+			Content:   "Unable to find user",
 		})
 		return
 	}
-
-	doc := docs[0]
-	c.JSON(http.StatusOK, doc.Data())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Data Format Error",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, user.Settings())
 	return
 }
 
@@ -212,34 +245,51 @@ func validateCredentials(c *gin.Context) {
 	var request User
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
 
-	// Update Document
-	docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-	if err != nil || len(docs) == 0 {
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
+
+	// secrets are write only, so the frontend leaves them empty unless the user typed a new one
+	stored, err := findUser(c.Request.Context(), request.Uid)
+	if errors.Is(err, errUserNotFound) {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to find user",
+		})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: FirestoreError,
-			content:   "Unable to find user in firestore",
+			ErrorCode: FirestoreError,
+			Content:   "Data Format Error",
 		})
 		return
 	}
-	ses, err := GetSessionWithoutPermanance(request)
+	if request.OpenAIApiKey == "" {
+		request.OpenAIApiKey = stored.OpenAIApiKey
+	}
+	if request.PineconeApiKey == "" {
+		request.PineconeApiKey = stored.PineconeApiKey
+	}
+	ses, err := GetSessionWithoutPermanance(c.Request.Context(), request)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, RequestErrorResult{
-			errorCode: InvalidCredsError,
-			content:   "Invalid Credentials",
+			ErrorCode: InvalidCredsError,
+			Content:   "Invalid Credentials",
 		})
 		return
 	}
-	err = ses.ValidateCredentials()
+	err = ses.ValidateCredentials(c.Request.Context())
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, RequestErrorResult{
-			errorCode: InvalidCredsError,
-			content:   "Invalid Credentials",
+			ErrorCode: InvalidCredsError,
+			Content:   "Invalid Credentials",
 		})
 		return
 	}
@@ -247,48 +297,82 @@ func validateCredentials(c *gin.Context) {
 	return
 }
 
+// UpdateUserRequest is the request sent to /api/updateUser. The api keys are write only, leaving one empty keeps the key
+// that is already stored.
+type UpdateUserRequest struct {
+	Uid                 string `json:"Uid"`
+	OpenAIApiKey        string `json:"OpenAIApiKey"`
+	PineconeApiKey      string `json:"PineconeApiKey"`
+	PineconeIndex       string `json:"PineconeIndex"`
+	PineconeEnvironment string `json:"PineconeEnvironment"`
+	PineconeProjectName string `json:"PineconeProjectName"`
+	TopK                int64  `json:"TopK"`
+}
+
+// patch returns the request as the PatchUserRequest that makes the same change, so both endpoints validate and apply
+// settings the same way. Every field is replaced except secrets that were left empty.
+func (r UpdateUserRequest) patch() PatchUserRequest {
+	patch := PatchUserRequest{
+		PineconeIndex:       &r.PineconeIndex,
+		PineconeEnvironment: &r.PineconeEnvironment,
+		PineconeProjectName: &r.PineconeProjectName,
+		TopK:                &r.TopK,
+	}
+	if r.OpenAIApiKey != "" {
+		patch.OpenAIApiKey = &r.OpenAIApiKey
+	}
+	if r.PineconeApiKey != "" {
+		patch.PineconeApiKey = &r.PineconeApiKey
+	}
+	return patch
+}
+
 // updateUserEndpoint is the endpoint at /api/updateUser and allows the frontend to update what a specific user lookslike
 func updateUserEndpoint(c *gin.Context) {
 	c.Writer.Header().Set("Content-Type", "application/json")
-	var request User
+	var request UpdateUserRequest
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
 
-	// Update Document
-	docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-	if err != nil || len(docs) == 0 {
-		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: FirestoreError,
-			content:   "Unable to find user in firestore",
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
+	patch := request.patch()
+	if problems := patch.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, FieldErrorsResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid settings",
+			Fields:    problems,
 		})
 		return
 	}
 
-	// upload the info for the current session
-	if ses := GetSessionIfExists(request.Uid); ses != nil {
-		ses.userMu.Lock()
-		ses.user = request
-		ses.userMu.Unlock()
+	user, err := updateUser(c.Request.Context(), request.Uid, patch.apply)
+	if errors.Is(err, errUserNotFound) {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to find user",
+		})
+		return
 	}
-
-	doc := docs[0]
-	_, err = doc.Ref.Set(context.Background(), request)
 	if err != nil {
-		log.Error().
+		log.Ctx(c.Request.Context()).Error().
 			Err(err).
 			Str("User", request.Uid).
-			Msg("Unable to update firestore")
+			Msg("Unable to update user")
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: FirestoreError,
-			content:   "Unable to Update File in Firestore",
+			ErrorCode: FirestoreError,
+			Content:   "Unable to update user",
 		})
 		return
 	}
+	// upload the info for the current session
+	reconfigureSession(c.Request.Context(), user)
 	c.Status(http.StatusOK)
 }
 
@@ -298,58 +382,42 @@ func queryM(c *gin.Context) {
 	var request QueryMessageRequest
 	if err := c.BindJSON(&request); err != nil {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
 
-	sess := GetSessionIfExists(request.Uid)
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
+	sess := sessionForRequest(c, request.Uid)
 	if sess == nil {
-		if !validateUID(request.Uid, c) {
-			return
-		}
-
-		docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-		if err != nil || len(docs) == 0 {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Unable to find user in firestore",
-			})
-			return
-		}
-
-		jsonData, _ := json.Marshal(docs[0].Data())
-		var user User
-		if err = json.Unmarshal(jsonData, &user); err != nil {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Data Format Error",
-			})
-			return
-		}
-
-		sess, err = GetSession(user)
-		if err != nil {
-			c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-				errorCode: InvalidCredsError,
-				content:   "Expected valid credentials for user",
-			})
-			fmt.Println(err)
-			return
-		}
+		return
 	}
 
-	content, err := sess.Message(request.Chat)
+	content, err := sess.Message(c.Request.Context(), request.Chat)
 
+	if isQuotaError(err) {
+		c.JSON(http.StatusTooManyRequests, RequestErrorResult{
+			ErrorCode: QuotaExceededError,
+			Content:   "Token quota exceeded, " + err.Error(),
+		})
+		return
+	}
+	if isUnavailableError(err) {
+		upstreamUnavailable(c)
+		return
+	}
 	if err != nil {
-		sess.userMu.RLock()
-		sess.userMu.RUnlock()
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", request.Uid).
+			Msg("Unable to answer message")
 		c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-			errorCode: InvalidCredsError,
-			content:   "Expected valid credentials for user",
+			ErrorCode: InvalidCredsError,
+			Content:   "Expected valid credentials for user",
 		})
-		fmt.Println(err)
 		return
 	}
 	c.String(http.StatusOK, content)
@@ -358,7 +426,6 @@ func queryM(c *gin.Context) {
 // queryMessageEndpoint is the endpoint at /message and is the chatMessaging api. If the user exists it starts a chat
 // sessions with the openAI bot and enables it to query the users notes.
 func queryMessageEndpoint2(c *gin.Context) {
-	fmt.Println("YEET")
 	c.Writer.Header().Set("Content-Type", "text/event-stream")
 	c.Writer.Header().Set("Cache-Control", "no-cache")
 	c.Writer.Header().Set("Connection", "keep-alive")
@@ -367,67 +434,49 @@ func queryMessageEndpoint2(c *gin.Context) {
 	if head != "" {
 		if err := json.Unmarshal([]byte(head), &request); err != nil {
 			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: InvalidRequestContent,
-				content:   "Content doesn't match expected structure",
+				ErrorCode: InvalidRequestContent,
+				Content:   "Content doesn't match expected structure",
 			})
 			return
 		}
 
 	} else {
 		c.JSON(http.StatusBadRequest, RequestErrorResult{
-			errorCode: InvalidRequestContent,
-			content:   "Content doesn't match expected structure",
+			ErrorCode: InvalidRequestContent,
+			Content:   "Content doesn't match expected structure",
 		})
 		return
 	}
-	fmt.Println("HERE REACHED")
-	fmt.Println(request.Uid)
-	sess := GetSessionIfExists(request.Uid)
+	if !authorizeUid(c, &request.Uid) {
+		return
+	}
+	sess := sessionForRequest(c, request.Uid)
 	if sess == nil {
-		if !validateUID(request.Uid, c) {
-			return
-		}
-
-		docs, err := firestoreClient.Collection("users").Where("Uid", "==", request.Uid).Limit(1).Documents(context.Background()).GetAll()
-		if err != nil || len(docs) == 0 {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Unable to find user in firestore",
-			})
-			return
-		}
-
-		jsonData, _ := json.Marshal(docs[0].Data())
-		var user User
-		if err = json.Unmarshal(jsonData, &user); err != nil {
-			c.JSON(http.StatusBadRequest, RequestErrorResult{
-				errorCode: FirestoreError,
-				content:   "Data Format Error",
-			})
-			return
-		}
-
-		sess, err = GetSession(user)
-		if err != nil {
-			c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-				errorCode: InvalidCredsError,
-				content:   "Expected valid credentials for user",
-			})
-			fmt.Println(err)
-			return
-		}
+		return
 	}
 
 	content, err := sess.Message2(request.Chat, c)
 
+	if isQuotaError(err) {
+		c.JSON(http.StatusTooManyRequests, RequestErrorResult{
+			ErrorCode: QuotaExceededError,
+			Content:   "Token quota exceeded, " + err.Error(),
+		})
+		return
+	}
+	if isUnavailableError(err) {
+		upstreamUnavailable(c)
+		return
+	}
 	if err != nil {
-		sess.userMu.RLock()
-		sess.userMu.RUnlock()
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", request.Uid).
+			Msg("Unable to answer message")
 		c.JSON(http.StatusExpectationFailed, RequestErrorResult{
-			errorCode: InvalidCredsError,
-			content:   "Expected valid credentials for user",
+			ErrorCode: InvalidCredsError,
+			Content:   "Expected valid credentials for user",
 		})
-		fmt.Println(err)
 		return
 	}
 	c.String(http.StatusOK, content)
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"github.com/abimek/opennote/keyring"
+	"time"
+)
+
+// Roles of a workspace member. Readers can search the notes of the workspace, editors can also change its index
+// settings and read its pinecone key to index notes into it, the owner also manages the members and can delete it.
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleReader = "reader"
+)
+
+// roleRanks orders the roles, a role can do everything the roles ranked below it can
+var roleRanks = map[string]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+const (
+	// workspaceInvitePrefix marks invitations so they can't be mistaken for other tokens
+	workspaceInvitePrefix   = "onw_"
+	workspaceInviteLifetime = 7 * 24 * time.Hour
+)
+
+var (
+	errWorkspaceNotFound = errors.New("workspace not found")
+	errNotMember         = errors.New("not a member of the workspace")
+	errInviteInvalid     = errors.New("invitation is invalid or expired")
+)
+
+// Workspace is a shared pinecone index, its notes can be searched by every member with the members own OpenAI key.
+type Workspace struct {
+	Id                  string `json:"Id"`
+	Name                string `json:"Name"`
+	OwnerUid            string `json:"OwnerUid"`
+	PineconeApiKey      string `json:"PineconeApiKey"`
+	PineconeIndex       string `json:"PineconeIndex"`
+	PineconeEnvironment string `json:"PineconeEnvironment"`
+	PineconeProjectName string `json:"PineconeProjectName"`
+	TopK                int64  `json:"TopK"`
+}
+
+// WorkspaceSettings is the redacted view of a Workspace, like UserSettings the key is only masked.
+type WorkspaceSettings struct {
+	Id                  string `json:"Id"`
+	Name                string `json:"Name"`
+	OwnerUid            string `json:"OwnerUid"`
+	PineconeApiKey      string `json:"PineconeApiKey"`
+	PineconeApiKeySet   bool   `json:"PineconeApiKeySet"`
+	PineconeIndex       string `json:"PineconeIndex"`
+	PineconeEnvironment string `json:"PineconeEnvironment"`
+	PineconeProjectName string `json:"PineconeProjectName"`
+	TopK                int64  `json:"TopK"`
+}
+
+// Settings returns the redacted view of the workspace.
+func (w Workspace) Settings() WorkspaceSettings {
+	return WorkspaceSettings{
+		Id:                  w.Id,
+		Name:                w.Name,
+		OwnerUid:            w.OwnerUid,
+		PineconeApiKey:      maskSecret(w.PineconeApiKey),
+		PineconeApiKeySet:   w.PineconeApiKey != "",
+		PineconeIndex:       w.PineconeIndex,
+		PineconeEnvironment: w.PineconeEnvironment,
+		PineconeProjectName: w.PineconeProjectName,
+		TopK:                w.TopK,
+	}
+}
+
+// workspaceRecord is how a Workspace is stored at workspaces/{id}, the pinecone key is sealed the same way as the
+// secrets of a userRecord.
+type workspaceRecord struct {
+	Id                  string
+	Name                string
+	OwnerUid            string
+	PineconeApiKey      string
+	PineconeIndex       string
+	PineconeEnvironment string
+	PineconeProjectName string
+	TopK                int64
+	CreatedAt           time.Time
+
+	DataKey    string
+	KeyVersion int
+}
+
+// workspaceMember is a membership, stored at workspaceMembers/{workspace id}_{uid}
+type workspaceMember struct {
+	WorkspaceId string
+	Uid         string
+	Role        string
+	JoinedAt    time.Time
+}
+
+// workspaceInvite is an invitation waiting to be accepted, stored at workspaceInvites/{sha256 of the invitation}
+type workspaceInvite struct {
+	WorkspaceId string
+	Role        string
+	InvitedBy   string
+	ExpiresAt   time.Time
+}
+
+// validRole reports whether role can be given to a member, there is only ever one owner
+func validRole(role string) bool {
+	return role == RoleEditor || role == RoleReader
+}
+
+// allows reports whether a member with the role can do what needs the required role
+func (m workspaceMember) allows(required string) bool {
+	return roleRanks[m.Role] >= roleRanks[required]
+}
+
+// sealWorkspace encrypts the pinecone key of the workspace with a fresh data key.
+func sealWorkspace(workspace Workspace, createdAt time.Time) (workspaceRecord, error) {
+	dataKey, err := keyring.NewDataKey()
+	if err != nil {
+		return workspaceRecord{}, err
+	}
+	wrapped, version, err := userKeyring.Wrap(dataKey)
+	if err != nil {
+		return workspaceRecord{}, err
+	}
+	record := workspaceRecord{
+		Id:                  workspace.Id,
+		Name:                workspace.Name,
+		OwnerUid:            workspace.OwnerUid,
+		PineconeIndex:       workspace.PineconeIndex,
+		PineconeEnvironment: workspace.PineconeEnvironment,
+		PineconeProjectName: workspace.PineconeProjectName,
+		TopK:                workspace.TopK,
+		CreatedAt:           createdAt,
+		DataKey:             wrapped,
+		KeyVersion:          version,
+	}
+	if record.PineconeApiKey, err = keyring.Encrypt(dataKey, workspace.PineconeApiKey, workspace.Id); err != nil {
+		return workspaceRecord{}, err
+	}
+	return record, nil
+}
+
+// open decrypts the record back into a Workspace.
+func (r workspaceRecord) open() (Workspace, error) {
+	workspace := Workspace{
+		Id:                  r.Id,
+		Name:                r.Name,
+		OwnerUid:            r.OwnerUid,
+		PineconeIndex:       r.PineconeIndex,
+		PineconeEnvironment: r.PineconeEnvironment,
+		PineconeProjectName: r.PineconeProjectName,
+		TopK:                r.TopK,
+	}
+	dataKey, err := userKeyring.Unwrap(r.DataKey, r.KeyVersion)
+	if err != nil {
+		return Workspace{}, err
+	}
+	if workspace.PineconeApiKey, err = keyring.Decrypt(dataKey, r.PineconeApiKey, r.Id); err != nil {
+		return Workspace{}, err
+	}
+	return workspace, nil
+}
+
+func newWorkspaceId() (string, error) {
+	raw := make([]byte, 12)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return "ws_" + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+func workspaceDoc(id string) *firestore.DocumentRef {
+	return firestoreClient.Collection("workspaces").Doc(id)
+}
+
+func memberDoc(workspaceId string, uid string) *firestore.DocumentRef {
+	return firestoreClient.Collection("workspaceMembers").Doc(workspaceId + "_" + uid)
+}
+
+// getWorkspaceRecord returns errWorkspaceNotFound if there is no workspace with the id
+func getWorkspaceRecord(ctx context.Context, id string) (workspaceRecord, error) {
+	doc, err := workspaceDoc(id).Get(ctx)
+	if err != nil {
+		if missing(doc) {
+			return workspaceRecord{}, errWorkspaceNotFound
+		}
+		return workspaceRecord{}, err
+	}
+	var record workspaceRecord
+	if err := doc.DataTo(&record); err != nil {
+		return workspaceRecord{}, err
+	}
+	return record, nil
+}
+
+// findWorkspace reads and decrypts the workspace with the id
+func findWorkspace(ctx context.Context, id string) (Workspace, error) {
+	record, err := getWorkspaceRecord(ctx, id)
+	if err != nil {
+		return Workspace{}, err
+	}
+	return record.open()
+}
+
+// findMember returns errNotMember if the user isn't a member of the workspace
+func findMember(ctx context.Context, workspaceId string, uid string) (workspaceMember, error) {
+	doc, err := memberDoc(workspaceId, uid).Get(ctx)
+	if err != nil {
+		if missing(doc) {
+			return workspaceMember{}, errNotMember
+		}
+		return workspaceMember{}, err
+	}
+	var member workspaceMember
+	err = doc.DataTo(&member)
+	return member, err
+}
+
+// authorizeMember returns the membership of the user if their role allows what needs the required role, a user with a
+// lower role gets errNotMember too so they can't tell the workspace apart from one they can't see at all.
+func authorizeMember(ctx context.Context, workspaceId string, uid string, required string) (workspaceMember, error) {
+	member, err := findMember(ctx, workspaceId, uid)
+	if err != nil {
+		return workspaceMember{}, err
+	}
+	if !member.allows(required) {
+		return workspaceMember{}, errNotMember
+	}
+	return member, nil
+}
+
+// createWorkspace stores the workspace with a new id and makes its owner the first member
+func createWorkspace(ctx context.Context, workspace Workspace) (Workspace, error) {
+	id, err := newWorkspaceId()
+	if err != nil {
+		return Workspace{}, err
+	}
+	workspace.Id = id
+	now := time.Now()
+	record, err := sealWorkspace(workspace, now)
+	if err != nil {
+		return Workspace{}, err
+	}
+	batch := firestoreClient.Batch()
+	batch.Create(workspaceDoc(id), record)
+	batch.Create(memberDoc(id, workspace.OwnerUid), workspaceMember{
+		WorkspaceId: id,
+		Uid:         workspace.OwnerUid,
+		Role:        RoleOwner,
+		JoinedAt:    now,
+	})
+	if _, err := batch.Commit(ctx); err != nil {
+		return Workspace{}, err
+	}
+	return workspace, nil
+}
+
+// saveWorkspace seals the workspace and replaces the stored one
+func saveWorkspace(ctx context.Context, workspace Workspace) error {
+	stored, err := getWorkspaceRecord(ctx, workspace.Id)
+	if err != nil {
+		return err
+	}
+	record, err := sealWorkspace(workspace, stored.CreatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = workspaceDoc(workspace.Id).Set(ctx, record)
+	return err
+}
+
+// listMemberships returns the memberships of the user
+func listMemberships(ctx context.Context, uid string) ([]workspaceMember, error) {
+	return queryMembers(ctx, "Uid", uid)
+}
+
+// listMembers returns the members of the workspace
+func listMembers(ctx context.Context, workspaceId string) ([]workspaceMember, error) {
+	return queryMembers(ctx, "WorkspaceId", workspaceId)
+}
+
+func queryMembers(ctx context.Context, field string, value string) ([]workspaceMember, error) {
+	docs, err := firestoreClient.Collection("workspaceMembers").Where(field, "==", value).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	members := []workspaceMember{}
+	for _, doc := range docs {
+		var member workspaceMember
+		if err := doc.DataTo(&member); err != nil {
+			continue
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// deleteWorkspace removes the workspace with its memberships and invitations, the notes in its index are left alone
+// since the index belongs to whoever owns the pinecone project.
+func deleteWorkspace(ctx context.Context, id string) error {
+	if err := deleteWhere(ctx, "workspaceMembers", "WorkspaceId", id); err != nil {
+		return err
+	}
+	if err := deleteWhere(ctx, "workspaceInvites", "WorkspaceId", id); err != nil {
+		return err
+	}
+	if _, err := workspaceDoc(id).Delete(ctx); err != nil {
+		return err
+	}
+	forgetWorkspace(id, "")
+	return nil
+}
+
+// leaveWorkspaces deletes the workspaces the user owns and removes them from the rest, it is part of deleting their
+// account
+func leaveWorkspaces(ctx context.Context, uid string) error {
+	memberships, err := listMemberships(ctx, uid)
+	if err != nil {
+		return err
+	}
+	for _, member := range memberships {
+		if member.Role == RoleOwner {
+			err = deleteWorkspace(ctx, member.WorkspaceId)
+		} else {
+			_, err = memberDoc(member.WorkspaceId, uid).Delete(ctx)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createInvite returns a new invitation to the workspace, whoever accepts it joins with the role
+func createInvite(ctx context.Context, workspaceId string, role string, invitedBy string) (string, time.Time, error) {
+	invitation, err := newSecret(workspaceInvitePrefix)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresAt := time.Now().Add(workspaceInviteLifetime)
+	_, err = firestoreClient.Collection("workspaceInvites").Doc(hashAccessToken(invitation)).Create(ctx, workspaceInvite{
+		WorkspaceId: workspaceId,
+		Role:        role,
+		InvitedBy:   invitedBy,
+		ExpiresAt:   expiresAt,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return invitation, expiresAt, nil
+}
+
+// acceptInvite adds the user to the workspace of the invitation, invitations can only be used once. A user who is
+// already a member keeps their role.
+func acceptInvite(ctx context.Context, invitation string, uid string) (workspaceMember, error) {
+	inviteRef := firestoreClient.Collection("workspaceInvites").Doc(hashAccessToken(invitation))
+	var member workspaceMember
+	err := firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(inviteRef)
+		if err != nil {
+			if missing(doc) {
+				return errInviteInvalid
+			}
+			return err
+		}
+		var invite workspaceInvite
+		if err := doc.DataTo(&invite); err != nil {
+			return err
+		}
+		if time.Now().After(invite.ExpiresAt) {
+			return errInviteInvalid
+		}
+		ref := memberDoc(invite.WorkspaceId, uid)
+		existing, err := tx.Get(ref)
+		switch {
+		case err == nil:
+			if err := existing.DataTo(&member); err != nil {
+				return err
+			}
+		case missing(existing):
+			member = workspaceMember{
+				WorkspaceId: invite.WorkspaceId,
+				Uid:         uid,
+				Role:        invite.Role,
+				JoinedAt:    time.Now(),
+			}
+			if err := tx.Create(ref, member); err != nil {
+				return err
+			}
+		default:
+			return err
+		}
+		return tx.Delete(inviteRef)
+	})
+	return member, err
+}
+
+// workspaceIndex is a workspace whose notes a conversation searches
+type workspaceIndex struct {
+	id    string
+	name  string
+	topK  int64
+	index *pineconeIndex
+}
+
+// newWorkspaceIndex builds the pinecone client of the workspace
+func newWorkspaceIndex(workspace Workspace) workspaceIndex {
+	index := newPineconeIndex(workspace.PineconeApiKey, workspace.PineconeIndex, workspace.PineconeProjectName,
+		workspace.PineconeEnvironment)
+	return workspaceIndex{
+		id:    workspace.Id,
+		name:  workspace.Name,
+		topK:  workspace.TopK,
+		index: index,
+	}
+}
+
+// searchScope is which indexes query_notes searches, the personal index of the user and the workspaces that were
+// picked for the conversation
+type searchScope struct {
+	personal   bool
+	workspaces []workspaceIndex
+}
+
+// personalScope is the scope of a conversation that didn't pick any workspaces
+var personalScope = searchScope{personal: true}
+
+// personalScopeName stands for the personal index where a scope is picked with a list of workspace ids
+const personalScopeName = "personal"
+
+// workspace returns the index of the workspace if it is in the scope
+func (s searchScope) workspace(id string) (workspaceIndex, bool) {
+	for _, w := range s.workspaces {
+		if w.id == id {
+			return w, true
+		}
+	}
+	return workspaceIndex{}, false
+}
+
+// resolveSearchScope checks that the user can read every workspace and builds their clients
+func resolveSearchScope(ctx context.Context, uid string, personal bool, workspaceIds []string) (searchScope, error) {
+	scope := searchScope{personal: personal}
+	for _, id := range workspaceIds {
+		if _, ok := scope.workspace(id); ok {
+			continue
+		}
+		if _, err := authorizeMember(ctx, id, uid, RoleReader); err != nil {
+			return searchScope{}, err
+		}
+		workspace, err := findWorkspace(ctx, id)
+		if err != nil {
+			return searchScope{}, err
+		}
+		scope.workspaces = append(scope.workspaces, newWorkspaceIndex(workspace))
+	}
+	return scope, nil
+}
+
+// forgetWorkspace removes the workspace from the search scope of live sessions, of every session if uid is empty. It
+// is called when a member loses access, so a conversation can't keep searching a workspace after being removed.
+func forgetWorkspace(workspaceId string, uid string) {
+	sessionsMutex.Lock()
+	live := make([]*session, 0, len(sessions))
+	for id, s := range sessions {
+		if uid == "" || id == uid {
+			live = append(live, s)
+		}
+	}
+	sessionsMutex.Unlock()
+	for _, s := range live {
+		s.updateSearchScope(func(scope searchScope) searchScope {
+			kept := scope.workspaces[:0:0]
+			for _, w := range scope.workspaces {
+				if w.id != workspaceId {
+					kept = append(kept, w)
+				}
+			}
+			scope.workspaces = kept
+			return scope
+		})
+	}
+}
+
+// reloadWorkspace replaces the client of the workspace in the search scope of every live session after its settings
+// changed
+func reloadWorkspace(workspace Workspace) {
+	sessionsMutex.Lock()
+	live := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		live = append(live, s)
+	}
+	sessionsMutex.Unlock()
+	for _, s := range live {
+		s.updateSearchScope(func(scope searchScope) searchScope {
+			workspaces := make([]workspaceIndex, len(scope.workspaces))
+			for i, w := range scope.workspaces {
+				if w.id == workspace.Id {
+					w = newWorkspaceIndex(workspace)
+				}
+				workspaces[i] = w
+			}
+			scope.workspaces = workspaces
+			return scope
+		})
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/nekomeowww/go-pinecone"
+	"github.com/rs/zerolog/log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// workspaceError writes the response for an error reading a workspace. Workspaces the user can't access are reported
+// as missing, so ids of other teams can't be probed.
+func workspaceError(c *gin.Context, err error) {
+	if errors.Is(err, errNotMember) || errors.Is(err, errWorkspaceNotFound) {
+		c.JSON(http.StatusNotFound, RequestErrorResult{
+			ErrorCode: NonExistentWorkspace,
+			Content:   "Unable to find workspace",
+		})
+		return
+	}
+	log.Ctx(c.Request.Context()).Error().
+		Err(err).
+		Str("User", authenticatedUid(c)).
+		Msg("Unable to read workspace")
+	c.JSON(http.StatusInternalServerError, RequestErrorResult{
+		ErrorCode: FirestoreError,
+		Content:   "Unable to read workspace",
+	})
+}
+
+func invalidWorkspaceRequest(c *gin.Context) {
+	c.JSON(http.StatusBadRequest, RequestErrorResult{
+		ErrorCode: InvalidRequestContent,
+		Content:   "Content doesn't match expected structure",
+	})
+}
+
+// WorkspaceRequest is the request of the endpoints that only need the id of the workspace
+type WorkspaceRequest struct {
+	Id string `json:"id"`
+}
+
+// WorkspaceSettingsRequest is the request sent to /api/workspaces/create and /api/workspaces/update, update only changes
+// the fields that are sent while create needs all of them.
+type WorkspaceSettingsRequest struct {
+	Id                  string  `json:"id"`
+	Name                *string `json:"Name"`
+	PineconeApiKey      *string `json:"PineconeApiKey"`
+	PineconeIndex       *string `json:"PineconeIndex"`
+	PineconeEnvironment *string `json:"PineconeEnvironment"`
+	PineconeProjectName *string `json:"PineconeProjectName"`
+	TopK                *int64  `json:"TopK"`
+}
+
+const (
+	maxWorkspaceNameLength = 64
+	defaultWorkspaceTopK   = 3
+)
+
+// validate returns the problems with the fields that were sent, the pinecone fields are checked like the ones of a user
+func (r WorkspaceSettingsRequest) validate() map[string]string {
+	problems := PatchUserRequest{
+		PineconeApiKey:      r.PineconeApiKey,
+		PineconeIndex:       r.PineconeIndex,
+		PineconeEnvironment: r.PineconeEnvironment,
+		PineconeProjectName: r.PineconeProjectName,
+		TopK:                r.TopK,
+	}.validate()
+	if r.Name != nil {
+		name := strings.TrimSpace(*r.Name)
+		if name == "" || len(name) > maxWorkspaceNameLength {
+			problems["Name"] = "must be 1 to 64 characters"
+		}
+	}
+	return problems
+}
+
+// missing returns the fields create needs that weren't sent
+func (r WorkspaceSettingsRequest) missing() map[string]string {
+	problems := map[string]string{}
+	if r.Name == nil {
+		problems["Name"] = "is required"
+	}
+	if r.PineconeApiKey == nil {
+		problems["PineconeApiKey"] = "is required"
+	}
+	if r.PineconeIndex == nil {
+		problems["PineconeIndex"] = "is required"
+	}
+	if r.PineconeEnvironment == nil {
+		problems["PineconeEnvironment"] = "is required"
+	}
+	if r.PineconeProjectName == nil {
+		problems["PineconeProjectName"] = "is required"
+	}
+	return problems
+}
+
+// apply returns the workspace with the fields that were sent replaced
+func (r WorkspaceSettingsRequest) apply(workspace Workspace) Workspace {
+	set := func(dst *string, value *string) {
+		if value != nil {
+			*dst = strings.TrimSpace(*value)
+		}
+	}
+	set(&workspace.Name, r.Name)
+	set(&workspace.PineconeApiKey, r.PineconeApiKey)
+	set(&workspace.PineconeIndex, r.PineconeIndex)
+	set(&workspace.PineconeEnvironment, r.PineconeEnvironment)
+	set(&workspace.PineconeProjectName, r.PineconeProjectName)
+	if r.TopK != nil {
+		workspace.TopK = *r.TopK
+	}
+	return workspace
+}
+
+// validateWorkspaceIndex checks that the pinecone credentials of the workspace work, it writes the error response
+// itself and returns false if they don't
+func validateWorkspaceIndex(c *gin.Context, workspace Workspace) bool {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
+	defer cancel()
+	if _, err := newWorkspaceIndex(workspace).index.DescribeIndexStats(ctx, pinecone.DescribeIndexStatsParams{}); err != nil {
+		c.JSON(http.StatusExpectationFailed, RequestErrorResult{
+			ErrorCode: InvalidCredsError,
+			Content:   "Invalid Pinecone Credentials",
+		})
+		return false
+	}
+	return true
+}
+
+// createWorkspaceEndpoint is the endpoint at /api/workspaces/create, the user creating the workspace becomes its owner
+func createWorkspaceEndpoint(c *gin.Context) {
+	var request WorkspaceSettingsRequest
+	if err := c.BindJSON(&request); err != nil {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	problems := request.validate()
+	for field, problem := range request.missing() {
+		problems[field] = problem
+	}
+	if len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, FieldErrorsResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid workspace settings",
+			Fields:    problems,
+		})
+		return
+	}
+	workspace := request.apply(Workspace{
+		OwnerUid: authenticatedUid(c),
+		TopK:     defaultWorkspaceTopK,
+	})
+	if !validateWorkspaceIndex(c, workspace) {
+		return
+	}
+	workspace, err := createWorkspace(c.Request.Context(), workspace)
+	if err != nil {
+		log.Ctx(c.Request.Context()).Error().
+			Err(err).
+			Str("User", authenticatedUid(c)).
+			Msg("Unable to create workspace")
+		c.JSON(http.StatusInternalServerError, RequestErrorResult{
+			ErrorCode: FirestoreError,
+			Content:   "Unable to create workspace",
+		})
+		return
+	}
+	c.JSON(http.StatusCreated, workspace.Settings())
+}
+
+// WorkspaceMembership is a workspace the user belongs to and their role in it
+type WorkspaceMembership struct {
+	Workspace WorkspaceSettings `json:"workspace"`
+	Role      string            `json:"role"`
+}
+
+// listWorkspacesEndpoint is the endpoint at /api/workspaces/list, it lists the workspaces of the user
+func listWorkspacesEndpoint(c *gin.Context) {
+	ctx := c.Request.Context()
+	memberships, err := listMemberships(ctx, authenticatedUid(c))
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	result := []WorkspaceMembership{}
+	for _, member := range memberships {
+		workspace, err := findWorkspace(ctx, member.WorkspaceId)
+		if err != nil {
+			// a membership can outlive a workspace that was deleted halfway
+			continue
+		}
+		result = append(result, WorkspaceMembership{
+			Workspace: workspace.Settings(),
+			Role:      member.Role,
+		})
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// WorkspaceMemberInfo is a member as listed by /api/workspaces/get
+type WorkspaceMemberInfo struct {
+	Uid      string    `json:"uid"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// WorkspaceResponse is the response of /api/workspaces/get
+type WorkspaceResponse struct {
+	WorkspaceMembership
+	Members []WorkspaceMemberInfo `json:"members"`
+}
+
+// getWorkspaceEndpoint is the endpoint at /api/workspaces/get, every member can see the settings and members
+func getWorkspaceEndpoint(c *gin.Context) {
+	var request WorkspaceRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	member, err := authorizeMember(ctx, request.Id, authenticatedUid(c), RoleReader)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	workspace, err := findWorkspace(ctx, request.Id)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	members, err := listMembers(ctx, request.Id)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	infos := make([]WorkspaceMemberInfo, 0, len(members))
+	for _, m := range members {
+		infos = append(infos, WorkspaceMemberInfo{Uid: m.Uid, Role: m.Role, JoinedAt: m.JoinedAt})
+	}
+	c.JSON(http.StatusOK, WorkspaceResponse{
+		WorkspaceMembership: WorkspaceMembership{
+			Workspace: workspace.Settings(),
+			Role:      member.Role,
+		},
+		Members: infos,
+	})
+}
+
+// updateWorkspaceEndpoint is the endpoint at /api/workspaces/update, editors and the owner can change the settings
+func updateWorkspaceEndpoint(c *gin.Context) {
+	var request WorkspaceSettingsRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	if problems := request.validate(); len(problems) > 0 {
+		c.JSON(http.StatusBadRequest, FieldErrorsResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid workspace settings",
+			Fields:    problems,
+		})
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := authorizeMember(ctx, request.Id, authenticatedUid(c), RoleEditor); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	stored, err := findWorkspace(ctx, request.Id)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	workspace := request.apply(stored)
+	indexChanged := workspace.PineconeApiKey != stored.PineconeApiKey ||
+		workspace.PineconeIndex != stored.PineconeIndex ||
+		workspace.PineconeEnvironment != stored.PineconeEnvironment ||
+		workspace.PineconeProjectName != stored.PineconeProjectName
+	if indexChanged && !validateWorkspaceIndex(c, workspace) {
+		return
+	}
+	if err := saveWorkspace(ctx, workspace); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	reloadWorkspace(workspace)
+	c.JSON(http.StatusOK, workspace.Settings())
+}
+
+// workspaceCredentialsEndpoint is the endpoint at /api/workspaces/credentials, it returns the unredacted pinecone
+// settings so editors can point their notes plugin at the workspace index
+func workspaceCredentialsEndpoint(c *gin.Context) {
+	var request WorkspaceRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := authorizeMember(ctx, request.Id, authenticatedUid(c), RoleEditor); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	workspace, err := findWorkspace(ctx, request.Id)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, workspace)
+}
+
+// deleteWorkspaceEndpoint is the endpoint at /api/workspaces/delete, only the owner can delete a workspace
+func deleteWorkspaceEndpoint(c *gin.Context) {
+	var request WorkspaceRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := authorizeMember(ctx, request.Id, authenticatedUid(c), RoleOwner); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	if err := deleteWorkspace(ctx, request.Id); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+// InviteRequest is the request sent to /api/workspaces/invite, Role is editor or reader
+type InviteRequest struct {
+	Id   string `json:"id"`
+	Role string `json:"role"`
+}
+
+// InviteResponse is the response of /api/workspaces/invite, the invitation is shown once and can be used once
+type InviteResponse struct {
+	Invitation string    `json:"invitation"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// inviteEndpoint is the endpoint at /api/workspaces/invite, the owner shares the invitation with whoever should join
+func inviteEndpoint(c *gin.Context) {
+	var request InviteRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" || !validRole(request.Role) {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	uid := authenticatedUid(c)
+	if _, err := authorizeMember(ctx, request.Id, uid, RoleOwner); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	invitation, expiresAt, err := createInvite(ctx, request.Id, request.Role, uid)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, InviteResponse{
+		Invitation: invitation,
+		ExpiresAt:  expiresAt,
+	})
+}
+
+// JoinWorkspaceRequest is the request sent to /api/workspaces/join
+type JoinWorkspaceRequest struct {
+	Invitation string `json:"invitation"`
+}
+
+// joinWorkspaceEndpoint is the endpoint at /api/workspaces/join, it accepts an invitation
+func joinWorkspaceEndpoint(c *gin.Context) {
+	var request JoinWorkspaceRequest
+	if err := c.BindJSON(&request); err != nil || !strings.HasPrefix(request.Invitation, workspaceInvitePrefix) {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	member, err := acceptInvite(ctx, request.Invitation, authenticatedUid(c))
+	if errors.Is(err, errInviteInvalid) {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "Invalid or expired invitation",
+		})
+		return
+	}
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	workspace, err := findWorkspace(ctx, member.WorkspaceId)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, WorkspaceMembership{
+		Workspace: workspace.Settings(),
+		Role:      member.Role,
+	})
+}
+
+// MemberRequest is the request sent to /api/workspaces/setRole and /api/workspaces/removeMember, Role is only used by
+// setRole
+type MemberRequest struct {
+	Id   string `json:"id"`
+	Uid  string `json:"uid"`
+	Role string `json:"role"`
+}
+
+// setRoleEndpoint is the endpoint at /api/workspaces/setRole, the owner can make members editors or readers
+func setRoleEndpoint(c *gin.Context) {
+	var request MemberRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" || request.Uid == "" || !validRole(request.Role) {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	if _, err := authorizeMember(ctx, request.Id, authenticatedUid(c), RoleOwner); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	member, err := findMember(ctx, request.Id, request.Uid)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	if member.Role == RoleOwner {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "The owner's role can't be changed",
+		})
+		return
+	}
+	member.Role = request.Role
+	if _, err := memberDoc(request.Id, request.Uid).Set(ctx, member); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, WorkspaceMemberInfo{Uid: member.Uid, Role: member.Role, JoinedAt: member.JoinedAt})
+}
+
+// removeMemberEndpoint is the endpoint at /api/workspaces/removeMember, the owner can remove anyone else and members
+// can remove themselves to leave. The owner can't leave, they delete the workspace instead.
+func removeMemberEndpoint(c *gin.Context) {
+	var request MemberRequest
+	if err := c.BindJSON(&request); err != nil || request.Id == "" || request.Uid == "" {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	ctx := c.Request.Context()
+	uid := authenticatedUid(c)
+	required := RoleOwner
+	if request.Uid == uid {
+		required = RoleReader
+	}
+	if _, err := authorizeMember(ctx, request.Id, uid, required); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	member, err := findMember(ctx, request.Id, request.Uid)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	if member.Role == RoleOwner {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "The owner can't leave the workspace, delete it instead",
+		})
+		return
+	}
+	if _, err := memberDoc(request.Id, request.Uid).Delete(ctx); err != nil {
+		workspaceError(c, err)
+		return
+	}
+	forgetWorkspace(request.Id, request.Uid)
+	c.Status(http.StatusOK)
+}
+
+// ConversationWorkspaces is the request and response of /api/conversation/workspaces. Personal is whether the users
+// own index is searched, Workspaces are the ids of the workspaces that are searched.
+type ConversationWorkspaces struct {
+	Personal   bool     `json:"personal"`
+	Workspaces []string `json:"workspaces"`
+}
+
+func conversationWorkspaces(scope searchScope) ConversationWorkspaces {
+	result := ConversationWorkspaces{
+		Personal:   scope.personal,
+		Workspaces: []string{},
+	}
+	for _, w := range scope.workspaces {
+		result.Workspaces = append(result.Workspaces, w.id)
+	}
+	return result
+}
+
+// getConversationWorkspacesEndpoint is the endpoint at GET /api/conversation/workspaces, it returns which indexes
+// query_notes searches in the conversation of the session
+func getConversationWorkspacesEndpoint(c *gin.Context) {
+	sess := sessionForRequest(c, authenticatedUid(c))
+	if sess == nil {
+		return
+	}
+	c.JSON(http.StatusOK, conversationWorkspaces(sess.searchScope()))
+}
+
+// setConversationWorkspacesEndpoint is the endpoint at POST /api/conversation/workspaces, it picks which indexes
+// query_notes searches in the conversation of the session. Conversations start out searching only the personal index.
+func setConversationWorkspacesEndpoint(c *gin.Context) {
+	var request ConversationWorkspaces
+	if err := c.BindJSON(&request); err != nil {
+		invalidWorkspaceRequest(c)
+		return
+	}
+	if !request.Personal && len(request.Workspaces) == 0 {
+		c.JSON(http.StatusBadRequest, RequestErrorResult{
+			ErrorCode: InvalidRequestContent,
+			Content:   "At least one index has to be searched",
+		})
+		return
+	}
+	if len(request.Workspaces) > 0 && firestoreClient == nil {
+		c.JSON(http.StatusNotImplemented, RequestErrorResult{
+			ErrorCode: ServerError,
+			Content:   "Workspaces aren't available on this server",
+		})
+		return
+	}
+	uid := authenticatedUid(c)
+	sess := sessionForRequest(c, uid)
+	if sess == nil {
+		return
+	}
+	scope, err := resolveSearchScope(c.Request.Context(), uid, request.Personal, request.Workspaces)
+	if err != nil {
+		workspaceError(c, err)
+		return
+	}
+	sess.setSearchScope(scope)
+	c.JSON(http.StatusOK, conversationWorkspaces(scope))
+}